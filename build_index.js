@@ -1,47 +1,122 @@
 // build_index.js (R2 version)
 //
-// Scan R2 bucket objects under data/posts/<userId>/<postId>.json
+// Scan R2 bucket objects under data/posts/<userId>/<postId>.json (or .json.gz /
+// .json.zst when the harvester stored them compressed) and the packed per-user
+// segments data/posts/<userId>.vseg, in any of the harvester's layouts (flat, or
+// sharded as data/posts/ab/cd/<userId>/...),
 // and build a compact index file stored back in R2 as data/posts_index.json.
 //
 // Run this whenever you add new harvested posts to R2:
 //    node build_index.js
 //
-// Required environment variables:
-//   R2_ENDPOINT            - e.g. https://87608ec3a41373ce7bc458d103de0201.r2.cloudflarestorage.com
-//   R2_BUCKET              - e.g. viner
-//   R2_ACCESS_KEY_ID
-//   R2_SECRET_ACCESS_KEY
-// Optional:
-//   R2_DATA_PREFIX         - root prefix for archive data (default: "data")
+// S3/R2 configuration (environment; the AWS/S3 name or the R2_* one):
+//   S3_ENDPOINT | R2_ENDPOINT | AWS_ENDPOINT_URL_S3 | AWS_ENDPOINT_URL
+//                   S3-compatible endpoint (unset = AWS S3)
+//   R2_BUCKET | S3_BUCKET            (default: "viner")
+//   R2_DATA_PREFIX | S3_DATA_PREFIX  (default: "data")
+//   AWS_ACCESS_KEY_ID + AWS_SECRET_ACCESS_KEY (+ AWS_SESSION_TOKEN), or
+//   R2_ACCESS_KEY_ID + R2_SECRET_ACCESS_KEY; without either, the standard
+//                   credential chain (AWS_PROFILE, ~/.aws files, SSO, ...)
+//   AWS_REGION | R2_REGION           (default: "auto" with an endpoint)
+//   S3_FORCE_PATH_STYLE | R2_FORCE_PATH_STYLE
+//                   path-style URLs (default: true with an endpoint)
+//   AWS_CA_BUNDLE | R2_CA_BUNDLE     PEM file with extra CAs to trust
+//   AWS_MAX_ATTEMPTS | R2_MAX_ATTEMPTS, AWS_RETRY_MODE | R2_RETRY_MODE
+// These are the same variables the Go harvester reads.
 //
 // NOTE: This version does NOT use the local filesystem for posts/index;
 // everything is read from and written to R2.
 
 const { S3Client, ListObjectsV2Command, GetObjectCommand, PutObjectCommand } = require("@aws-sdk/client-s3");
 const { Readable } = require("stream");
+const fs = require("fs");
+const https = require("https");
+const tls = require("tls");
+const zlib = require("zlib");
 
-// ---- R2 config ----
+// ---- S3/R2 config ----
 
-const R2_ENDPOINT = process.env.R2_ENDPOINT;
-const R2_BUCKET = process.env.R2_BUCKET || "viner";
-const R2_ACCESS_KEY_ID = process.env.R2_ACCESS_KEY_ID;
-const R2_SECRET_ACCESS_KEY = process.env.R2_SECRET_ACCESS_KEY;
-const R2_DATA_PREFIX = (process.env.R2_DATA_PREFIX || "data").replace(/^\/+|\/+$/g, ""); // trim slashes
+const R2_BUCKET = process.env.R2_BUCKET || process.env.S3_BUCKET || "viner";
+const R2_DATA_PREFIX = (process.env.R2_DATA_PREFIX || process.env.S3_DATA_PREFIX || "data").replace(/^\/+|\/+$/g, "");
 
-if (!R2_ENDPOINT || !R2_ACCESS_KEY_ID || !R2_SECRET_ACCESS_KEY) {
-    console.error("Missing required R2 env vars. Need R2_ENDPOINT, R2_ACCESS_KEY_ID, R2_SECRET_ACCESS_KEY");
+// Each setting takes the AWS/S3 name or the R2_* name, in the same order as
+// the Go harvester (vine-harvester/internal/s3store/s3store.go), so one env file configures both.
+function env(...names) {
+    for (const name of names) {
+        if (process.env[name]) return process.env[name];
+    }
+    return undefined;
+}
+
+function configError(msg) {
+    console.error(`S3/R2 config: ${msg}`);
     process.exit(1);
 }
 
-const s3 = new S3Client({
-    region: "auto",
-    endpoint: R2_ENDPOINT,
-    credentials: {
-        accessKeyId: R2_ACCESS_KEY_ID,
-        secretAccessKey: R2_SECRET_ACCESS_KEY,
-    },
-    forcePathStyle: true,
-});
+function s3ClientConfig() {
+    const endpoint = env("S3_ENDPOINT", "R2_ENDPOINT", "AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL");
+    const cfg = {
+        // Without a region the SDK falls back to the profile's.
+        region: env("AWS_REGION", "R2_REGION", "AWS_DEFAULT_REGION") || (endpoint ? "auto" : undefined),
+        endpoint,
+        forcePathStyle: Boolean(endpoint),
+    };
+
+    // Static keys, taken as pairs; without them the SDK's default chain
+    // applies (AWS_PROFILE and ~/.aws/config + credentials, SSO, instance roles).
+    let keys = null;
+    if (process.env.AWS_ACCESS_KEY_ID) {
+        keys = {
+            accessKeyId: process.env.AWS_ACCESS_KEY_ID,
+            secretAccessKey: process.env.AWS_SECRET_ACCESS_KEY,
+            sessionToken: process.env.AWS_SESSION_TOKEN || undefined,
+        };
+    } else if (process.env.R2_ACCESS_KEY_ID) {
+        keys = {
+            accessKeyId: process.env.R2_ACCESS_KEY_ID,
+            secretAccessKey: process.env.R2_SECRET_ACCESS_KEY,
+        };
+    }
+    if (keys) {
+        if (!keys.secretAccessKey) configError(`access key ${keys.accessKeyId} is set without its secret access key`);
+        cfg.credentials = keys;
+    }
+
+    const pathStyle = env("S3_FORCE_PATH_STYLE", "R2_FORCE_PATH_STYLE");
+    if (pathStyle !== undefined) {
+        if (/^(1|t|true)$/i.test(pathStyle)) cfg.forcePathStyle = true;
+        else if (/^(0|f|false)$/i.test(pathStyle)) cfg.forcePathStyle = false;
+        else configError(`S3_FORCE_PATH_STYLE: want true or false, got "${pathStyle}"`);
+    }
+
+    const attempts = env("AWS_MAX_ATTEMPTS", "R2_MAX_ATTEMPTS");
+    if (attempts !== undefined) {
+        cfg.maxAttempts = Number(attempts);
+        if (!Number.isInteger(cfg.maxAttempts) || cfg.maxAttempts < 1) {
+            configError(`AWS_MAX_ATTEMPTS: want a positive number, got "${attempts}"`);
+        }
+    }
+    const retryMode = env("AWS_RETRY_MODE", "R2_RETRY_MODE");
+    if (retryMode !== undefined) {
+        if (!["standard", "adaptive"].includes(retryMode)) configError(`AWS_RETRY_MODE: want standard or adaptive, got "${retryMode}"`);
+        cfg.retryMode = retryMode;
+    }
+
+    const caBundle = env("AWS_CA_BUNDLE", "R2_CA_BUNDLE");
+    if (caBundle) {
+        let ca;
+        try {
+            ca = fs.readFileSync(caBundle);
+        } catch (err) {
+            configError(`CA bundle: ${err.message}`);
+        }
+        // An agent's ca replaces Node's built-in roots, so keep those too.
+        cfg.requestHandler = { httpsAgent: new https.Agent({ keepAlive: true, ca: [...tls.rootCertificates, ca] }) };
+    }
+    return cfg;
+}
+
+const s3 = new S3Client(s3ClientConfig());
 
 // Utility: turn R2 Body stream into a string
 async function streamToString(body) {
@@ -50,7 +125,22 @@ async function streamToString(body) {
     for await (const chunk of Readable.from(body)) {
         chunks.push(typeof chunk === "string" ? Buffer.from(chunk) : chunk);
     }
-    return Buffer.concat(chunks).toString("utf8");
+    return decodeStored(Buffer.concat(chunks)).toString("utf8");
+}
+
+// Stored post JSON may be compressed by the harvester's -storageCodec
+// (.json.gz / .json.zst); decode by magic bytes so either form works.
+function decodeStored(buf) {
+    if (buf.length >= 2 && buf[0] === 0x1f && buf[1] === 0x8b) {
+        return zlib.gunzipSync(buf);
+    }
+    if (buf.length >= 4 && buf.readUInt32LE(0) === 0xfd2fb528) {
+        if (!zlib.zstdDecompressSync) {
+            throw new Error("zstd-compressed object needs Node 22.15+");
+        }
+        return zlib.zstdDecompressSync(buf);
+    }
+    return buf;
 }
 
 function joinKey(...parts) {
@@ -82,6 +172,54 @@ async function* listAllObjects(prefix) {
     }
 }
 
+const STORED_JSON_RE = /\.json(\.gz|\.zst)?$/;
+
+// Packed segments (vine_full_harvest.go -postLayout packed) end with the offset
+// of their last index block and the magic "VSEGIDX1". Each index block is
+// 'I' uvarint(len) JSON {"prev": offset|-1, "posts": {"<postId>": [off, len]}};
+// following prev back and letting newer entries win gives every post's data.
+function readSegmentIndex(buf) {
+    if (buf.length < 16 || buf.toString("latin1", buf.length - 8) !== "VSEGIDX1") {
+        throw new Error("missing segment trailer");
+    }
+    const chain = [];
+    let off = Number(buf.readBigUInt64BE(buf.length - 16));
+    while (off >= 0) {
+        if (off >= buf.length || buf[off] !== 0x49 /* 'I' */ || chain.length > buf.length / 16) {
+            throw new Error("corrupt segment index");
+        }
+        let pos = off + 1;
+        let len = 0;
+        for (let shift = 0; ; shift += 7) {
+            const b = buf[pos++];
+            len += (b & 0x7f) * 2 ** shift;
+            if (b < 0x80) break;
+        }
+        const blk = JSON.parse(buf.toString("utf8", pos, pos + len));
+        chain.push(blk.posts || {});
+        off = blk.prev;
+    }
+    const index = {};
+    for (let i = chain.length - 1; i >= 0; i--) {
+        Object.assign(index, chain[i]);
+    }
+    return index;
+}
+
+async function readObject(key) {
+    const resp = await s3.send(
+        new GetObjectCommand({
+            Bucket: R2_BUCKET,
+            Key: key,
+        })
+    );
+    const chunks = [];
+    for await (const chunk of Readable.from(resp.Body)) {
+        chunks.push(typeof chunk === "string" ? Buffer.from(chunk) : chunk);
+    }
+    return Buffer.concat(chunks);
+}
+
 async function main() {
     const postsPrefix = joinKey(R2_DATA_PREFIX, "posts") + "/";
 
@@ -100,16 +238,63 @@ async function main() {
         return Number.isNaN(ts) ? 0 : ts;
     }
 
+    function toRecord(json, userId, postId) {
+        const created = json.created || json.created_at || json.creationDate || "";
+
+        return {
+            userId: String(json.userIdStr || json.userId || userId),
+            postId: String(json.postIdStr || json.postId || postId),
+            username: json.username || json.author || "",
+            description:
+                json.description ||
+                json.descriptionPlain ||
+                (json.caption && json.caption.text) ||
+                "",
+            thumbnailUrl: json.thumbnailUrl || null,
+            created,
+            createdTs: parseCreated(created),
+            loops: json.loops || json.loopCount || 0,
+            likes: json.likes || json.likeCount || 0,
+            comments: json.comments || json.commentCount || 0,
+            reposts: json.reposts || json.repostCount || 0,
+        };
+    }
+
     for await (const obj of listAllObjects(postsPrefix)) {
         const key = obj.Key;
-        if (!key.endsWith(".json")) continue;
-
-        // Expect keys like: data/posts/<userId>/<postId>.json
         const rel = key.substring(postsPrefix.length);
+
+        // Packed segment: data/posts/[shards/]<userId>.vseg, one GET for all
+        // its posts. seg lets index.js fetch a single post with a ranged GET.
+        if (rel.endsWith(".vseg")) {
+            const userId = rel.split("/").pop().replace(/\.vseg$/, "");
+            let buf, index;
+            try {
+                buf = await readObject(key);
+                index = readSegmentIndex(buf);
+            } catch (e) {
+                console.warn("Failed to read segment", key, e.message);
+                continue;
+            }
+            for (const [postId, [off, len]] of Object.entries(index)) {
+                let json;
+                try {
+                    json = JSON.parse(decodeStored(buf.subarray(off, off + len)).toString("utf8"));
+                } catch {
+                    continue;
+                }
+                posts.push({ ...toRecord(json, userId, postId), seg: [off, len] });
+            }
+            continue;
+        }
+
+        if (!STORED_JSON_RE.test(key)) continue;
+
+        // Expect keys like: data/posts/[shards/]<userId>/<postId>.json
         const parts = rel.split("/");
-        if (parts.length !== 2) continue;
-        const [userId, fileName] = parts;
-        const postId = fileName.replace(/\.json$/, "");
+        if (parts.length < 2) continue;
+        const [userId, fileName] = parts.slice(-2);
+        const postId = fileName.replace(STORED_JSON_RE, "");
 
         let body;
         try {
@@ -132,27 +317,7 @@ async function main() {
             continue;
         }
 
-        const created = json.created || json.created_at || json.creationDate || "";
-
-        const rec = {
-            userId: String(json.userIdStr || json.userId || userId),
-            postId: String(json.postIdStr || json.postId || postId),
-            username: json.username || json.author || "",
-            description:
-                json.description ||
-                json.descriptionPlain ||
-                (json.caption && json.caption.text) ||
-                "",
-            thumbnailUrl: json.thumbnailUrl || null,
-            created,
-            createdTs: parseCreated(created),
-            loops: json.loops || json.loopCount || 0,
-            likes: json.likes || json.likeCount || 0,
-            comments: json.comments || json.commentCount || 0,
-            reposts: json.reposts || json.repostCount || 0,
-        };
-
-        posts.push(rec);
+        posts.push(toRecord(json, userId, postId));
     }
 
     console.log("Posts scanned from R2:", posts.length);
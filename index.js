@@ -12,22 +12,36 @@
 //   GET /api/lookup/post/:postId
 //
 // All post JSON files are read from R2 at:
-//   data/posts/<userId>/<postId>.json
+//   data/posts/<userId>/<postId>.json (or .json.gz / .json.zst)
+//   or, for packed users, ranges of data/posts/<userId>.vseg
+// with shard directories in between (data/posts/ab/cd/<userId>/...) when
+// data/layout.json says the harvester used a hashed layout.
 //
-// Required environment variables:
-//   R2_ENDPOINT
-//   R2_BUCKET
-//   R2_ACCESS_KEY_ID
-//   R2_SECRET_ACCESS_KEY
-// Optional:
-//   R2_DATA_PREFIX  (default: "data")
+// S3/R2 configuration (environment; the AWS/S3 name or the R2_* one):
+//   S3_ENDPOINT | R2_ENDPOINT | AWS_ENDPOINT_URL_S3 | AWS_ENDPOINT_URL
+//                   S3-compatible endpoint (unset = AWS S3)
+//   R2_BUCKET | S3_BUCKET            (default: "viner")
+//   R2_DATA_PREFIX | S3_DATA_PREFIX  (default: "data")
+//   AWS_ACCESS_KEY_ID + AWS_SECRET_ACCESS_KEY (+ AWS_SESSION_TOKEN), or
+//   R2_ACCESS_KEY_ID + R2_SECRET_ACCESS_KEY; without either, the standard
+//                   credential chain (AWS_PROFILE, ~/.aws files, SSO, ...)
+//   AWS_REGION | R2_REGION           (default: "auto" with an endpoint)
+//   S3_FORCE_PATH_STYLE | R2_FORCE_PATH_STYLE
+//                   path-style URLs (default: true with an endpoint)
+//   AWS_CA_BUNDLE | R2_CA_BUNDLE     PEM file with extra CAs to trust
+//   AWS_MAX_ATTEMPTS | R2_MAX_ATTEMPTS, AWS_RETRY_MODE | R2_RETRY_MODE
+// These are the same variables the Go harvester reads.
 
 const http = require("http");
+const https = require("https");
+const tls = require("tls");
 const path = require("path");
 const url = require("url");
 const fs = require("fs");
 const fsp = require("fs/promises");
 const { Readable } = require("stream");
+const crypto = require("crypto");
+const zlib = require("zlib");
 const {
     S3Client,
     GetObjectCommand,
@@ -35,28 +49,89 @@ const {
 
 const PORT = process.env.PORT ? Number(process.env.PORT) : 3000;
 
-// --- R2 config ---
+// --- S3/R2 config ---
 
-const R2_ENDPOINT = process.env.R2_ENDPOINT;
-const R2_BUCKET = process.env.R2_BUCKET || "viner";
-const R2_ACCESS_KEY_ID = process.env.R2_ACCESS_KEY_ID;
-const R2_SECRET_ACCESS_KEY = process.env.R2_SECRET_ACCESS_KEY;
-const R2_DATA_PREFIX = (process.env.R2_DATA_PREFIX || "data").replace(/^\/+|\/+$/g, "");
+const R2_BUCKET = process.env.R2_BUCKET || process.env.S3_BUCKET || "viner";
+const R2_DATA_PREFIX = (process.env.R2_DATA_PREFIX || process.env.S3_DATA_PREFIX || "data").replace(/^\/+|\/+$/g, "");
 
-if (!R2_ENDPOINT || !R2_ACCESS_KEY_ID || !R2_SECRET_ACCESS_KEY) {
-    console.error("Missing required R2 env vars. Need R2_ENDPOINT, R2_ACCESS_KEY_ID, R2_SECRET_ACCESS_KEY");
+// Each setting takes the AWS/S3 name or the R2_* name, in the same order as
+// the Go harvester (vine-harvester/internal/s3store/s3store.go), so one env file configures both.
+function env(...names) {
+    for (const name of names) {
+        if (process.env[name]) return process.env[name];
+    }
+    return undefined;
+}
+
+function configError(msg) {
+    console.error(`S3/R2 config: ${msg}`);
     process.exit(1);
 }
 
-const s3 = new S3Client({
-    region: "auto",
-    endpoint: R2_ENDPOINT,
-    credentials: {
-        accessKeyId: R2_ACCESS_KEY_ID,
-        secretAccessKey: R2_SECRET_ACCESS_KEY,
-    },
-    forcePathStyle: true,
-});
+function s3ClientConfig() {
+    const endpoint = env("S3_ENDPOINT", "R2_ENDPOINT", "AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL");
+    const cfg = {
+        // Without a region the SDK falls back to the profile's.
+        region: env("AWS_REGION", "R2_REGION", "AWS_DEFAULT_REGION") || (endpoint ? "auto" : undefined),
+        endpoint,
+        forcePathStyle: Boolean(endpoint),
+    };
+
+    // Static keys, taken as pairs; without them the SDK's default chain
+    // applies (AWS_PROFILE and ~/.aws/config + credentials, SSO, instance roles).
+    let keys = null;
+    if (process.env.AWS_ACCESS_KEY_ID) {
+        keys = {
+            accessKeyId: process.env.AWS_ACCESS_KEY_ID,
+            secretAccessKey: process.env.AWS_SECRET_ACCESS_KEY,
+            sessionToken: process.env.AWS_SESSION_TOKEN || undefined,
+        };
+    } else if (process.env.R2_ACCESS_KEY_ID) {
+        keys = {
+            accessKeyId: process.env.R2_ACCESS_KEY_ID,
+            secretAccessKey: process.env.R2_SECRET_ACCESS_KEY,
+        };
+    }
+    if (keys) {
+        if (!keys.secretAccessKey) configError(`access key ${keys.accessKeyId} is set without its secret access key`);
+        cfg.credentials = keys;
+    }
+
+    const pathStyle = env("S3_FORCE_PATH_STYLE", "R2_FORCE_PATH_STYLE");
+    if (pathStyle !== undefined) {
+        if (/^(1|t|true)$/i.test(pathStyle)) cfg.forcePathStyle = true;
+        else if (/^(0|f|false)$/i.test(pathStyle)) cfg.forcePathStyle = false;
+        else configError(`S3_FORCE_PATH_STYLE: want true or false, got "${pathStyle}"`);
+    }
+
+    const attempts = env("AWS_MAX_ATTEMPTS", "R2_MAX_ATTEMPTS");
+    if (attempts !== undefined) {
+        cfg.maxAttempts = Number(attempts);
+        if (!Number.isInteger(cfg.maxAttempts) || cfg.maxAttempts < 1) {
+            configError(`AWS_MAX_ATTEMPTS: want a positive number, got "${attempts}"`);
+        }
+    }
+    const retryMode = env("AWS_RETRY_MODE", "R2_RETRY_MODE");
+    if (retryMode !== undefined) {
+        if (!["standard", "adaptive"].includes(retryMode)) configError(`AWS_RETRY_MODE: want standard or adaptive, got "${retryMode}"`);
+        cfg.retryMode = retryMode;
+    }
+
+    const caBundle = env("AWS_CA_BUNDLE", "R2_CA_BUNDLE");
+    if (caBundle) {
+        let ca;
+        try {
+            ca = fs.readFileSync(caBundle);
+        } catch (err) {
+            configError(`CA bundle: ${err.message}`);
+        }
+        // An agent's ca replaces Node's built-in roots, so keep those too.
+        cfg.requestHandler = { httpsAgent: new https.Agent({ keepAlive: true, ca: [...tls.rootCertificates, ca] }) };
+    }
+    return cfg;
+}
+
+const s3 = new S3Client(s3ClientConfig());
 
 function joinKey(...parts) {
     return parts
@@ -71,7 +146,22 @@ async function streamToString(body) {
     for await (const chunk of Readable.from(body)) {
         chunks.push(typeof chunk === "string" ? Buffer.from(chunk) : chunk);
     }
-    return Buffer.concat(chunks).toString("utf8");
+    return decodeStored(Buffer.concat(chunks)).toString("utf8");
+}
+
+// Stored post JSON may be compressed by the harvester's -storageCodec
+// (.json.gz / .json.zst); decode by magic bytes so either form works.
+function decodeStored(buf) {
+    if (buf.length >= 2 && buf[0] === 0x1f && buf[1] === 0x8b) {
+        return zlib.gunzipSync(buf);
+    }
+    if (buf.length >= 4 && buf.readUInt32LE(0) === 0xfd2fb528) {
+        if (!zlib.zstdDecompressSync) {
+            throw new Error("zstd-compressed object needs Node 22.15+");
+        }
+        return zlib.zstdDecompressSync(buf);
+    }
+    return buf;
 }
 
 // --- Local static/public paths ---
@@ -224,12 +314,15 @@ async function loadIndex() {
     );
 }
 
-// ------------ Fetch single post JSON from R2 ------------
+// ------------ Archive layout ------------
 
-async function fetchPostJson(userId, postId) {
-    const numericPostId = postId.replace(/[^0-9]/g, "");
-    const key = joinKey(R2_DATA_PREFIX, "posts", userId, numericPostId + ".json");
+// Shard levels of the harvester's layout (flat = 0, hash1 = 1, hash2 = 2),
+// read from data/layout.json at startup.
+let layoutLevels = 0;
 
+async function loadLayout() {
+    const key = joinKey(R2_DATA_PREFIX, "layout.json");
+    let state;
     try {
         const resp = await s3.send(
             new GetObjectCommand({
@@ -237,12 +330,152 @@ async function fetchPostJson(userId, postId) {
                 Key: key,
             })
         );
-        const body = await streamToString(resp.Body);
-        return JSON.parse(body);
+        state = JSON.parse(await streamToString(resp.Body));
     } catch (e) {
-        console.error("Error reading post JSON from R2:", key, e.message);
-        return null;
+        if (e.name === "NoSuchKey") return; // flat
+        throw new Error(`Failed to read ${key} from R2: ${e.message}`);
+    }
+    const levels = { flat: 0, hash1: 1, hash2: 2 }[state.layout];
+    if (levels === undefined || state.migratingTo) {
+        throw new Error(`Unsupported archive layout in ${key}: ${JSON.stringify(state)}`);
+    }
+    layoutLevels = levels;
+    console.log("Archive layout:", state.layout);
+}
+
+// userKey returns the key of an entry belonging to userId under
+// data/posts, with the layout's shard directories (hex SHA-256 prefix).
+function userKey(userId, name) {
+    const hash = crypto.createHash("sha256").update(String(userId)).digest("hex");
+    const shards = [];
+    for (let i = 0; i < layoutLevels; i++) {
+        shards.push(hash.substr(2 * i, 2));
+    }
+    return joinKey(R2_DATA_PREFIX, "posts", ...shards, name);
+}
+
+// ------------ Fetch single post JSON from R2 ------------
+
+// getRange returns bytes [start, end] of key, still encoded, and the total
+// object size. A negative start asks for the last -start bytes.
+async function getRange(key, start, end) {
+    const resp = await s3.send(
+        new GetObjectCommand({
+            Bucket: R2_BUCKET,
+            Key: key,
+            Range: start < 0 ? `bytes=${start}` : `bytes=${start}-${end}`,
+        })
+    );
+    const chunks = [];
+    for await (const chunk of Readable.from(resp.Body)) {
+        chunks.push(typeof chunk === "string" ? Buffer.from(chunk) : chunk);
+    }
+    const m = /\/(\d+)$/.exec(resp.ContentRange || "");
+    return { buf: Buffer.concat(chunks), size: m ? Number(m[1]) : undefined };
+}
+
+function readUvarint(buf, pos) {
+    let n = 0;
+    for (let shift = 0; pos < buf.length; shift += 7) {
+        const b = buf[pos++];
+        n += (b & 0x7f) * 2 ** shift;
+        if (b < 0x80) return [n, pos];
+    }
+    throw new Error("truncated varint");
+}
+
+// postIdOf is the ID a post JSON carries, the way the harvester reads it.
+function postIdOf(json) {
+    if (json && typeof json.postIdStr === "string" && json.postIdStr) return json.postIdStr;
+    if (json && typeof json.postId === "number") return BigInt(Math.round(json.postId)).toString();
+    return "";
+}
+
+// findSegmentPost looks postId up in the segment's own index, following the
+// chain of index blocks back from the trailer (newer blocks win). It returns
+// [off, len] of the post's data, or null.
+async function findSegmentPost(key, postId) {
+    const { buf: tail, size } = await getRange(key, -16);
+    if (tail.length !== 16 || tail.toString("latin1", 8) !== "VSEGIDX1") {
+        throw new Error("missing segment trailer");
+    }
+    let off = Number(tail.readBigUInt64BE(0));
+    for (let blocks = 0; off >= 0; blocks++) {
+        if (blocks > 64 || (size !== undefined && off >= size)) {
+            throw new Error("corrupt segment index");
+        }
+        const { buf: head } = await getRange(key, off, off + 10);
+        if (head[0] !== 0x49 /* 'I' */) throw new Error("corrupt segment index");
+        const [len, pos] = readUvarint(head, 1);
+        const { buf: raw } = await getRange(key, off + pos, off + pos + len - 1);
+        const blk = JSON.parse(raw.toString("utf8"));
+        if (blk.posts && blk.posts[postId]) return blk.posts[postId];
+        off = blk.prev;
+    }
+    return null;
+}
+
+async function readSegmentRange(key, [off, len]) {
+    const { buf } = await getRange(key, off, off + len - 1);
+    return JSON.parse(decodeStored(buf).toString("utf8"));
+}
+
+async function fetchPostJson(userId, postId) {
+    const numericPostId = postId.replace(/[^0-9]/g, "");
+
+    // Posts packed into the user's segment: one ranged GET at the offset
+    // build_index.js recorded. Compaction moves posts around, so a range that
+    // no longer holds the post is looked up again in the segment's index.
+    const rec = postIdIndex.get(numericPostId);
+    if (rec && rec.seg && String(rec.userId) === String(userId)) {
+        const key = userKey(userId, userId + ".vseg");
+        try {
+            let json = null;
+            try {
+                json = await readSegmentRange(key, rec.seg);
+            } catch (e) {
+                if (e.name === "NoSuchKey") throw e;
+            }
+            if (postIdOf(json) === numericPostId) return json;
+
+            const seg = await findSegmentPost(key, numericPostId);
+            if (seg) {
+                json = await readSegmentRange(key, seg);
+                if (postIdOf(json) === numericPostId) {
+                    rec.seg = seg;
+                    return json;
+                }
+            }
+            console.error("Error reading post JSON from R2:", key, numericPostId, "not in segment");
+            return null;
+        } catch (e) {
+            console.error("Error reading post JSON from R2:", key, e.message);
+            return null;
+        }
+    }
+
+    const base = userKey(userId, joinKey(userId, numericPostId + ".json"));
+
+    // Plain first, then the compressed forms the harvester can store.
+    for (const ext of ["", ".gz", ".zst"]) {
+        const key = base + ext;
+        try {
+            const resp = await s3.send(
+                new GetObjectCommand({
+                    Bucket: R2_BUCKET,
+                    Key: key,
+                })
+            );
+            const body = await streamToString(resp.Body);
+            return JSON.parse(body);
+        } catch (e) {
+            if (e.name === "NoSuchKey") continue;
+            console.error("Error reading post JSON from R2:", key, e.message);
+            return null;
+        }
     }
+    console.error("Error reading post JSON from R2:", base, "not found");
+    return null;
 }
 
 // ------------ HTTP server ------------
@@ -348,7 +581,8 @@ const server = http.createServer(async (req, res) => {
 
 // ------------ Startup ------------
 
-loadIndex()
+loadLayout()
+    .then(loadIndex)
     .then(() => {
         server.listen(PORT, () => {
             console.log(`Server running at http://localhost:${PORT}`);
@@ -0,0 +1,95 @@
+// checkpoint.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"vine-harvester/internal/s3store"
+)
+
+const (
+	slugsFile      = "vine_slugs.txt"
+	checkpointFile = "scan_checkpoint.json"
+)
+
+// scanCheckpoint remembers which inputs have been fully scanned, keyed by S3
+// key (or local path), so later passes only read what is new or changed.
+// A nil *scanCheckpoint treats everything as unscanned.
+type scanCheckpoint struct {
+	mu        sync.Mutex
+	Objects   map[string]checkpointEntry `json:"objects"`
+	UpdatedAt time.Time                  `json:"updatedAt"`
+}
+
+type checkpointEntry struct {
+	ETag string `json:"etag"`
+	Size int64  `json:"size"`
+}
+
+func loadCheckpoint(ctx context.Context, out s3store.Path, client *s3.Client) (*scanCheckpoint, error) {
+	cp := &scanCheckpoint{Objects: make(map[string]checkpointEntry)}
+	data, err := readOutFile(ctx, out, client, checkpointFile)
+	if err != nil {
+		if errors.Is(err, errOutFileNotFound) {
+			return cp, nil
+		}
+		return nil, fmt.Errorf("loading checkpoint: %w", err)
+	}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("decoding checkpoint: %w", err)
+	}
+	if cp.Objects == nil {
+		cp.Objects = make(map[string]checkpointEntry)
+	}
+	return cp, nil
+}
+
+func (cp *scanCheckpoint) unchanged(key string, e checkpointEntry) bool {
+	if cp == nil {
+		return false
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	prev, ok := cp.Objects[key]
+	return ok && prev == e
+}
+
+// markDone records an input as scanned; only called after a successful scan,
+// so a failed object is retried on the next pass.
+func (cp *scanCheckpoint) markDone(key string, e checkpointEntry) {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	cp.Objects[key] = e
+	cp.mu.Unlock()
+}
+
+// prune drops entries for inputs that no longer exist.
+func (cp *scanCheckpoint) prune(seen map[string]checkpointEntry) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for key := range cp.Objects {
+		if _, ok := seen[key]; !ok {
+			delete(cp.Objects, key)
+		}
+	}
+}
+
+func (cp *scanCheckpoint) save(ctx context.Context, out s3store.Path, client *s3.Client) error {
+	cp.mu.Lock()
+	cp.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(cp, "", "  ")
+	cp.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeOutFile(ctx, out, client, checkpointFile, data)
+}
@@ -0,0 +1,844 @@
+// fast_harvest_vine.go
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"vine-harvester/internal/archive"
+	"vine-harvester/internal/atomicfile"
+	"vine-harvester/internal/httpclient"
+	"vine-harvester/internal/medialedger"
+)
+
+// Flags
+var (
+	profilesPath = flag.String("profiles", "profiles.json", "User list: JSON/JSONL, TSV/CSV (first column), or one ID, vine.co profile URL or vanity name per line")
+	outDir       = flag.String("outDir", "vine_archive_harvest", "Output root directory")
+	baseProfile  = flag.String("baseProfile", "https://archive.vine.co/profiles", "Base URL for profile JSON (no trailing slash)")
+	basePost     = flag.String("basePost", "https://archive.vine.co/posts", "Base URL for post JSON (no trailing slash)")
+	workers      = flag.Int("workers", 64, "Number of concurrent user workers")
+	download     = flag.Bool("download", false, "Download media files from vines.s3.amazonaws.com")
+
+	mediaRetries     = flag.Int("mediaRetries", 2, "Passes over failed media downloads at the end of the run")
+	mediaMaxAttempts = flag.Int("mediaMaxAttempts", 5, "Attempts per media file, across runs, before it counts as permanently missing")
+
+	vanityResolver = flag.String("vanityResolver", "https://vine.co/api/users/profiles/vanity/{vanity}", "URL template for resolving vanity names not found in harvested profiles (empty = local only)")
+
+	storageCodecName = flag.String("storageCodec", "none", "Codec for newly written profile/post JSON: none, gzip (.json.gz) or zstd (.json.zst); readers accept any of them")
+	layoutName       = flag.String("layout", "", "Directory layout of profiles and posts: flat, hash1 or hash2 (profiles/ab/cd/<userId>.json); only for a new outDir, otherwise the recorded one is used")
+
+	httpConfigPath = flag.String("httpConfig", "", "JSON file with HTTP client settings: json/media timeouts, idle connection limits, proxy, caBundle, userAgent, contact")
+	userAgent      = flag.String("userAgent", "", "User-Agent for every request (default: FastVineHarvester/1.0, FastVineHarvesterMedia/1.0 for media)")
+	contact        = flag.String("contact", "", "Contact URL or email appended to the User-Agent (an email is also sent as From)")
+	proxyURL       = flag.String("proxy", "", "HTTP(S) proxy URL (default: HTTP_PROXY/HTTPS_PROXY from the environment)")
+	caBundle       = flag.String("caBundle", "", "PEM file with extra CA certificates to trust")
+	jsonTimeout    = flag.Duration("jsonTimeout", 30*time.Second, "Overall timeout for one profile/post JSON request")
+	mediaTimeout   = flag.Duration("mediaTimeout", 30*time.Minute, "Overall timeout for one media download")
+)
+
+// HTTP clients (shared), built in main from the HTTP client flags
+var jsonClient, mediaClient *http.Client
+
+// layout and docs place and store profiles and posts; main sets them from
+// outDir/layout.json and -storageCodec.
+var (
+	layout = archive.Layouts[0]
+	docs   = archive.Store{FS: archive.Local{}, Codec: archive.Codecs[0]}
+)
+
+// media is the download ledger (media_state.jsonl), opened in main with -download
+var media *medialedger.Ledger
+
+var (
+	// ~10 requests per second globally (tweak if you want)
+	rateLimiter = time.Tick(time.Second / 10)
+)
+
+// ------------------------ main ------------------------
+
+func main() {
+	flag.Parse()
+
+	httpCfg, err := httpclient.Load(*httpConfigPath, flag.CommandLine)
+	if err != nil {
+		log.Fatalf("httpConfig: %v", err)
+	}
+	if jsonClient, err = httpclient.New(httpCfg, httpCfg.JSON, "FastVineHarvester/1.0"); err != nil {
+		log.Fatalf("HTTP client: %v", err)
+	}
+	if mediaClient, err = httpclient.New(httpCfg, httpCfg.Media, "FastVineHarvesterMedia/1.0"); err != nil {
+		log.Fatalf("HTTP client: %v", err)
+	}
+
+	userIDs, err := loadUserIDs(*profilesPath)
+	if err != nil {
+		log.Fatalf("loadUserIDs: %v", err)
+	}
+	if len(userIDs) == 0 {
+		log.Fatalf("No user IDs found in %s", *profilesPath)
+	}
+	log.Printf("Loaded %d user IDs from %s\n", len(userIDs), *profilesPath)
+
+	// Prepare directories
+	profilesDir := filepath.Join(*outDir, "profiles")
+	postsRoot := filepath.Join(*outDir, "posts")
+	mediaRoot := filepath.Join(*outDir, "media")
+	if err := os.MkdirAll(profilesDir, 0755); err != nil {
+		log.Fatalf("MkdirAll profilesDir: %v", err)
+	}
+	if err := os.MkdirAll(postsRoot, 0755); err != nil {
+		log.Fatalf("MkdirAll postsRoot: %v", err)
+	}
+	atomicfile.Sweep(*outDir)
+	if docs.Codec, err = archive.ParseCodec(*storageCodecName); err != nil {
+		log.Fatalf("storageCodec: %v", err)
+	}
+	if layout, err = archive.ResolveLayout(archive.Local{}, *outDir, *layoutName); err != nil {
+		log.Fatalf("layout: %v", err)
+	}
+	if *download {
+		if err := os.MkdirAll(mediaRoot, 0755); err != nil {
+			log.Fatalf("MkdirAll mediaRoot: %v", err)
+		}
+		media = medialedger.New(*mediaMaxAttempts)
+		if err := media.Open(filepath.Join(*outDir, "media_state.jsonl")); err != nil {
+			log.Fatalf("media state: %v", err)
+		}
+		defer media.Close()
+	}
+
+	// User job channel
+	jobs := make(chan string, *workers*2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			for uid := range jobs {
+				if err := processUser(uid, profilesDir, postsRoot, mediaRoot); err != nil {
+					log.Printf("[worker %d] user %s: %v\n", workerID, uid, err)
+				}
+			}
+		}(i)
+	}
+
+	start := time.Now()
+	for _, uid := range userIDs {
+		jobs <- uid
+	}
+	close(jobs)
+	wg.Wait()
+
+	if *download {
+		media.Retry(*mediaRetries, *workers, func(u string) error { return downloadMedia(u, mediaRoot) })
+	}
+
+	log.Printf("Finished in %v\n", time.Since(start))
+}
+
+// ------------------------ load userId list ------------------------
+
+// userEntry is one user reference from a user list, before resolution.
+type userEntry struct {
+	Kind  string // "userId" or "vanity"
+	Value string
+}
+
+// loadUserIDs reads a user list in any of the formats we run into and returns
+// the numeric user IDs, de-duplicated in file order:
+//   - JSON: an array of strings, numbers or objects (userIdStr/userId/vanity)
+//   - JSONL: one such object (or string) per line
+//   - TSV/CSV: the first column, e.g. profiles.txt's "id<TAB>display name"
+//   - plain text: one ID, vine.co profile URL or vanity name per line
+//
+// Vanity names are resolved against profiles already harvested into -outDir,
+// then the -vanityResolver endpoint if one is configured.
+func loadUserIDs(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := parseUserList(path, data)
+	if err != nil {
+		return nil, err
+	}
+	return resolveUserEntries(entries), nil
+}
+
+func parseUserList(path string, data []byte) ([]userEntry, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return nil, nil
+	}
+
+	switch trimmed[0] {
+	case '[':
+		var items []interface{}
+		dec := json.NewDecoder(bytes.NewReader(trimmed))
+		dec.UseNumber()
+		if err := dec.Decode(&items); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		var out []userEntry
+		for _, item := range items {
+			if e, ok := userEntryFromJSON(item); ok {
+				out = append(out, e)
+			}
+		}
+		return out, nil
+
+	case '{':
+		// JSONL (or concatenated objects)
+		var out []userEntry
+		dec := json.NewDecoder(bytes.NewReader(trimmed))
+		dec.UseNumber()
+		for {
+			var item interface{}
+			err := dec.Decode(&item)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			if e, ok := userEntryFromJSON(item); ok {
+				out = append(out, e)
+			}
+		}
+		return out, nil
+	}
+
+	return parseUserLines(path, trimmed)
+}
+
+// userEntryFromJSON accepts a string/number token or an object with one of the
+// usual user fields.
+func userEntryFromJSON(v interface{}) (userEntry, bool) {
+	switch t := v.(type) {
+	case string:
+		return parseUserToken(t)
+	case json.Number:
+		return parseUserToken(t.String())
+	case map[string]interface{}:
+		for _, k := range []string{"userIdStr", "userId", "user_id", "id"} {
+			switch id := t[k].(type) {
+			case string:
+				if id != "" {
+					return parseUserToken(id)
+				}
+			case json.Number:
+				return userEntry{Kind: "userId", Value: id.String()}, true
+			}
+		}
+		for _, k := range []string{"profileUrl", "url", "vanityUrl", "vanity"} {
+			if s, ok := t[k].(string); ok && s != "" {
+				return parseUserToken(s)
+			}
+		}
+		if vs, ok := t["vanityUrls"].([]interface{}); ok && len(vs) > 0 {
+			if s, ok := vs[0].(string); ok && s != "" {
+				return parseUserToken(s)
+			}
+		}
+	}
+	return userEntry{}, false
+}
+
+// parseUserLines handles TSV, CSV and plain one-per-line lists. Only the first
+// column matters; a header row is skipped.
+func parseUserLines(path string, data []byte) ([]userEntry, error) {
+	lower := strings.ToLower(path)
+	firstLine := string(data)
+	if i := strings.IndexByte(firstLine, '\n'); i >= 0 {
+		firstLine = firstLine[:i]
+	}
+
+	var comma rune
+	switch {
+	case strings.HasSuffix(lower, ".tsv") || strings.Contains(firstLine, "\t"):
+		comma = '\t'
+	case strings.HasSuffix(lower, ".csv") || strings.Contains(firstLine, ","):
+		comma = ','
+	}
+
+	var out []userEntry
+	if comma == 0 {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			if e, ok := parseUserToken(fields[0]); ok {
+				out = append(out, e)
+			}
+		}
+		return out, nil
+	}
+
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.Comma = comma
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	for row := 0; ; row++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if len(rec) == 0 {
+			continue
+		}
+		first := strings.TrimSpace(rec[0])
+		if row == 0 && isUserListHeader(first) {
+			continue
+		}
+		if e, ok := parseUserToken(first); ok {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+func isUserListHeader(s string) bool {
+	switch strings.ToLower(s) {
+	case "id", "userid", "useridstr", "user_id", "user", "profile", "profileurl", "url", "vanity", "username":
+		return true
+	}
+	return false
+}
+
+// vanityRe is what we accept as a bare vanity name.
+var vanityRe = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+// parseUserToken classifies a single token the same way harvest_vine_archive.js
+// does: numeric IDs, vine.co/u/<id> URLs, vine.co/<vanity> URLs, or a bare
+// vanity name.
+func parseUserToken(raw string) (userEntry, bool) {
+	tok := strings.TrimSpace(raw)
+	if tok == "" || strings.HasPrefix(tok, "#") {
+		return userEntry{}, false
+	}
+	if isDigits(tok) {
+		return userEntry{Kind: "userId", Value: tok}, true
+	}
+
+	if strings.HasPrefix(tok, "http://") || strings.HasPrefix(tok, "https://") || strings.HasPrefix(tok, "vine.co/") {
+		if strings.HasPrefix(tok, "vine.co/") {
+			tok = "https://" + tok
+		}
+		u, err := url.Parse(tok)
+		if err != nil || !isVineHost(u.Hostname()) {
+			log.Printf("Skipping non-vine URL in user list: %s\n", raw)
+			return userEntry{}, false
+		}
+		parts := strings.FieldsFunc(u.Path, func(r rune) bool { return r == '/' })
+		if len(parts) >= 2 && parts[0] == "u" && isDigits(parts[1]) {
+			return userEntry{Kind: "userId", Value: parts[1]}, true
+		}
+		if len(parts) >= 1 && parts[0] != "v" && vanityRe.MatchString(parts[0]) {
+			return userEntry{Kind: "vanity", Value: parts[0]}, true
+		}
+		log.Printf("Skipping unrecognized vine URL in user list: %s\n", raw)
+		return userEntry{}, false
+	}
+
+	if vanityRe.MatchString(tok) {
+		return userEntry{Kind: "vanity", Value: tok}, true
+	}
+	log.Printf("Skipping unrecognized user list entry: %s\n", raw)
+	return userEntry{}, false
+}
+
+// isVineHost accepts vine.co and its subdomains, not names that merely end
+// in "vine.co".
+func isVineHost(host string) bool {
+	host = strings.ToLower(host)
+	return host == "vine.co" || strings.HasSuffix(host, ".vine.co")
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveUserEntries turns entries into user IDs, de-duplicated in order.
+// Vanity names that can't be resolved are logged and dropped.
+func resolveUserEntries(entries []userEntry) []string {
+	seen := make(map[string]struct{})
+	var ids []string
+	add := func(id string) {
+		if _, ok := seen[id]; ok {
+			return
+		}
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+	}
+
+	var vanities *vanityTable
+	for _, e := range entries {
+		if e.Kind == "userId" {
+			add(e.Value)
+			continue
+		}
+		if vanities == nil {
+			vanities = loadVanityTable(filepath.Join(*outDir, "profiles"))
+		}
+		if id, ok := vanities.resolve(e.Value); ok {
+			add(id)
+		} else {
+			log.Printf("Could not resolve vanity %q\n", e.Value)
+		}
+	}
+	if vanities != nil {
+		vanities.saveRemote()
+	}
+	return ids
+}
+
+// ------------------------ vanity -> userId ------------------------
+
+// vanityTable maps lower-cased vanity names to user IDs. It is built from the
+// profiles we have already harvested plus vanity_resolved.json, which caches
+// earlier answers from the remote resolver.
+type vanityTable struct {
+	m         map[string]string
+	cachePath string
+	remote    map[string]string // resolved remotely this run
+}
+
+func loadVanityTable(profilesDir string) *vanityTable {
+	t := &vanityTable{
+		m:         make(map[string]string),
+		cachePath: filepath.Join(*outDir, "vanity_resolved.json"),
+		remote:    make(map[string]string),
+	}
+
+	if data, err := os.ReadFile(t.cachePath); err == nil {
+		var cached map[string]string
+		if err := json.Unmarshal(data, &cached); err == nil {
+			for k, v := range cached {
+				t.m[strings.ToLower(k)] = v
+				t.remote[strings.ToLower(k)] = v
+			}
+		}
+	}
+
+	var files []string
+	filepath.WalkDir(profilesDir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	for _, f := range files {
+		base := archive.StoredBase(f)
+		if base == "" {
+			continue
+		}
+		data, err := os.ReadFile(f)
+		if err == nil {
+			data, err = archive.Decode(data)
+		}
+		if err != nil {
+			continue
+		}
+		var profile map[string]interface{}
+		if err := json.Unmarshal(data, &profile); err != nil {
+			continue
+		}
+		id, _ := profile["userIdStr"].(string)
+		if id == "" {
+			id = strings.TrimSuffix(filepath.Base(base), ".json")
+		}
+		if vs, ok := profile["vanityUrls"].([]interface{}); ok {
+			for _, v := range vs {
+				if s, ok := v.(string); ok && s != "" {
+					t.m[strings.ToLower(s)] = id
+				}
+			}
+		}
+		if s, ok := profile["vanityUrl"].(string); ok && s != "" {
+			t.m[strings.ToLower(s)] = id
+		}
+	}
+	log.Printf("Vanity table: %d names from %s\n", len(t.m), profilesDir)
+	return t
+}
+
+func (t *vanityTable) resolve(vanity string) (string, bool) {
+	key := strings.ToLower(vanity)
+	if id, ok := t.m[key]; ok {
+		return id, true
+	}
+	if *vanityResolver == "" {
+		return "", false
+	}
+
+	u := strings.ReplaceAll(*vanityResolver, "{vanity}", url.PathEscape(vanity))
+	resp, err := fetchJSONMap(u)
+	if err != nil {
+		log.Printf("vanity %q: %v\n", vanity, err)
+		return "", false
+	}
+	// vine.co answered {"data": {"userId": ..., "userIdStr": ...}}; accept a
+	// bare object too.
+	d, ok := resp["data"].(map[string]interface{})
+	if !ok {
+		d = resp
+	}
+	id, _ := d["userIdStr"].(string)
+	if id == "" {
+		if f, ok := d["userId"].(float64); ok {
+			id = fmt.Sprintf("%.0f", f)
+		}
+	}
+	if id == "" {
+		return "", false
+	}
+	log.Printf("vanity %q -> userId %s\n", vanity, id)
+	t.m[key] = id
+	t.remote[key] = id
+	return id, true
+}
+
+// saveRemote persists remote answers so later runs resolve them locally.
+func (t *vanityTable) saveRemote() {
+	if len(t.remote) == 0 {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(t.cachePath), 0755); err != nil {
+		log.Printf("Warning: MkdirAll %s: %v\n", filepath.Dir(t.cachePath), err)
+		return
+	}
+	if err := writeJSONFile(t.cachePath, t.remote); err != nil {
+		log.Printf("Warning: failed to write %s: %v\n", t.cachePath, err)
+	}
+}
+
+// ------------------------ per-user processing ------------------------
+
+func processUser(userID, profilesDir, postsRoot, mediaRoot string) error {
+	// 1) Fetch profile JSON
+	profileURL := fmt.Sprintf("%s/%s.json", strings.TrimRight(*baseProfile, "/"), url.PathEscape(userID))
+	profile, err := fetchJSONMap(profileURL)
+	if err != nil {
+		return fmt.Errorf("fetch profile: %w", err)
+	}
+
+	// Rewrite URLs inside profile
+	profile = rewriteURLs(profile).(map[string]interface{})
+
+	// Save profile JSON
+	profilePath := layout.Path(profilesDir, userID, userID+".json")
+	if err := docs.WriteJSON(profilePath, profile); err != nil {
+		return fmt.Errorf("write profile JSON: %w", err)
+	}
+
+	// 2) Find all post IDs in profile JSON (generic scan for postId / postIdStr)
+	postIDs := collectPostIDsFromProfile(profile)
+	if len(postIDs) == 0 {
+		// Some profiles may not expose posts; not necessarily an error.
+		log.Printf("User %s: no post IDs found in profile\n", userID)
+		return nil
+	}
+
+	userPostsDir := layout.Path(postsRoot, userID, userID)
+
+	for _, pid := range postIDs {
+		postFile := filepath.Join(userPostsDir, pid+".json")
+		if docs.Exists(postFile) {
+			// Already harvested
+			continue
+		}
+		postURL := fmt.Sprintf("%s/%s.json", strings.TrimRight(*basePost, "/"), url.PathEscape(pid))
+
+		postData, err := fetchJSONMap(postURL)
+		if err != nil {
+			// Posts disappear or some IDs are bogus; log and continue.
+			log.Printf("User %s post %s: %v\n", userID, pid, err)
+			continue
+		}
+
+		// Rewrite URLs
+		postData = rewriteURLs(postData).(map[string]interface{})
+
+		// Save JSON
+		if err := docs.WriteJSON(postFile, postData); err != nil {
+			log.Printf("User %s post %s: write JSON: %v\n", userID, pid, err)
+		}
+
+		// Download media if toggled
+		if *download {
+			mediaURLs := collectMediaURLs(postData)
+			for _, mu := range mediaURLs {
+				media.Add(mu)
+			}
+			for _, mu := range mediaURLs {
+				if err := downloadMedia(mu, mediaRoot); err != nil {
+					log.Printf("User %s post %s: download %s: %v\n", userID, pid, mu, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// ------------------------ HTTP + JSON helpers ------------------------
+
+func fetchJSONMap(u string) (map[string]interface{}, error) {
+	<-rateLimiter // global throttle
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := jsonClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	var m map[string]interface{}
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func writeJSONFile(path string, data interface{}) error {
+	return atomicfile.Write(path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(data)
+	})
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// ------------------------ URL rewriting ------------------------
+
+// rewriteURLs walks any JSON structure and:
+//   - replaces http(s)://v.cdn.vine.co/... with https://vines.s3.amazonaws.com/...
+//   - leaves existing https://vines.s3.amazonaws.com/... as-is.
+func rewriteURLs(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, vv := range t {
+			t[k] = rewriteURLs(vv)
+		}
+		return t
+	case []interface{}:
+		for i, vv := range t {
+			t[i] = rewriteURLs(vv)
+		}
+		return t
+	case string:
+		s := t
+		if strings.Contains(s, "v.cdn.vine.co") {
+			s = strings.ReplaceAll(s, "http://v.cdn.vine.co", "https://vines.s3.amazonaws.com")
+			s = strings.ReplaceAll(s, "https://v.cdn.vine.co", "https://vines.s3.amazonaws.com")
+			s = strings.ReplaceAll(s, "https://mtc.cdn.vine.co", "https://vines.s3.amazonaws.com")
+			s = strings.ReplaceAll(s, "http://mtc.cdn.vine.co", "https://vines.s3.amazonaws.com")
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+// ------------------------ postId collection ------------------------
+
+// collectPostIDsFromProfile pulls post IDs from a profile JSON.
+// It first looks for a top-level "posts" field (which is usually just a list
+// of IDs), and falls back to a deep scan for postId/postIdStr if needed.
+func collectPostIDsFromProfile(profile map[string]interface{}) []string {
+	seen := make(map[string]struct{})
+	var out []string
+
+	addID := func(id string) {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			return
+		}
+		if _, ok := seen[id]; ok {
+			return
+		}
+		seen[id] = struct{}{}
+		out = append(out, id)
+	}
+
+	// 1) Preferred: profile["posts"] as a flat list of IDs
+	if rawPosts, ok := profile["posts"]; ok && rawPosts != nil {
+		switch v := rawPosts.(type) {
+		case []interface{}:
+			for _, item := range v {
+				switch t := item.(type) {
+				case string:
+					addID(t)
+				case float64:
+					// numbers come in as float64 from JSON
+					addID(fmt.Sprintf("%.0f", t))
+				case map[string]interface{}:
+					// just in case some variants store objects under posts
+					if s, ok2 := t["postIdStr"].(string); ok2 && s != "" {
+						addID(s)
+					} else if f, ok2 := t["postId"].(float64); ok2 {
+						addID(fmt.Sprintf("%.0f", f))
+					}
+				default:
+					// ignore
+				}
+			}
+		}
+	}
+
+	// 2) Fallback: deep scan for postId / postIdStr anywhere
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for k, vv := range t {
+				kl := strings.ToLower(k)
+				if (kl == "postid" || kl == "postidstr") && vv != nil {
+					switch idv := vv.(type) {
+					case string:
+						addID(idv)
+					case float64:
+						addID(fmt.Sprintf("%.0f", idv))
+					}
+				}
+				walk(vv)
+			}
+		case []interface{}:
+			for _, vv := range t {
+				walk(vv)
+			}
+		default:
+			// nothing
+		}
+	}
+
+	// Only bother with fallback if we didn't get anything from "posts"
+	if len(out) == 0 {
+		walk(profile)
+	}
+
+	return out
+}
+
+// ------------------------ media URL collection + download ------------------------
+
+func collectMediaURLs(root interface{}) []string {
+	var urls []string
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for _, vv := range t {
+				walk(vv)
+			}
+		case []interface{}:
+			for _, vv := range t {
+				walk(vv)
+			}
+		case string:
+			s := t
+			if strings.Contains(s, "vines.s3.amazonaws.com") {
+				// Basic filter: look for file-ish endings
+				if strings.Contains(s, ".mp4") || strings.Contains(s, ".jpg") ||
+					strings.Contains(s, ".jpeg") || strings.Contains(s, ".png") ||
+					strings.Contains(s, ".gif") {
+					urls = append(urls, s)
+				}
+			}
+		}
+	}
+	walk(root)
+	return urls
+}
+
+func downloadMedia(rawURL, mediaRoot string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	// Build local path from URL path
+	cleanPath := strings.TrimLeft(parsed.Path, "/")
+	localPath := filepath.Join(mediaRoot, cleanPath)
+
+	if !media.Start(rawURL, func() bool { return fileExists(localPath) }) {
+		return nil // done, missing, in flight elsewhere, or out of attempts
+	}
+
+	err = nil
+	if !fileExists(localPath) {
+		err = fetchMediaFile(rawURL, localPath)
+	}
+	media.Finish(rawURL, err)
+	return err
+}
+
+func fetchMediaFile(rawURL, localPath string) error {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := mediaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		switch resp.StatusCode {
+		case http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+			return fmt.Errorf("media HTTP %d: %w", resp.StatusCode, medialedger.ErrGone)
+		}
+		return fmt.Errorf("media HTTP %d", resp.StatusCode)
+	}
+
+	return atomicfile.Write(localPath, func(w io.Writer) error {
+		_, err := io.Copy(w, resp.Body)
+		return err
+	})
+}
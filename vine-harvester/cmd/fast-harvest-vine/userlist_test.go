@@ -0,0 +1,101 @@
+// userlist_test.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"vine-harvester/internal/archive"
+)
+
+func TestParseUserList(t *testing.T) {
+	for _, tc := range []struct {
+		name, path, data, want string
+	}{
+		{
+			name: "JSON array",
+			path: "users.json",
+			data: `[123, "456", {"userIdStr":"789"}, {"userId":1011}, {"vanityUrls":["alice"]}, {"profileUrl":"https://vine.co/u/1213"}, {}]`,
+			want: "[userId:123 userId:456 userId:789 userId:1011 vanity:alice userId:1213]",
+		},
+		{
+			name: "JSONL",
+			path: "users.jsonl",
+			data: "{\"user_id\":\"1\"}\n{\"id\":2}\n{\"vanity\":\"bob\"}\n",
+			want: "[userId:1 userId:2 vanity:bob]",
+		},
+		{
+			name: "profiles.txt with a header",
+			path: "profiles.txt",
+			data: "userIdStr\tusername\tfollowers\n111\tAlice\t10\n# dropped\n222\tBob\t3\n",
+			want: "[userId:111 userId:222]",
+		},
+		{
+			name: "CSV with a header",
+			path: "users.csv",
+			data: "url,note\nhttps://vine.co/u/333,first\nvine.co/carol,\"quoted, note\"\n444,\n",
+			want: "[userId:333 vanity:carol userId:444]",
+		},
+		{
+			name: "plain text with comments",
+			path: "users.txt",
+			data: "# seed users\n555\n\n  dave  trailing words\n#666\nhttp://vine.co/u/777/\n",
+			want: "[userId:555 vanity:dave userId:777]",
+		},
+		{
+			name: "vine URLs only",
+			path: "urls.txt",
+			data: "https://vine.co/u/888\nhttps://vine.co/erin\nhttps://vine.co/v/abcDEF\nhttps://example.com/u/999\nftp://vine.co/u/1\nhttps://notvine.com/frank\nhttps://evilvine.co/hank\nhttps://mobile.vine.co/gina\n",
+			want: "[userId:888 vanity:erin vanity:gina]",
+		},
+		{
+			name: "byte order mark",
+			path: "bom.txt",
+			data: "\xef\xbb\xbf1000\n",
+			want: "[userId:1000]",
+		},
+		{name: "empty", path: "empty.txt", data: " \n", want: "[]"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			entries, err := parseUserList(tc.path, []byte(tc.data))
+			if err != nil {
+				t.Fatalf("parseUserList: %v", err)
+			}
+			got := make([]string, len(entries))
+			for i, e := range entries {
+				got[i] = e.Kind + ":" + e.Value
+			}
+			if fmt.Sprint(got) != tc.want {
+				t.Fatalf("got %v, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseUserListRejectsBrokenJSON(t *testing.T) {
+	if _, err := parseUserList("users.json", []byte(`[1, 2`)); err == nil {
+		t.Fatal("truncated JSON array accepted")
+	}
+}
+
+func TestResolveUserEntriesDedupsInOrder(t *testing.T) {
+	*outDir = t.TempDir()
+	*vanityResolver = ""
+	layout = archive.Layouts[0]
+	profiles := filepath.Join(*outDir, "profiles")
+	os.MkdirAll(profiles, 0755)
+	if err := os.WriteFile(filepath.Join(profiles, "42.json"), []byte(`{"userIdStr":"42","vanityUrls":["Alice"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := parseUserList("users.txt", []byte("7\nalice\n42\nhttps://vine.co/u/7\nunknown\n9\nALICE\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// alice resolves to 42 locally; unknown has no resolver and is dropped.
+	if got := fmt.Sprint(resolveUserEntries(entries)); got != "[7 42 9]" {
+		t.Fatalf("resolveUserEntries = %s, want [7 42 9]", got)
+	}
+}
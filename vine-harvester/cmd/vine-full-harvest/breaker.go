@@ -0,0 +1,255 @@
+// breaker.go
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// When a host goes down, 128 workers hammering it only produce identical
+// errors and users with missing posts. Each host gets a breaker: once enough
+// of its recent requests fail (network errors, 5xx, 429) it opens, and every
+// request for that host waits instead of being sent. After the cooldown one
+// request goes through as a probe (half-open); success closes the breaker and
+// releases everyone, failure reopens it with a longer cooldown. Requests that
+// failed or waited while the host was down are retried once it is back, so
+// the work is parked rather than dropped. State changes are logged and
+// written to outDir/breakers.json.
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	return [...]string{"closed", "open", "half-open"}[s]
+}
+
+// maxBreakerCooldown caps the cooldown after repeated failed probes.
+const maxBreakerCooldown = 10 * time.Minute
+
+type hostBreaker struct {
+	host string
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	state    breakerState
+	since    time.Time
+	window   []bool // recent outcomes, true = failure
+	next     int
+	filled   int
+	probing  bool
+	cooldown time.Duration
+	opens    int
+	waiting  int
+}
+
+// breakerStatus is one host in breakers.json.
+type breakerStatus struct {
+	State   string `json:"state"`
+	Since   string `json:"since"`
+	Opens   int    `json:"opens"`
+	Waiting int    `json:"waiting"`
+}
+
+type breakerSet struct {
+	mu       sync.Mutex
+	m        map[string]*hostBreaker
+	exportMu sync.Mutex
+	exports  sync.WaitGroup // background exports after state changes
+}
+
+var breakers = &breakerSet{m: make(map[string]*hostBreaker)}
+
+func breakerFor(host string) *hostBreaker {
+	breakers.mu.Lock()
+	defer breakers.mu.Unlock()
+	b, ok := breakers.m[host]
+	if !ok {
+		n := *breakerMinRequests * 2
+		if n < 10 {
+			n = 10
+		}
+		b = &hostBreaker{host: host, since: time.Now(), window: make([]bool, n), cooldown: *breakerCooldown}
+		b.cond = sync.NewCond(&b.mu)
+		breakers.m[host] = b
+	}
+	return b
+}
+
+// doRequest sends req through its host's breaker. Only idempotent, bodiless
+// requests go through here, so resending req is safe.
+func doRequest(client *http.Client, req *http.Request) (*http.Response, error) {
+	if *breakerErrorRate <= 0 || (*httpCache != "" && *httpCacheMode == "offline") {
+		return client.Do(req)
+	}
+	b := breakerFor(req.URL.Host)
+	deadline := time.Now().Add(*breakerMaxWait)
+	for {
+		probe, err := b.acquire(deadline)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		failed := err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		if !b.record(failed, probe) || time.Now().After(deadline) {
+			return resp, err
+		}
+		// The host is (now) down: park this request until it recovers.
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+}
+
+// acquire blocks while the breaker is open. It returns probe=true when the
+// caller is the single half-open probe.
+func (b *hostBreaker) acquire(deadline time.Time) (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var wake *time.Timer
+	for {
+		switch {
+		case b.state == breakerClosed:
+			return false, nil
+		case b.state == breakerHalfOpen && !b.probing:
+			b.probing = true
+			return true, nil
+		case !time.Now().Before(deadline):
+			return false, fmt.Errorf("circuit breaker for %s open for more than %v", b.host, *breakerMaxWait)
+		}
+		if wake == nil {
+			// State changes wake waiters too, but none may come before the
+			// deadline while a probe hangs.
+			wake = time.AfterFunc(time.Until(deadline), func() {
+				b.mu.Lock()
+				defer b.mu.Unlock()
+				b.cond.Broadcast()
+			})
+			defer wake.Stop()
+		}
+		b.waiting++
+		b.cond.Wait()
+		b.waiting--
+	}
+}
+
+// record adds one outcome and reports whether the request should be parked
+// and retried (it failed and the host is, or just became, unavailable).
+func (b *hostBreaker) record(failed, probe bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+		if failed {
+			b.cooldown *= 2
+			if b.cooldown > maxBreakerCooldown {
+				b.cooldown = maxBreakerCooldown
+			}
+			b.setState(breakerOpen)
+			return true
+		}
+		b.cooldown = *breakerCooldown
+		b.setState(breakerClosed)
+		return false
+	}
+
+	if b.state != breakerClosed {
+		// Sent before the breaker opened; retry once it closes.
+		return failed
+	}
+
+	b.window[b.next] = failed
+	b.next = (b.next + 1) % len(b.window)
+	if b.filled < len(b.window) {
+		b.filled++
+	}
+	if !failed || b.filled < *breakerMinRequests {
+		return false
+	}
+	fails := 0
+	for i := 0; i < b.filled; i++ {
+		if b.window[i] {
+			fails++
+		}
+	}
+	if float64(fails)/float64(b.filled) < *breakerErrorRate {
+		return false
+	}
+	b.setState(breakerOpen)
+	return true
+}
+
+// setState must be called with b.mu held.
+func (b *hostBreaker) setState(s breakerState) {
+	if s == b.state {
+		if s == breakerOpen {
+			b.scheduleHalfOpen()
+		}
+		return
+	}
+	log.Printf("Circuit breaker %s: %s -> %s (cooldown %v, %d requests parked)\n", b.host, b.state, s, b.cooldown, b.waiting)
+	b.state = s
+	b.since = time.Now()
+	switch s {
+	case breakerOpen:
+		b.opens++
+		b.scheduleHalfOpen()
+	case breakerClosed:
+		b.next, b.filled = 0, 0
+		b.cond.Broadcast()
+	}
+	breakers.exports.Add(1)
+	go func() {
+		defer breakers.exports.Done()
+		breakers.export()
+	}()
+}
+
+func (b *hostBreaker) scheduleHalfOpen() {
+	time.AfterFunc(b.cooldown, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.state == breakerOpen {
+			b.setState(breakerHalfOpen)
+		}
+		b.cond.Broadcast()
+	})
+}
+
+// flush waits for background exports, then writes the final state.
+func (bs *breakerSet) flush() {
+	bs.exports.Wait()
+	bs.export()
+}
+
+// export writes every host's breaker state to outDir/breakers.json.
+func (bs *breakerSet) export() {
+	bs.exportMu.Lock()
+	defer bs.exportMu.Unlock()
+
+	bs.mu.Lock()
+	out := make(map[string]breakerStatus, len(bs.m))
+	for host, b := range bs.m {
+		b.mu.Lock()
+		out[host] = breakerStatus{State: b.state.String(), Since: b.since.UTC().Format(time.RFC3339), Opens: b.opens, Waiting: b.waiting}
+		b.mu.Unlock()
+	}
+	bs.mu.Unlock()
+	if len(out) == 0 {
+		return
+	}
+	if err := writeJSONFile(filepath.Join(stateRoot, "breakers.json"), out); err != nil {
+		log.Printf("Warning: write breakers.json: %v\n", err)
+	}
+}
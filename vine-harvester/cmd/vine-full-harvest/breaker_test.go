@@ -0,0 +1,214 @@
+// breaker_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// breakerEnv gives the test fresh breakers that open once half of at least 4
+// requests fail.
+func breakerEnv(t *testing.T, cooldown, maxWait time.Duration) {
+	t.Helper()
+	rate, min, cd, wait, root := *breakerErrorRate, *breakerMinRequests, *breakerCooldown, *breakerMaxWait, stateRoot
+	*breakerErrorRate, *breakerMinRequests, *breakerCooldown, *breakerMaxWait = 0.5, 4, cooldown, maxWait
+	stateRoot = t.TempDir()
+	breakers = &breakerSet{m: make(map[string]*hostBreaker)}
+	t.Cleanup(func() {
+		breakers.exports.Wait()
+		*breakerErrorRate, *breakerMinRequests, *breakerCooldown, *breakerMaxWait = rate, min, cd, wait
+		stateRoot = root
+	})
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	// The cooldowns are long enough that no timer fires during the test;
+	// "half-open" stands in for one running out.
+	const cooldown = 4 * time.Minute
+	open := []string{"fail", "fail", "fail", "fail"}
+	cases := []struct {
+		name     string
+		steps    []string
+		parked   string // per step: P = parked for a retry, . = returned
+		state    breakerState
+		cooldown time.Duration
+	}{
+		{"opens at the error rate", []string{"ok", "ok", "fail", "fail"}, "...P", breakerOpen, cooldown},
+		{"stays closed below the rate", []string{"ok", "ok", "ok", "fail", "ok"}, ".....", breakerClosed, cooldown},
+		{"waits for enough requests", []string{"fail", "fail", "fail"}, "...", breakerClosed, cooldown},
+		{"parks failures sent before it opened", append(open, "fail", "ok"), "...PP.", breakerOpen, cooldown},
+		{"closes on a good probe", append(open, "half-open", "probe ok"), "...P..", breakerClosed, cooldown},
+		{"counts afresh once closed", append(open, "half-open", "probe ok", "fail", "fail", "fail"), "...P.....", breakerClosed, cooldown},
+		{"reopens longer on a failed probe", append(open, "half-open", "probe fail"), "...P.P", breakerOpen, 2 * cooldown},
+		{"caps the cooldown", append(open, "half-open", "probe fail", "half-open", "probe fail"), "...P.P.P", breakerOpen, maxBreakerCooldown},
+		{"resets the cooldown when closed", append(open, "half-open", "probe fail", "half-open", "probe ok"), "...P.P..", breakerClosed, cooldown},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			breakerEnv(t, cooldown, time.Hour)
+			b := breakerFor("example.com")
+			var parked strings.Builder
+			for _, step := range tc.steps {
+				p := false
+				switch step {
+				case "ok", "fail":
+					p = b.record(step == "fail", false)
+				case "half-open":
+					b.mu.Lock()
+					b.setState(breakerHalfOpen)
+					b.mu.Unlock()
+				case "probe ok", "probe fail":
+					probe, err := b.acquire(time.Now().Add(time.Second))
+					if err != nil || !probe {
+						t.Fatalf("acquire when half-open = %v, %v; want the probe", probe, err)
+					}
+					p = b.record(step == "probe fail", true)
+				}
+				if p {
+					parked.WriteByte('P')
+				} else {
+					parked.WriteByte('.')
+				}
+			}
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if parked.String() != tc.parked || b.state != tc.state || b.cooldown != tc.cooldown {
+				t.Fatalf("parked %s, %s with cooldown %v; want %s, %s with cooldown %v",
+					parked.String(), b.state, b.cooldown, tc.parked, tc.state, tc.cooldown)
+			}
+		})
+	}
+}
+
+// flakyHost answers 503 while down is set.
+type flakyHost struct {
+	down     atomic.Bool
+	requests atomic.Int32
+}
+
+func (h *flakyHost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.requests.Add(1)
+	if h.down.Load() {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("{}"))
+}
+
+// downHost starts a host that answers 503 until it is brought back, and sends
+// it requests until its breaker opens. The request that opens the breaker is
+// left parked on the returned channel.
+func downHost(t *testing.T) (*flakyHost, *hostBreaker, func() (int, error), chan result) {
+	t.Helper()
+	h := &flakyHost{}
+	h.down.Store(true)
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	get := func() (int, error) {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		resp, err := doRequest(srv.Client(), req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	// Failures before the breaker opens reach the caller.
+	for i := 0; i < 3; i++ {
+		if code, err := get(); code != http.StatusServiceUnavailable {
+			t.Fatalf("request %d before the breaker opened: %d, %v", i, code, err)
+		}
+	}
+	results := make(chan result, 16)
+	go send(get, results)
+	b := breakerFor(strings.TrimPrefix(srv.URL, "http://"))
+	waitParked(t, b, 1)
+	return h, b, get, results
+}
+
+type result struct {
+	code int
+	err  error
+}
+
+func send(get func() (int, error), results chan<- result) {
+	code, err := get()
+	results <- result{code, err}
+}
+
+// waitParked waits until n requests wait behind b.
+func waitParked(t *testing.T, b *hostBreaker, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		b.mu.Lock()
+		waiting := b.waiting
+		b.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests parked, want %d", waiting, n)
+		}
+	}
+}
+
+func TestBreakerParksRequestsUntilTheHostRecovers(t *testing.T) {
+	breakerEnv(t, 200*time.Millisecond, time.Minute)
+	h, b, get, results := downHost(t)
+	const later = 5
+	for i := 0; i < later; i++ {
+		go send(get, results)
+	}
+	waitParked(t, b, 1+later)
+	if got := h.requests.Load(); got != 4 {
+		t.Errorf("requests sent while open = %d, want 4", got)
+	}
+	h.down.Store(false)
+
+	// After the cooldown one probe goes through, then the rest.
+	for i := 0; i < 1+later; i++ {
+		if r := <-results; r.code != http.StatusOK || r.err != nil {
+			t.Errorf("parked request finished with %d, %v; want 200", r.code, r.err)
+		}
+	}
+	if got := h.requests.Load(); got != 4+1+later {
+		t.Errorf("requests sent = %d, want %d", got, 4+1+later)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerClosed || b.opens != 1 {
+		t.Errorf("breaker %s after %d opens, want closed after 1", b.state, b.opens)
+	}
+}
+
+func TestBreakerReleasesWaitersAtTheDeadline(t *testing.T) {
+	// No probe comes before the deadline: only it can release the waiters.
+	breakerEnv(t, time.Hour, 200*time.Millisecond)
+	start := time.Now()
+	h, b, get, results := downHost(t)
+	for i := 0; i < 2; i++ {
+		go send(get, results)
+	}
+	waitParked(t, b, 3)
+	for i := 0; i < 3; i++ {
+		select {
+		case r := <-results:
+			if r.err == nil || !strings.Contains(r.err.Error(), "circuit breaker") {
+				t.Errorf("parked request returned %d, %v; want the breaker error", r.code, r.err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("parked requests not released at their deadline")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("released after %v, before the deadline", elapsed)
+	}
+	if got := h.requests.Load(); got != 4 {
+		t.Errorf("requests sent = %d, want 4", got)
+	}
+}
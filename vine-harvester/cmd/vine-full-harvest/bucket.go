@@ -0,0 +1,240 @@
+// bucket.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"vine-harvester/internal/archive"
+	"vine-harvester/internal/s3store"
+)
+
+// With -outDir s3://bucket/prefix, profiles, posts, media and layout.json are
+// written straight to the bucket under prefix, in the same layout and codecs
+// as a local outDir. Existence checks (what makes a rerun resume) are one
+// HEAD each; profiles and posts are only looked up under the current
+// -storageCodec's name, so a bucket should keep one codec across runs. The
+// run's own state (media ledger, history, quarantine, discovery logs) stays
+// local in -stateDir. The client is vine-harvester's (internal/s3store) and
+// reads the same environment as the Node server: S3_ENDPOINT or R2_ENDPOINT,
+// AWS_REGION, the AWS_* or R2_* keys (else the standard credential chain),
+// S3_FORCE_PATH_STYLE, AWS_MAX_ATTEMPTS and AWS_RETRY_MODE. Its requests go
+// through the HTTP client settings (-proxy, -caBundle, else AWS_CA_BUNDLE).
+
+// bucketArchive is the s3:// outDir: archive paths (relative, e.g.
+// "posts/100/1.json") map to keys under prefix.
+type bucketArchive struct {
+	c        *s3.Client
+	bucket   string
+	prefix   string
+	partSize int
+}
+
+// bucket is set when -outDir is an s3:// URL.
+var bucket *bucketArchive
+
+func (b *bucketArchive) key(path string) string {
+	return b.prefix + filepath.ToSlash(path)
+}
+
+func (b *bucketArchive) Exists(path string) (bool, error) {
+	_, err := b.c.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key(path)),
+	})
+	if s3store.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *bucketArchive) Read(path string) ([]byte, error) {
+	out, err := b.c.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key(path)),
+	})
+	if s3store.IsNotFound(err) {
+		return nil, fmt.Errorf("%s: %w", b.key(path), os.ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+func (b *bucketArchive) put(path string, data []byte) error {
+	_, err := b.c.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:      aws.String(b.bucket),
+		Key:         aws.String(b.key(path)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentTypeFor(path)),
+	})
+	return err
+}
+
+// upload streams r to path: one PUT when it fits in a part, a multipart
+// upload otherwise, so large media never has to be held in memory whole.
+func (b *bucketArchive) upload(path string, r io.Reader) error {
+	readPart := func() ([]byte, error) {
+		return io.ReadAll(io.LimitReader(r, int64(b.partSize)))
+	}
+	buf, err := readPart()
+	if err != nil {
+		return err
+	}
+	if len(buf) < b.partSize {
+		return b.put(path, buf)
+	}
+
+	ctx := context.Background()
+	key := b.key(path)
+	created, err := b.c.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(b.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentTypeFor(path)),
+	})
+	if err != nil {
+		return fmt.Errorf("S3 create multipart upload %s: %w", key, err)
+	}
+	abort := func(err error) error {
+		b.c.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(b.bucket),
+			Key:      aws.String(key),
+			UploadId: created.UploadId,
+		})
+		return err
+	}
+
+	var parts []types.CompletedPart
+	for num := int32(1); len(buf) > 0; num++ {
+		out, err := b.c.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(b.bucket),
+			Key:        aws.String(key),
+			UploadId:   created.UploadId,
+			PartNumber: aws.Int32(num),
+			Body:       bytes.NewReader(buf),
+		})
+		if err != nil {
+			return abort(err)
+		}
+		parts = append(parts, types.CompletedPart{PartNumber: aws.Int32(num), ETag: out.ETag})
+		if buf, err = readPart(); err != nil {
+			return abort(err)
+		}
+	}
+
+	_, err = b.c.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(b.bucket),
+		Key:             aws.String(key),
+		UploadId:        created.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return abort(fmt.Errorf("S3 complete multipart upload %s: %w", key, err))
+	}
+	return nil
+}
+
+func (b *bucketArchive) Remove(path string) error {
+	_, err := b.c.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key(path)),
+	})
+	if err != nil && !s3store.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// empty reports whether nothing is stored under path yet.
+func (b *bucketArchive) Empty(path string) (bool, error) {
+	out, err := b.c.ListObjectsV2(context.Background(), &s3.ListObjectsV2Input{
+		Bucket:  aws.String(b.bucket),
+		Prefix:  aws.String(b.key(path) + "/"),
+		MaxKeys: aws.Int32(1),
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(out.Contents) == 0, nil
+}
+
+func contentTypeFor(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return "application/json; charset=utf-8"
+	case ".mp4":
+		return "video/mp4"
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	case ".gz":
+		return "application/gzip"
+	case ".zst":
+		return "application/zstd"
+	case ".vseg":
+		return "application/octet-stream"
+	}
+	return "application/octet-stream"
+}
+
+// Write streams what fill writes to path. A failed fill leaves path untouched
+// because the object is only created once the upload completes.
+func (b *bucketArchive) Write(path string, fill func(w io.Writer) error) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(fill(pw))
+	}()
+	err := b.upload(path, pr)
+	pr.CloseWithError(err) // unblocks fill if the upload gave up early
+	return err
+}
+
+// archiveFS is where profiles, posts, media and layout.json go: the bucket
+// when -outDir is s3://, the local filesystem otherwise.
+func archiveFS() archive.FS {
+	if bucket == nil {
+		return archive.Local{}
+	}
+	return bucket
+}
+
+// docs stores profiles and posts in archiveFS with the current codec. In a
+// bucket a document is only looked up under that codec's name, so a check
+// stays one HEAD.
+func docs() archive.Store {
+	return archive.Store{FS: archiveFS(), Codec: storage, CurrentOnly: bucket != nil}
+}
+
+// storage is the codec new profile and post files are written with.
+var storage = archive.Codecs[0]
+
+// The archive* helpers are archiveFS for the media write path.
+
+func archiveExists(path string) bool {
+	ok, err := archiveFS().Exists(path)
+	if err != nil {
+		log.Printf("Warning: %v\n", err)
+	}
+	return ok
+}
+
+func archiveWrite(path string, fill func(w io.Writer) error) error {
+	return archiveFS().Write(path, fill)
+}
+
+func archiveRemove(path string) error {
+	return archiveFS().Remove(path)
+}
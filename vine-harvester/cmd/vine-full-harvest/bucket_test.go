@@ -0,0 +1,134 @@
+// bucket_test.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"vine-harvester/internal/archive"
+	"vine-harvester/internal/s3store"
+	"vine-harvester/internal/s3store/s3test"
+)
+
+// bucketEnv points the archive at a fresh S3 stand-in under prefix "arch/".
+func bucketEnv(t *testing.T) *s3test.Server {
+	t.Helper()
+	srv := s3test.NewServer(t)
+	c, err := s3store.NewClient(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket = &bucketArchive{c: c, bucket: "vines", prefix: "arch/", partSize: 5 << 20}
+	archiveRoot = ""
+	profileStore = looseStore{root: "profiles"}
+	t.Cleanup(func() {
+		bucket = nil
+		storage = archive.Codecs[0]
+	})
+	return srv
+}
+
+func TestBucketArchiveStoresDocuments(t *testing.T) {
+	srv := bucketEnv(t)
+	storage = archive.Codecs[1] // gzip
+	srv.Put("vines", "arch/profiles/2.json", []byte(`{"userIdStr":"2"}`))
+
+	if err := writeDoc(profileStore, "1", map[string]interface{}{"userIdStr": "1"}); err != nil {
+		t.Fatalf("writeDoc: %v", err)
+	}
+	if _, ok := srv.Get("vines", "arch/profiles/1.json.gz"); !ok {
+		t.Fatalf("profile not stored with the gzip codec: %v", srv.Keys("vines"))
+	}
+
+	// One HEAD per existence check, under the current codec's name only: the
+	// plain copy of 2 is not looked for.
+	for _, tc := range []struct {
+		id   string
+		want bool
+	}{{"1", true}, {"2", false}, {"3", false}} {
+		srv.ResetOps()
+		if got := profileStore.exists(tc.id); got != tc.want {
+			t.Errorf("exists(%s) = %v, want %v", tc.id, got, tc.want)
+		}
+		if n, heads := srv.Ops("List")+srv.Ops("HEAD")+srv.Ops("GET"), srv.Ops("HEAD"); n != 1 || heads != 1 {
+			t.Errorf("exists(%s) took %d requests (%d HEAD)", tc.id, n, heads)
+		}
+	}
+	if doc, err := readDoc(profileStore, "1"); err != nil || doc["userIdStr"] != "1" {
+		t.Errorf("readDoc(1) = %v, %v", doc, err)
+	}
+
+	// Writing 2 with the current codec is a single upload; the plain copy is
+	// left alone rather than deleted on every write.
+	srv.ResetOps()
+	if err := writeDoc(profileStore, "2", map[string]interface{}{"userIdStr": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Ops("DELETE") + srv.Ops("DeleteObjects"); n != 0 {
+		t.Errorf("write issued %d deletes", n)
+	}
+	if _, ok := srv.Get("vines", "arch/profiles/2.json"); !ok {
+		t.Error("plain copy of profile 2 removed by a write")
+	}
+	if doc, err := readDoc(profileStore, "2"); err != nil || doc["userIdStr"] != "2" {
+		t.Errorf("readDoc(2) = %v, %v", doc, err)
+	}
+	if n := srv.BadSignatures(); n != 0 {
+		t.Fatalf("%d requests were refused for their signature", n)
+	}
+}
+
+func TestBucketArchiveMultipartUpload(t *testing.T) {
+	srv := bucketEnv(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), (12<<20)/16)
+
+	err := archiveWrite("media/v.mp4", func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("archiveWrite: %v", err)
+	}
+	got, ok := srv.Get("vines", "arch/media/v.mp4")
+	if !ok || !bytes.Equal(got, data) {
+		t.Fatalf("uploaded %d bytes, stored %d", len(data), len(got))
+	}
+	if srv.Ops("CreateMultipart") != 1 || srv.Ops("UploadPart") != 3 || srv.Ops("Complete") != 1 {
+		t.Fatalf("multipart ops: create %d, parts %d, complete %d",
+			srv.Ops("CreateMultipart"), srv.Ops("UploadPart"), srv.Ops("Complete"))
+	}
+	if !archiveExists("media/v.mp4") || archiveExists("media/w.mp4") {
+		t.Fatal("archiveExists disagrees with the bucket")
+	}
+	if err := archiveRemove("media/v.mp4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := archiveRemove("media/v.mp4"); err != nil {
+		t.Fatalf("removing a missing object: %v", err)
+	}
+	if n := srv.BadSignatures(); n != 0 {
+		t.Fatalf("%d requests were refused for their signature", n)
+	}
+}
+
+func TestS3StandInRejectsBadSignatures(t *testing.T) {
+	srv := s3test.NewServer(t)
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "wrong")
+	c, err := s3store.NewClient(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String("vines"),
+		Key:    aws.String("x"),
+		Body:   bytes.NewReader([]byte("x")),
+	})
+	if err == nil || srv.BadSignatures() != 1 {
+		t.Fatalf("PutObject with a wrong secret = %v (%d refused)", err, srv.BadSignatures())
+	}
+}
@@ -0,0 +1,163 @@
+// cache.go
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"vine-harvester/internal/atomicfile"
+)
+
+// cacheTransport records GET responses under a cache directory and can play
+// them back, so parsers and post-processing can be re-run over an earlier
+// crawl without touching the network. Each response is two files named by the
+// SHA-256 of the URL:
+//
+//	<dir>/ab/abcdef....json   status, headers, URL and when it was recorded
+//	<dir>/ab/abcdef....body   the raw body
+//
+// The pair is plain enough to check in as a test fixture. Only answers worth
+// repeating are kept: 2xx, 304, and the 404/410 of entities that are gone.
+// Anything else (429, 5xx, ...) is passed through, and is a miss when an older
+// cache has it.
+type cacheTransport struct {
+	base http.RoundTripper
+	dir  string
+	mode string
+}
+
+type cachedResponse struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Status     int         `json:"status"`
+	Header     http.Header `json:"header"`
+	RecordedAt string      `json:"recordedAt"`
+}
+
+func newCacheTransport(base http.RoundTripper, dir, mode string) (*cacheTransport, error) {
+	switch mode {
+	case "record", "replay", "offline":
+	default:
+		return nil, fmt.Errorf("unknown cache mode %q (want record, replay or offline)", mode)
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &cacheTransport{base: base, dir: dir, mode: mode}, nil
+}
+
+func cacheableStatus(code int) bool {
+	return code >= 200 && code < 300 || code == http.StatusNotModified ||
+		code == http.StatusNotFound || code == http.StatusGone
+}
+
+func (t *cacheTransport) paths(req *http.Request) (meta, body string) {
+	sum := sha256.Sum256([]byte(req.Method + " " + req.URL.String()))
+	name := hex.EncodeToString(sum[:])
+	base := filepath.Join(t.dir, name[:2], name)
+	return base + ".json", base + ".body"
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		if t.mode == "offline" {
+			return nil, fmt.Errorf("offline: %s %s not allowed", req.Method, req.URL)
+		}
+		return t.base.RoundTrip(req)
+	}
+
+	metaPath, bodyPath := t.paths(req)
+	if t.mode != "record" {
+		if resp, err := t.replay(req, metaPath, bodyPath); err == nil {
+			return resp, nil
+		} else if t.mode == "offline" {
+			return nil, fmt.Errorf("offline: %s not in cache: %w", req.URL, err)
+		}
+	}
+
+	// Conditional headers would turn the recording into a bodiless 304.
+	live := req
+	if req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		live = req.Clone(req.Context())
+		live.Header.Del("If-None-Match")
+		live.Header.Del("If-Modified-Since")
+	}
+	resp, err := t.base.RoundTrip(live)
+	if err != nil {
+		return nil, err
+	}
+	if !cacheableStatus(resp.StatusCode) {
+		return resp, nil
+	}
+	if err := t.record(req, resp, metaPath, bodyPath); err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("record %s: %w", req.URL, err)
+	}
+	resp.Body.Close()
+	return t.replay(req, metaPath, bodyPath)
+}
+
+func (t *cacheTransport) record(req *http.Request, resp *http.Response, metaPath, bodyPath string) error {
+	err := atomicfile.Write(bodyPath, func(w io.Writer) error {
+		_, err := io.Copy(w, resp.Body)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return writeJSONFile(metaPath, cachedResponse{
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Status:     resp.StatusCode,
+		Header:     resp.Header,
+		RecordedAt: time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+func (t *cacheTransport) replay(req *http.Request, metaPath, bodyPath string) (*http.Response, error) {
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, err
+	}
+	var m cachedResponse
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", metaPath, err)
+	}
+	if !cacheableStatus(m.Status) {
+		return nil, fmt.Errorf("%s: status %d is not replayed", metaPath, m.Status)
+	}
+	f, err := os.Open(bodyPath)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	header := m.Header
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", m.Status, http.StatusText(m.Status)),
+		StatusCode:    m.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          f,
+		ContentLength: fi.Size(),
+		Request:       req,
+	}, nil
+}
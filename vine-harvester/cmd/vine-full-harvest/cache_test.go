@@ -0,0 +1,82 @@
+// cache_test.go
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestCacheReplaysOnlyRepeatableAnswers(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		n := hits[r.URL.Path]
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/ok":
+			io.WriteString(w, `{"ok":true}`)
+		case "/gone":
+			http.NotFound(w, r)
+		case "/busy":
+			if n == 1 {
+				http.Error(w, "slow down", http.StatusTooManyRequests)
+				return
+			}
+			io.WriteString(w, `{"busy":false}`)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	get := func(mode, path string) (int, string, error) {
+		ct, err := newCacheTransport(srv.Client().Transport, dir, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := (&http.Client{Transport: ct}).Get(srv.URL + path)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), nil
+	}
+
+	for _, path := range []string{"/ok", "/gone", "/busy"} {
+		get("replay", path)
+	}
+	if code, _, _ := get("replay", "/busy"); code != 200 {
+		t.Fatalf("second /busy = %d, want a live 200", code)
+	}
+	for _, path := range []string{"/ok", "/gone", "/busy"} {
+		if _, _, err := get("offline", path); err != nil {
+			t.Fatalf("offline %s: %v", path, err)
+		}
+	}
+	if code, body, _ := get("offline", "/ok"); code != 200 || body != `{"ok":true}` {
+		t.Fatalf("replayed /ok = %d %q", code, body)
+	}
+	if code, _, _ := get("offline", "/gone"); code != 404 {
+		t.Fatalf("replayed /gone = %d, want 404", code)
+	}
+	if hits["/ok"] != 1 || hits["/gone"] != 1 || hits["/busy"] != 2 {
+		t.Fatalf("server hits = %v, want ok:1 gone:1 busy:2", hits)
+	}
+
+	// A 429 recorded by an older version is not played back.
+	ct, _ := newCacheTransport(nil, dir, "offline")
+	req, _ := http.NewRequest("GET", srv.URL+"/throttled", nil)
+	metaPath, bodyPath := ct.paths(req)
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}, Body: http.NoBody}
+	if err := ct.record(req, resp, metaPath, bodyPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := get("offline", "/throttled"); err == nil {
+		t.Fatal("offline replay served a cached 429")
+	}
+}
@@ -0,0 +1,87 @@
+// codec.go
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"vine-harvester/internal/archive"
+)
+
+// convertStorage rewrites every profile and post under the given roots with
+// the current codec. Each file is replaced atomically and the old copy only
+// removed afterwards, so an interrupted conversion can simply be run again. A
+// document that already has a current-codec copy (written by a run after the
+// codec changed) keeps it, and only the older copy is removed.
+func convertStorage(roots ...string) error {
+	paths := make(chan string, *workers*2)
+	var converted, failed int64
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range paths {
+				base := archive.StoredBase(p)
+				var err error
+				if !fileExists(base + storage.Ext) {
+					var raw []byte
+					raw, err = os.ReadFile(p)
+					if err == nil {
+						raw, err = archive.Decode(raw)
+					}
+					if err == nil {
+						err = docs().Write(base, raw)
+					}
+				}
+				if err == nil {
+					err = archiveRemove(p)
+				}
+				if err != nil {
+					log.Printf("convert %s: %v\n", p, err)
+					atomic.AddInt64(&failed, 1)
+					continue
+				}
+				atomic.AddInt64(&converted, 1)
+			}
+		}()
+	}
+
+	var walkErr error
+	for _, root := range roots {
+		walkErr = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && p == root {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			if base := archive.StoredBase(p); base != "" && p != base+storage.Ext {
+				paths <- p
+			}
+			return nil
+		})
+		if walkErr != nil {
+			break
+		}
+	}
+	close(paths)
+	wg.Wait()
+
+	log.Printf("Converted %d files to %s storage (%d failed)\n", converted, storage.Name, failed)
+	if walkErr != nil {
+		return walkErr
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be converted", failed)
+	}
+	return nil
+}
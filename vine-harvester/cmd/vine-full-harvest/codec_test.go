@@ -0,0 +1,38 @@
+// codec_test.go
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"vine-harvester/internal/archive"
+)
+
+func TestConvertStorageKeepsNewerCopy(t *testing.T) {
+	defer func() { storage = archive.Codecs[0] }()
+	root := t.TempDir()
+	old := filepath.Join(root, "1", "1.json")
+	os.MkdirAll(filepath.Dir(old), 0755)
+	os.WriteFile(old, []byte(`{"v":"old"}`), 0644)
+	os.WriteFile(filepath.Join(root, "1", "2.json"), []byte(`{"v":"only"}`), 0644)
+
+	// A gzip run rewrote post 1 but left its plain copy behind.
+	storage = archive.Codecs[1]
+	if err := docs().Write(old, []byte(`{"v":"new"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := convertStorage(root); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ base, want string }{{"1.json", `{"v":"new"}`}, {"2.json", `{"v":"only"}`}} {
+		base := filepath.Join(root, "1", tc.base)
+		if _, err := os.Stat(base); !os.IsNotExist(err) {
+			t.Errorf("%s: plain copy left after conversion", tc.base)
+		}
+		got, err := docs().Read(base)
+		if err != nil || string(got) != tc.want {
+			t.Errorf("%s = %s, %v; want %s", tc.base, got, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// filter.go
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// harvestFilter scopes a run to a curated subset. User allow/deny lists are
+// checked before anything is fetched; verified/explicit checks run on the
+// profile, and date/engagement checks on each post, so filtered posts are
+// neither saved nor have their media downloaded. The zero value (and a nil
+// *harvestFilter) lets everything through.
+type harvestFilter struct {
+	AllowUsers      []string `json:"allowUsers,omitempty"`
+	DenyUsers       []string `json:"denyUsers,omitempty"`
+	CreatedAfter    string   `json:"createdAfter,omitempty"`
+	CreatedBefore   string   `json:"createdBefore,omitempty"`
+	MinLoops        int64    `json:"minLoops,omitempty"`
+	MinLikes        int64    `json:"minLikes,omitempty"`
+	VerifiedOnly    bool     `json:"verifiedOnly,omitempty"`
+	ExcludeExplicit bool     `json:"excludeExplicit,omitempty"`
+
+	allow, deny   map[string]struct{}
+	after, before time.Time
+
+	skippedUsers int64 // atomic
+	skippedPosts int64 // atomic
+}
+
+// loadHarvestFilter reads -filterConfig, if any, then applies the filter flags
+// that were set explicitly on the command line.
+func loadHarvestFilter() (*harvestFilter, error) {
+	f := &harvestFilter{}
+	if *filterConfig != "" {
+		data, err := os.ReadFile(*filterConfig)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, f); err != nil {
+			return nil, fmt.Errorf("%s: %w", *filterConfig, err)
+		}
+	}
+
+	var err error
+	flag.Visit(func(fl *flag.Flag) {
+		if err != nil {
+			return
+		}
+		switch fl.Name {
+		case "allowUsers":
+			f.AllowUsers, err = readUserIDList(*allowUsers)
+		case "denyUsers":
+			f.DenyUsers, err = readUserIDList(*denyUsers)
+		case "createdAfter":
+			f.CreatedAfter = *createdAfter
+		case "createdBefore":
+			f.CreatedBefore = *createdBefore
+		case "minLoops":
+			f.MinLoops = *minLoops
+		case "minLikes":
+			f.MinLikes = *minLikes
+		case "verifiedOnly":
+			f.VerifiedOnly = *verifiedOnly
+		case "excludeExplicit":
+			f.ExcludeExplicit = *excludeExplicit
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if f.AllowUsers != nil {
+		f.allow = make(map[string]struct{}, len(f.AllowUsers))
+		for _, id := range f.AllowUsers {
+			f.allow[id] = struct{}{}
+		}
+	}
+	f.deny = make(map[string]struct{}, len(f.DenyUsers))
+	for _, id := range f.DenyUsers {
+		f.deny[id] = struct{}{}
+	}
+	if f.CreatedAfter != "" {
+		if f.after, err = parseVineTime(f.CreatedAfter); err != nil {
+			return nil, fmt.Errorf("createdAfter: %w", err)
+		}
+	}
+	if f.CreatedBefore != "" {
+		if f.before, err = parseVineTime(f.CreatedBefore); err != nil {
+			return nil, fmt.Errorf("createdBefore: %w", err)
+		}
+	}
+
+	if f.active() {
+		desc, _ := json.Marshal(f)
+		log.Printf("Harvest filters: %s\n", desc)
+	}
+	return f, nil
+}
+
+func (f *harvestFilter) active() bool {
+	return f != nil && (f.allow != nil || len(f.deny) > 0 || !f.after.IsZero() || !f.before.IsZero() ||
+		f.MinLoops > 0 || f.MinLikes > 0 || f.VerifiedOnly || f.ExcludeExplicit)
+}
+
+func (f *harvestFilter) allowsUserID(userID string) bool {
+	if f == nil {
+		return true
+	}
+	_, denied := f.deny[userID]
+	_, allowed := f.allow[userID]
+	return !denied && (f.allow == nil || allowed)
+}
+
+// needsProfile reports whether allowsProfile can reject anyone.
+func (f *harvestFilter) needsProfile() bool {
+	return f != nil && (f.VerifiedOnly || f.ExcludeExplicit)
+}
+
+func (f *harvestFilter) allowsProfile(profile map[string]interface{}) bool {
+	if f == nil {
+		return true
+	}
+	return !(f.VerifiedOnly && !jsonTruthy(profile["verified"])) &&
+		!(f.ExcludeExplicit && jsonTruthy(profile["explicitContent"]))
+}
+
+func (f *harvestFilter) allowsPost(post map[string]interface{}) bool {
+	if f == nil || f.allowsPostFields(post) {
+		return true
+	}
+	atomic.AddInt64(&f.skippedPosts, 1)
+	return false
+}
+
+func (f *harvestFilter) allowsPostFields(post map[string]interface{}) bool {
+	if f == nil {
+		return true
+	}
+	if f.ExcludeExplicit && jsonTruthy(post["explicitContent"]) {
+		return false
+	}
+	if f.MinLoops > 0 && countField(post["loops"]) < f.MinLoops {
+		return false
+	}
+	if f.MinLikes > 0 && countField(post["likes"]) < f.MinLikes {
+		return false
+	}
+	if !f.after.IsZero() || !f.before.IsZero() {
+		created, _ := post["created"].(string)
+		t, err := parseVineTime(created)
+		if err != nil {
+			return false // can't place it in the range, so leave it out
+		}
+		if !f.after.IsZero() && t.Before(f.after) {
+			return false
+		}
+		if !f.before.IsZero() && !t.Before(f.before) {
+			return false
+		}
+	}
+	return true
+}
+
+// vineTimeLayouts covers the archive's "created" values and what people type
+// on the command line.
+var vineTimeLayouts = []string{
+	"2006-01-02T15:04:05.999999",
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+func parseVineTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range vineTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q", s)
+}
+
+// countField reads a post counter, which the archive stores either as a number
+// or as {"count": n, ...}.
+func countField(v interface{}) int64 {
+	switch t := v.(type) {
+	case float64:
+		return int64(t)
+	case map[string]interface{}:
+		return countField(t["count"])
+	}
+	return 0
+}
+
+func jsonTruthy(v interface{}) bool {
+	switch t := v.(type) {
+	case bool:
+		return t
+	case float64:
+		return t != 0
+	case string:
+		return t == "1" || strings.EqualFold(t, "true")
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+// flight.go
+package main
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// flightGroup lets concurrent callers with the same key share one call and its
+// result (singleflight). A key is forgotten as soon as its call returns, so a
+// failure only reaches the callers that were already waiting on it and the
+// next attempt goes out fresh.
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flightCall
+	n  int64 // callers served by someone else's call (atomic)
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+var jsonFlights, mediaFlights flightGroup
+
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*flightCall)
+	}
+	if c, ok := g.m[key]; ok {
+		g.mu.Unlock()
+		atomic.AddInt64(&g.n, 1)
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	c := &flightCall{}
+	c.wg.Add(1)
+	g.m[key] = c
+	g.mu.Unlock()
+
+	c.val, c.err = fn()
+
+	g.mu.Lock()
+	delete(g.m, key)
+	g.mu.Unlock()
+	c.wg.Done()
+	return c.val, c.err
+}
+
+func (g *flightGroup) shared() int64 { return atomic.LoadInt64(&g.n) }
+
+// canonicalURL normalizes u so trivially different spellings of the same
+// resource share a flight: lower-case scheme and host, no default port, no
+// fragment, sorted query.
+func canonicalURL(u string) string {
+	p, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	p.Scheme = strings.ToLower(p.Scheme)
+	host := strings.ToLower(p.Hostname())
+	if port := p.Port(); port != "" && !(p.Scheme == "http" && port == "80") && !(p.Scheme == "https" && port == "443") {
+		host += ":" + port
+	}
+	p.Host = host
+	p.Fragment = ""
+	if p.RawQuery != "" {
+		p.RawQuery = p.Query().Encode()
+	}
+	if p.Path == "" {
+		p.Path = "/"
+	}
+	return p.String()
+}
@@ -0,0 +1,126 @@
+// flight_test.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupSharesOneCall(t *testing.T) {
+	errDown := errors.New("host down")
+	cases := []struct {
+		name string
+		val  interface{}
+		err  error
+	}{
+		{"result", "profile 1001", nil},
+		{"error", nil, errDown},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var g flightGroup
+			var calls int32
+			release := make(chan struct{})
+			fn := func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return tc.val, tc.err
+			}
+
+			const callers = 5
+			type result struct {
+				val interface{}
+				err error
+			}
+			results := make(chan result, callers)
+			var wg sync.WaitGroup
+			do := func() {
+				defer wg.Done()
+				v, err := g.Do("https://vine.co/api/users/profiles/1001", fn)
+				results <- result{v, err}
+			}
+			wg.Add(1)
+			go do()
+			for atomic.LoadInt32(&calls) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			wg.Add(callers - 1)
+			for i := 1; i < callers; i++ {
+				go do()
+			}
+			for deadline := time.Now().Add(5 * time.Second); g.shared() < callers-1; time.Sleep(time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("%d callers joined the flight, want %d", g.shared(), callers-1)
+				}
+			}
+			close(release)
+			wg.Wait()
+			close(results)
+
+			for r := range results {
+				if r.val != tc.val || r.err != tc.err {
+					t.Errorf("Do = %v, %v; want %v, %v", r.val, r.err, tc.val, tc.err)
+				}
+			}
+			if calls != 1 {
+				t.Errorf("fn called %d times, want 1", calls)
+			}
+
+			// The key is forgotten once the call returns: the next one goes
+			// out fresh, failed or not.
+			v, err := g.Do("https://vine.co/api/users/profiles/1001", func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				return "again", nil
+			})
+			if v != "again" || err != nil || calls != 2 || g.shared() != callers-1 {
+				t.Errorf("Do after the flight = %v, %v with %d calls and %d shared", v, err, calls, g.shared())
+			}
+		})
+	}
+}
+
+func TestFlightGroupKeysAreSeparate(t *testing.T) {
+	var g flightGroup
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("https://vine.co/api/timelines/posts/%d", i)
+			v, err := g.Do(key, func() (interface{}, error) {
+				<-release
+				return i, nil
+			})
+			if v != i || err != nil {
+				t.Errorf("Do(%s) = %v, %v", key, v, err)
+			}
+		}(i)
+	}
+	close(release)
+	wg.Wait()
+	if g.shared() != 0 {
+		t.Errorf("shared = %d across different keys", g.shared())
+	}
+}
+
+func TestCanonicalURL(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"HTTPS://Vine.CO/api/posts/1", "https://vine.co/api/posts/1"},
+		{"https://vine.co:443/api/posts/1", "https://vine.co/api/posts/1"},
+		{"http://vine.co:80/api/posts/1", "http://vine.co/api/posts/1"},
+		{"https://vine.co:8443/api/posts/1", "https://vine.co:8443/api/posts/1"},
+		{"https://vine.co/api/posts/1#top", "https://vine.co/api/posts/1"},
+		{"https://vine.co/api?b=2&a=1", "https://vine.co/api?a=1&b=2"},
+		{"https://vine.co", "https://vine.co/"},
+	}
+	for _, tc := range cases {
+		if got := canonicalURL(tc.in); got != tc.want {
+			t.Errorf("canonicalURL(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
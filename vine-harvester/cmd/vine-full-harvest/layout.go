@@ -0,0 +1,148 @@
+// layout.go
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"vine-harvester/internal/archive"
+	"vine-harvester/internal/atomicfile"
+)
+
+// layout is the scheme every profile and post path goes through (see
+// archive.Layout); main resolves it from layout.json and -layout.
+var layout = archive.Layouts[0]
+
+// isShardName reports whether a directory name is a shard (two hex digits).
+// Vine user IDs are long decimal numbers, so they never look like one.
+func isShardName(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// migrateLayout moves every profile, post directory and segment under
+// outDir, and the history kept for each user, to where layout to puts it. Each entry is moved with a rename, and
+// entries already in place are left alone, so an interrupted migration is
+// finished by running it again; outDir/layout.json records the migration
+// until it completes.
+func migrateLayout(to archive.Layout, profilesDir, postsRoot string) error {
+	st, err := archive.ReadLayoutState(archive.Local{}, archiveRoot)
+	if err != nil {
+		return err
+	}
+	if st.MigratingTo == "" && st.Layout == to.Name {
+		log.Printf("%s already uses the %s layout\n", *outDir, to.Name)
+		return nil
+	}
+	st.MigratingTo = to.Name
+	if err := archive.WriteLayoutState(archive.Local{}, archiveRoot, st); err != nil {
+		return err
+	}
+
+	maxLevels := to.Levels
+	for _, l := range archive.Layouts {
+		if l.Name == st.Layout && l.Levels > maxLevels {
+			maxLevels = l.Levels
+		}
+	}
+	moved := 0
+	roots := []string{profilesDir, postsRoot}
+	for _, kind := range []string{"profiles", "posts", "validators"} {
+		roots = append(roots, filepath.Join(stateRoot, "history", kind))
+	}
+	for _, root := range roots {
+		n, err := migrateDir(root, root, 0, maxLevels, to)
+		moved += n
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := archive.WriteLayoutState(archive.Local{}, archiveRoot, archive.LayoutState{Layout: to.Name}); err != nil {
+		return err
+	}
+	log.Printf("Migrated %s from %s to %s layout (%d entries moved)\n", *outDir, st.Layout, to.Name, moved)
+	return nil
+}
+
+// migrateDir moves the user entries found in dir (depth shard levels below
+// root) to their place under layout to.
+func migrateDir(root, dir string, depth, maxLevels int, to archive.Layout) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		if e.IsDir() && depth < maxLevels && isShardName(e.Name()) {
+			n, err := migrateDir(root, p, depth+1, maxLevels, to)
+			moved += n
+			if err != nil {
+				return moved, err
+			}
+			os.Remove(p) // only succeeds once empty
+			continue
+		}
+
+		userID := e.Name()
+		if e.IsDir() {
+			// posts/<userId>/
+		} else if base := archive.StoredBase(e.Name()); base != "" {
+			userID = strings.TrimSuffix(base, ".json")
+		} else if strings.HasSuffix(userID, ".vseg") {
+			userID = strings.TrimSuffix(userID, ".vseg")
+		} else {
+			continue
+		}
+		target := to.Path(root, userID, e.Name())
+		if target == p {
+			continue
+		}
+		if err := moveEntry(p, target); err != nil {
+			return moved, fmt.Errorf("move %s: %w", p, err)
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// moveEntry renames src to dst. A user's post directory that already exists
+// at dst (a rerun after an interruption) is merged file by file.
+func moveEntry(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	fi, err := os.Stat(dst)
+	if err != nil || !fi.IsDir() {
+		if err := os.Rename(src, dst); err != nil {
+			return err
+		}
+		atomicfile.SyncDir(filepath.Dir(dst))
+		return nil
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.Rename(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())); err != nil {
+			return err
+		}
+	}
+	atomicfile.SyncDir(dst)
+	return os.Remove(src)
+}
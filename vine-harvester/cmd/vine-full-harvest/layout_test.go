@@ -0,0 +1,72 @@
+// layout_test.go
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"vine-harvester/internal/archive"
+)
+
+func TestMigrateLayoutResumes(t *testing.T) {
+	dir := t.TempDir()
+	*outDir, archiveRoot, stateRoot = dir, dir, dir
+	defer func() { layout = archive.Layouts[0] }()
+	profilesDir, postsRoot := filepath.Join(dir, "profiles"), filepath.Join(dir, "posts")
+	to := archive.Layouts[2]
+
+	put := func(path, data string) {
+		t.Helper()
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An earlier run was interrupted: profile 1 and one of its posts already
+	// moved, the rest still flat.
+	put(filepath.Join(dir, "layout.json"), `{"layout":"flat","migratingTo":"hash2"}`)
+	put(to.Path(profilesDir, "1", "1.json"), `{}`)
+	put(filepath.Join(to.Path(postsRoot, "1", "1"), "11.json"), `{}`)
+	put(filepath.Join(postsRoot, "1", "12.json.gz"), `{}`)
+	put(filepath.Join(profilesDir, "2.json.zst"), `{}`)
+	put(filepath.Join(postsRoot, "2.vseg"), `seg`)
+	put(filepath.Join(dir, "history", "validators", "2.json"), `{}`)
+	put(filepath.Join(dir, "history", "posts", "2", "21", "20160101T000000.000Z.json"), `{}`)
+
+	if _, err := archive.ResolveLayout(archiveFS(), archiveRoot, *layoutName); err == nil {
+		t.Fatal("ResolveLayout accepted a half-migrated outDir")
+	}
+	if err := migrateLayout(to, profilesDir, postsRoot); err != nil {
+		t.Fatalf("migrateLayout: %v", err)
+	}
+
+	for _, p := range []string{
+		to.Path(profilesDir, "1", "1.json"),
+		filepath.Join(to.Path(postsRoot, "1", "1"), "11.json"),
+		filepath.Join(to.Path(postsRoot, "1", "1"), "12.json.gz"),
+		to.Path(profilesDir, "2", "2.json.zst"),
+		to.Path(postsRoot, "2", "2.vseg"),
+		to.Path(filepath.Join(dir, "history", "validators"), "2", "2.json"),
+		filepath.Join(to.Path(filepath.Join(dir, "history", "posts"), "2", "2"), "21", "20160101T000000.000Z.json"),
+	} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("not migrated: %v", err)
+		}
+	}
+	for _, p := range []string{filepath.Join(postsRoot, "1"), filepath.Join(profilesDir, "2.json.zst"), filepath.Join(postsRoot, "2.vseg")} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s left behind", p)
+		}
+	}
+
+	*layoutName = ""
+	got, err := archive.ResolveLayout(archiveFS(), archiveRoot, *layoutName)
+	if err != nil || got.Name != "hash2" {
+		t.Fatalf("ResolveLayout after migration = %v, %v", got.Name, err)
+	}
+	// Running it again is a no-op.
+	if err := migrateLayout(to, profilesDir, postsRoot); err != nil {
+		t.Fatalf("second migrateLayout: %v", err)
+	}
+}
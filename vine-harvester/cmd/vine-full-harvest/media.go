@@ -0,0 +1,100 @@
+// media.go
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"vine-harvester/internal/atomicfile"
+	"vine-harvester/internal/medialedger"
+)
+
+func collectMediaURLs(v interface{}) []string {
+	var urls []string
+
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for _, vv := range t {
+				walk(vv)
+			}
+		case []interface{}:
+			for _, vv := range t {
+				walk(vv)
+			}
+		case string:
+			s := t
+			if strings.Contains(s, "vines.s3.amazonaws.com") {
+				if strings.Contains(s, ".mp4") || strings.Contains(s, ".jpg") ||
+					strings.Contains(s, ".jpeg") || strings.Contains(s, ".png") ||
+					strings.Contains(s, ".gif") {
+					urls = append(urls, s)
+				}
+			}
+		default:
+			// ignore
+		}
+	}
+
+	walk(v)
+	return urls
+}
+
+func downloadMedia(rawURL, mediaRoot string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	cleanPath := strings.TrimLeft(parsed.Path, "/")
+	localPath := filepath.Join(mediaRoot, cleanPath)
+
+	// Reposts share media, so several workers can want the same file at once.
+	// The file is what we're protecting, so the flight is keyed by its path.
+	_, err = mediaFlights.Do(localPath, func() (interface{}, error) {
+		if !media.Start(rawURL, func() bool { return archiveExists(localPath) }) {
+			return nil, nil // done, missing, or out of attempts
+		}
+		var err error
+		if !archiveExists(localPath) {
+			err = fetchMediaFile(rawURL, localPath)
+		}
+		media.Finish(rawURL, err)
+		return nil, err
+	})
+	return err
+}
+
+func fetchMediaFile(rawURL, localPath string) error {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := doRequest(mediaClient, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		switch resp.StatusCode {
+		case http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+			return fmt.Errorf("media HTTP %d: %w", resp.StatusCode, medialedger.ErrGone)
+		}
+		return fmt.Errorf("media HTTP %d", resp.StatusCode)
+	}
+
+	if bucket != nil {
+		return bucket.upload(localPath, resp.Body)
+	}
+	return atomicfile.Write(localPath, func(w io.Writer) error {
+		_, err := io.Copy(w, resp.Body)
+		return err
+	})
+}
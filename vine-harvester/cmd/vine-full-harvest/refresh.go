@@ -0,0 +1,283 @@
+// refresh.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"vine-harvester/internal/atomicfile"
+)
+
+// When the archive sends an ETag or Last-Modified with a profile or post, it is
+// kept in one file per user, outDir/history/validators/<userId>.json (placed
+// by the archive layout), covering the profile and every post. With -refresh,
+// saved entities are re-requested conditionally; when the archive returns
+// something that differs from what we have, the old file is kept as
+// history/<kind>/<userId>/[<postId>/]<timestamp>.json and a summary of the
+// changed fields goes to outDir/history/changes.jsonl. Media is only
+// downloaded for posts that changed, and downloadMedia still skips files we
+// already have.
+
+type validators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	CheckedAt    string `json:"checkedAt"`
+	Source       string `json:"source,omitempty"` // which -profileSources/-postSources entry served it
+}
+
+type entityStatus int
+
+const (
+	entityUnchanged entityStatus = iota
+	entityChanged
+)
+
+// entityChange is one line of changes.jsonl.
+type entityChange struct {
+	Kind     string   `json:"kind"`
+	ID       string   `json:"id"`
+	Source   string   `json:"source,omitempty"`
+	At       string   `json:"at"`
+	Previous string   `json:"previous"`
+	Added    []string `json:"added,omitempty"`
+	Removed  []string `json:"removed,omitempty"`
+	Changed  []string `json:"changed,omitempty"`
+}
+
+// userValidators is the validators file of one user. Posts are keyed by the
+// ID they are stored under.
+type userValidators struct {
+	Profile *validators           `json:"profile,omitempty"`
+	Posts   map[string]validators `json:"posts,omitempty"`
+}
+
+// known reports whether v carries anything a conditional request can use.
+func (v validators) known() bool {
+	return v.ETag != "" || v.LastModified != ""
+}
+
+// maxDiffPaths caps how many field paths one change record lists.
+const maxDiffPaths = 100
+
+var refreshedProfiles sync.Map
+
+var changeLog struct {
+	mu sync.Mutex
+	f  *os.File
+	n  int64
+}
+
+// historyDir is where previous versions of userID's profile (kind
+// "profiles") or of one of their posts (kind "posts", with the post ID) go.
+func historyDir(kind, userID string, postID ...string) string {
+	dir := layout.Path(filepath.Join(stateRoot, "history", kind), userID, userID)
+	return filepath.Join(append([]string{dir}, postID...)...)
+}
+
+func validatorsPath(userID string) string {
+	return layout.Path(filepath.Join(stateRoot, "history", "validators"), userID, userID+".json")
+}
+
+// validatorLocks serialize updates of a user's validators file; seed workers
+// may save posts of the same user concurrently.
+var validatorLocks [64]sync.Mutex
+
+func validatorLock(userID string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return &validatorLocks[h.Sum32()%uint32(len(validatorLocks))]
+}
+
+func loadUserValidators(userID string) userValidators {
+	var uv userValidators
+	if data, err := os.ReadFile(validatorsPath(userID)); err == nil {
+		json.Unmarshal(data, &uv)
+	}
+	return uv
+}
+
+// saveValidators merges what was learned about userID's profile (nil: no
+// news) and posts into their validators file. Entries without an ETag or
+// Last-Modified are dropped, so servers that send neither cost no files.
+func saveValidators(userID string, profile *validators, posts map[string]validators) {
+	if profile != nil && !profile.known() {
+		profile = nil
+	}
+	for id, v := range posts {
+		if !v.known() {
+			delete(posts, id)
+		}
+	}
+	if profile == nil && len(posts) == 0 {
+		return
+	}
+
+	mu := validatorLock(userID)
+	mu.Lock()
+	defer mu.Unlock()
+	uv := loadUserValidators(userID)
+	if profile != nil {
+		uv.Profile = profile
+	}
+	if len(posts) > 0 && uv.Posts == nil {
+		uv.Posts = make(map[string]validators, len(posts))
+	}
+	for id, v := range posts {
+		uv.Posts[id] = v
+	}
+	if err := writeJSONFile(validatorsPath(userID), uv); err != nil {
+		log.Printf("Warning: save validators of user %s: %v\n", userID, err)
+	}
+}
+
+// refreshEntity re-validates the copy of qid saved in store against its
+// sources, conditionally when prev is known, and returns the current version
+// along with the validators it came with.
+func refreshEntity(srcs []source, kind, qid, id, hist string, prev *validators, store docStore, validate func(map[string]interface{}) error) (map[string]interface{}, entityStatus, validators, error) {
+	fresh, val, err := fetchEntity(srcs, kind, qid, id, prev, validate)
+	if err == errNotModified && prev != nil {
+		// Revalidated: same validators, checked just now.
+		val = *prev
+		val.CheckedAt = time.Now().UTC().Format(time.RFC3339)
+		old, err := readDoc(store, qid)
+		return old, entityUnchanged, val, err
+	}
+	if err == errNotModified || isPayloadError(err) {
+		// a bad refresh (already quarantined) is not a change
+		old, err := readDoc(store, qid)
+		return old, entityUnchanged, validators{}, err
+	}
+	if err != nil {
+		return nil, entityUnchanged, validators{}, err
+	}
+	fresh = rewriteURLs(fresh).(map[string]interface{})
+
+	oldRaw, err := store.read(qid)
+	if err != nil {
+		return nil, entityUnchanged, val, err
+	}
+	var old map[string]interface{}
+	if err := json.Unmarshal(oldRaw, &old); err != nil {
+		return nil, entityUnchanged, val, fmt.Errorf("decode %s: %w", qid, err)
+	}
+
+	// Round-trip through JSON so numbers compare the way they were saved.
+	var cur map[string]interface{}
+	b, err := json.Marshal(fresh)
+	if err != nil {
+		return nil, entityUnchanged, val, err
+	}
+	if err := json.Unmarshal(b, &cur); err != nil {
+		return nil, entityUnchanged, val, err
+	}
+
+	if reflect.DeepEqual(old, cur) {
+		return old, entityUnchanged, val, nil
+	}
+
+	now := time.Now().UTC()
+	prevPath := filepath.Join(hist, now.Format("20060102T150405.000Z")+".json")
+	if err := os.MkdirAll(hist, 0755); err != nil {
+		return nil, entityUnchanged, val, err
+	}
+	if err := atomicfile.WriteBytes(prevPath, oldRaw); err != nil {
+		return nil, entityUnchanged, val, fmt.Errorf("keep previous version: %w", err)
+	}
+	if err := writeDoc(store, qid, cur); err != nil {
+		return nil, entityUnchanged, val, err
+	}
+
+	change := entityChange{Kind: kind, ID: qid, Source: val.Source, At: now.Format(time.RFC3339), Previous: prevPath}
+	diffJSON("", old, cur, &change)
+	recordChange(change)
+	log.Printf("%s %s changed (%d added, %d removed, %d changed fields)\n",
+		kind, qid, len(change.Added), len(change.Removed), len(change.Changed))
+	return cur, entityChanged, val, nil
+}
+
+// diffJSON lists the field paths that differ between a and b, e.g.
+// "loops.count" or "tags[2]".
+func diffJSON(path string, a, b interface{}, c *entityChange) {
+	if len(c.Added)+len(c.Removed)+len(c.Changed) >= maxDiffPaths {
+		return
+	}
+	am, aok := a.(map[string]interface{})
+	bm, bok := b.(map[string]interface{})
+	if aok && bok {
+		keys := make([]string, 0, len(am)+len(bm))
+		for k := range am {
+			keys = append(keys, k)
+		}
+		for k := range bm {
+			if _, ok := am[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			av, inA := am[k]
+			bv, inB := bm[k]
+			switch {
+			case !inA:
+				c.Added = append(c.Added, p)
+			case !inB:
+				c.Removed = append(c.Removed, p)
+			default:
+				diffJSON(p, av, bv, c)
+			}
+		}
+		return
+	}
+
+	as, aok := a.([]interface{})
+	bs, bok := b.([]interface{})
+	if aok && bok && len(as) == len(bs) {
+		for i := range as {
+			diffJSON(fmt.Sprintf("%s[%d]", path, i), as[i], bs[i], c)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		c.Changed = append(c.Changed, path)
+	}
+}
+
+func recordChange(c entityChange) {
+	line, err := json.Marshal(c)
+	if err != nil {
+		return
+	}
+	changeLog.mu.Lock()
+	defer changeLog.mu.Unlock()
+	if changeLog.f == nil {
+		path := filepath.Join(stateRoot, "history", "changes.jsonl")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			log.Printf("Warning: %v\n", err)
+			return
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Printf("Warning: open %s: %v\n", path, err)
+			return
+		}
+		changeLog.f = f
+	}
+	if _, err := changeLog.f.Write(append(line, '\n')); err != nil {
+		log.Printf("Warning: write changes.jsonl: %v\n", err)
+		return
+	}
+	changeLog.n++
+}
@@ -0,0 +1,149 @@
+// refresh_test.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"vine-harvester/internal/archive"
+)
+
+// fakeArchive serves one user's profile and posts. Posts listed in etags are
+// sent with that ETag and answered with 304 when it comes back.
+type fakeArchive struct {
+	mu          sync.Mutex
+	userID      string
+	posts       map[string]string // post ID -> description
+	etags       map[string]string
+	conditional int
+}
+
+func (a *fakeArchive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	id := strings.TrimSuffix(filepath.Base(r.URL.Path), ".json")
+	var doc map[string]interface{}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/profiles/") && id == a.userID:
+		var ids []interface{}
+		for pid := range a.posts {
+			ids = append(ids, pid)
+		}
+		doc = map[string]interface{}{"userIdStr": a.userID, "username": "u", "posts": ids}
+	case strings.HasPrefix(r.URL.Path, "/posts/") && a.posts[id] != "":
+		if tag := a.etags[id]; tag != "" {
+			if r.Header.Get("If-None-Match") != "" {
+				a.conditional++
+				if r.Header.Get("If-None-Match") == tag {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+			w.Header().Set("ETag", tag)
+		}
+		doc = map[string]interface{}{
+			"postIdStr":   id,
+			"userIdStr":   a.userID,
+			"videoUrl":    "https://v.cdn.vine.co/" + id + ".mp4",
+			"description": a.posts[id],
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(doc)
+}
+
+// refreshEnv points the harvester at a fresh archive served by h.
+func refreshEnv(t *testing.T, h http.Handler) (profilesDir, postsRoot string) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	stateRoot = dir
+	profilesDir, postsRoot = filepath.Join(dir, "profiles"), filepath.Join(dir, "posts")
+	profileStore = looseStore{root: profilesDir}
+	postStore = postsStore{loose: looseStore{root: postsRoot}}
+	profileSrcs = []source{{Name: "archive", Template: srv.URL + "/profiles/{id}.json"}}
+	postSrcs = []source{{Name: "archive", Template: srv.URL + "/posts/{id}.json"}}
+	jsonClient = srv.Client()
+	layout = archive.Layouts[1]
+	*breakerErrorRate, *download = 0, false
+	t.Cleanup(func() {
+		layout = archive.Layouts[0]
+		*refresh = false
+		refreshedProfiles = sync.Map{}
+	})
+	return profilesDir, postsRoot
+}
+
+func TestValidatorsArePerUserAndOnlyWhenSent(t *testing.T) {
+	a := &fakeArchive{
+		userID: "1001",
+		posts:  map[string]string{"11": "tagged", "12": "untagged"},
+		etags:  map[string]string{"11": `"v1"`},
+	}
+	profilesDir, postsRoot := refreshEnv(t, a)
+
+	if err := processUser("1001", nil, profilesDir, postsRoot, "", 0, nil); err != nil {
+		t.Fatalf("processUser: %v", err)
+	}
+
+	var files []string
+	filepath.Walk(filepath.Join(stateRoot, "history"), func(p string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if len(files) != 1 || files[0] != validatorsPath("1001") {
+		t.Fatalf("history files = %v, want only %s", files, validatorsPath("1001"))
+	}
+	if filepath.Dir(files[0]) == filepath.Join(stateRoot, "history", "validators") {
+		t.Errorf("validators file %s does not follow the hash1 layout", files[0])
+	}
+
+	uv := loadUserValidators("1001")
+	if uv.Profile != nil {
+		t.Errorf("profile validators saved without ETag or Last-Modified: %+v", uv.Profile)
+	}
+	if len(uv.Posts) != 1 || uv.Posts["11"].ETag != `"v1"` {
+		t.Fatalf("post validators = %+v, want only 11 with \"v1\"", uv.Posts)
+	}
+
+	// A refresh revalidates the tagged post conditionally and picks up the
+	// change to the untagged one.
+	stale := uv.Posts["11"]
+	stale.CheckedAt = "2016-01-01T00:00:00Z"
+	saveValidators("1001", nil, map[string]validators{"11": stale})
+	*refresh = true
+	a.mu.Lock()
+	a.posts["12"] = "edited"
+	a.mu.Unlock()
+	if err := processUser("1001", nil, profilesDir, postsRoot, "", 0, nil); err != nil {
+		t.Fatalf("processUser (refresh): %v", err)
+	}
+	if a.conditional != 1 {
+		t.Errorf("conditional requests = %d, want 1", a.conditional)
+	}
+	// The 304 keeps the ETag and moves checkedAt forward.
+	if got := loadUserValidators("1001").Posts["11"]; got.ETag != `"v1"` || got.CheckedAt <= stale.CheckedAt {
+		t.Errorf("validators of 11 after a 304 = %+v, want ETag \"v1\" checked now", got)
+	}
+	post, err := readDoc(postStore, "1001/12")
+	if err != nil || post["description"] != "edited" {
+		t.Fatalf("refreshed post 12 = %v, %v", post, err)
+	}
+	prev, _ := filepath.Glob(filepath.Join(historyDir("posts", "1001", "12"), "*.json"))
+	if len(prev) != 1 {
+		t.Fatalf("previous versions of post 12 = %v", prev)
+	}
+}
@@ -0,0 +1,286 @@
+// scheduler.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"vine-harvester/internal/scan"
+)
+
+// A run that gets cut short should already have the accounts people care about
+// most, so with -priority each level's users are ranked before they are handed
+// out instead of going in ID order. The ordering is a list of keys compared in
+// turn:
+//
+//	allowlist  users listed in -priorityUsers first
+//	followers  higher followerCount first (needs the profile)
+//	loops      higher loopCount first (needs the profile)
+//	shares     users whose Vines were shared most in the tweet corpus first
+//	oldest     lower (earlier) user ID first
+//
+// Ties always fall back to oldest. Keys that need the profile make the level
+// fetch every profile before any posts; processUser then reads them from disk.
+// The ranking is a scan.Set of sortable keys (see rankKey), so like the user
+// sets themselves it spills to disk instead of growing with the corpus.
+
+var priorityKeys = map[string]bool{"allowlist": true, "followers": true, "loops": true, "shares": true, "oldest": true}
+
+type userScheduler struct {
+	keys  []string
+	allow map[string]struct{}
+
+	// shares holds "<userId>\t<slug>" for every Vine of a user found in the
+	// tweet corpus; filled in by fetchUsersFromSlugs and counted per user
+	// when a level is ranked.
+	shares *scan.Set
+}
+
+func newUserScheduler(spec, allowPath string) (*userScheduler, error) {
+	s := &userScheduler{}
+	for _, k := range strings.Split(spec, ",") {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if k == "" {
+			continue
+		}
+		if !priorityKeys[k] {
+			return nil, fmt.Errorf("unknown priority key %q", k)
+		}
+		s.keys = append(s.keys, k)
+	}
+	if s.wants("shares") {
+		s.shares = scan.NewSet(*tmpDir, int64(*dedupMemMB)<<20)
+	}
+	if allowPath != "" {
+		ids, err := readUserIDList(allowPath)
+		if err != nil {
+			return nil, err
+		}
+		s.allow = make(map[string]struct{}, len(ids))
+		for _, id := range ids {
+			s.allow[id] = struct{}{}
+		}
+		log.Printf("Loaded %d priority users from %s\n", len(s.allow), allowPath)
+	}
+	return s, nil
+}
+
+func (s *userScheduler) enabled() bool { return len(s.keys) > 0 }
+
+func (s *userScheduler) wants(key string) bool {
+	for _, k := range s.keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// countShare records that slug, found in the tweet corpus, belongs to userID.
+func (s *userScheduler) countShare(userID, slug string) {
+	if s.shares != nil {
+		// A failed spill surfaces when rank iterates the shares.
+		s.shares.Add(userID + "\t" + slug)
+	}
+}
+
+func (s *userScheduler) close() {
+	if s.shares != nil {
+		s.shares.Close()
+	}
+}
+
+// rank returns users as a set of rank keys whose iteration order is the
+// harvest order; userOfRank recovers the user ID. Profiles are fetched first
+// when the ordering needs follower or loop counts.
+func (s *userScheduler) rank(users *scan.Set, profilesDir string) (*scan.Set, error) {
+	var shares *scan.Iter
+	more := false
+	if s.shares != nil {
+		it, err := s.shares.Iter()
+		if err != nil {
+			return nil, err
+		}
+		defer it.Close()
+		shares, more = it, it.Next()
+	}
+
+	needProfile := s.wants("followers") || s.wants("loops")
+	n := 1
+	if needProfile {
+		n = *workers
+		log.Printf("Fetching profiles to rank users by %s\n", strings.Join(s.keys, ","))
+	}
+	ranked := scan.NewSet(*tmpDir, int64(*dedupMemMB)<<20)
+	jobs := make(chan queuedUser, n*2)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range jobs {
+				if needProfile {
+					// On error processUser retries the profile and reports it.
+					if profile, err := loadProfile(u.id, profilesDir); err == nil {
+						u.followers = profileCount(profile, "followerCount")
+						u.loops = profileCount(profile, "loopCount")
+					}
+				}
+				// A failed spill stops the feed below.
+				ranked.Add(s.rankKey(u))
+			}
+		}()
+	}
+
+	err := users.Each(func(uid string) error {
+		u := queuedUser{id: uid}
+		_, u.allowed = s.allow[uid]
+		// Both sets iterate in the same order: a user's share keys are the
+		// ones starting with "<uid>\t", and '\t' sorts before any ID byte.
+		prefix := uid + "\t"
+		for more && shares.Key() < prefix {
+			more = shares.Next()
+		}
+		for more && strings.HasPrefix(shares.Key(), prefix) {
+			u.shares++
+			more = shares.Next()
+		}
+		if err := ranked.Err(); err != nil {
+			return err
+		}
+		jobs <- u
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+	if err == nil && shares != nil {
+		err = shares.Err()
+	}
+	if err == nil {
+		err = ranked.Err()
+	}
+	if err != nil {
+		ranked.Close()
+		return nil, err
+	}
+	return ranked, nil
+}
+
+// rankKey encodes where u goes in the ordering as a string that sorts best
+// first: one fixed-width field per key, then the ID as the tie-breaker.
+func (s *userScheduler) rankKey(u queuedUser) string {
+	var b strings.Builder
+	desc := func(n int64) {
+		if n < 0 {
+			n = 0
+		}
+		fmt.Fprintf(&b, "%019d", math.MaxInt64-n)
+	}
+	for _, k := range s.keys {
+		switch k {
+		case "allowlist":
+			if u.allowed {
+				b.WriteByte('0')
+			} else {
+				b.WriteByte('1')
+			}
+		case "followers":
+			desc(u.followers)
+		case "loops":
+			desc(u.loops)
+		case "shares":
+			desc(u.shares)
+		case "oldest":
+			b.WriteString(idKey(u.id))
+		}
+	}
+	b.WriteString(idKey(u.id))
+	b.WriteByte('\t')
+	b.WriteString(u.id)
+	return b.String()
+}
+
+// userOfRank returns the user ID at the end of a rankKey.
+func userOfRank(key string) string {
+	return key[strings.LastIndexByte(key, '\t')+1:]
+}
+
+type queuedUser struct {
+	id        string
+	allowed   bool
+	followers int64
+	loops     int64
+	shares    int64
+}
+
+// idLess orders numeric IDs by value; Vine IDs grow over time, so this is
+// also oldest-first.
+func idLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// idKey is an ID in a form whose string order is idLess.
+func idKey(id string) string {
+	return fmt.Sprintf("%04d%s", len(id), id)
+}
+
+// profileCount reads a counter such as followerCount, which the archive
+// stores as a number (occasionally a string).
+func profileCount(profile map[string]interface{}, key string) int64 {
+	switch v := profile[key].(type) {
+	case float64:
+		return int64(v)
+	case string:
+		var n int64
+		fmt.Sscan(v, &n)
+		return n
+	}
+	return 0
+}
+
+// orderPostIDs applies -postOrder to the post IDs listed in a profile.
+func orderPostIDs(ids []string, order string) []string {
+	switch order {
+	case "oldest":
+		sort.SliceStable(ids, func(i, j int) bool { return idLess(ids[i], ids[j]) })
+	case "newest":
+		sort.SliceStable(ids, func(i, j int) bool { return idLess(ids[j], ids[i]) })
+	}
+	return ids
+}
+
+// readUserIDList reads user IDs from a JSON array of strings or a text file
+// with one ID per line (first field; blank lines and # comments skipped).
+func readUserIDList(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		var ids []string
+		if err := json.Unmarshal(trimmed, &ids); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return ids, nil
+	}
+	var ids []string
+	for _, line := range strings.Split(string(trimmed), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		ids = append(ids, fields[0])
+	}
+	return ids, nil
+}
@@ -0,0 +1,77 @@
+// scheduler_test.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"vine-harvester/internal/scan"
+)
+
+func rankedIDs(t *testing.T, s *userScheduler, users *scan.Set) []string {
+	t.Helper()
+	ranked, err := s.rank(users, t.TempDir())
+	if err != nil {
+		t.Fatalf("rank: %v", err)
+	}
+	defer ranked.Close()
+	var ids []string
+	ranked.Each(func(key string) error {
+		ids = append(ids, userOfRank(key))
+		return nil
+	})
+	return ids
+}
+
+func TestSchedulerRanksByAllowlistSharesThenID(t *testing.T) {
+	allow := filepath.Join(t.TempDir(), "allow.txt")
+	os.WriteFile(allow, []byte("900\n"), 0644)
+	s, err := newUserScheduler("allowlist,shares", allow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	users := scan.NewSet(t.TempDir(), 0)
+	defer users.Close()
+	for _, id := range []string{"12", "123", "9", "900", "45"} {
+		users.Add(id)
+	}
+	// 123 has three Vines in the corpus, 12 and 45 one each; "12\t" must not
+	// be confused with "123".
+	for i, id := range []string{"123", "123", "123", "12", "45", "unknown"} {
+		s.countShare(id, fmt.Sprintf("slug%d", i))
+	}
+
+	got := fmt.Sprint(rankedIDs(t, s, users))
+	if want := "[900 123 12 45 9]"; got != want {
+		t.Fatalf("order = %s, want %s", got, want)
+	}
+}
+
+func TestSchedulerOldestIsNumeric(t *testing.T) {
+	s, err := newUserScheduler("oldest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := scan.NewSet(t.TempDir(), 0)
+	defer users.Close()
+	for _, id := range []string{"1000", "99", "5", "100"} {
+		users.Add(id)
+	}
+	if got := fmt.Sprint(rankedIDs(t, s, users)); got != "[5 99 100 1000]" {
+		t.Fatalf("order = %s", got)
+	}
+}
+
+func TestSchedulerDefaultIsOff(t *testing.T) {
+	s, err := newUserScheduler(*priority, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.enabled() {
+		t.Fatalf("default -priority %q ranks users; expected plain user ID order", *priority)
+	}
+}
@@ -0,0 +1,405 @@
+// segment.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"vine-harvester/internal/archive"
+	"vine-harvester/internal/atomicfile"
+)
+
+// Millions of loose posts/<userId>/<postId>.json files are slow to list, sync
+// and back up, so with -postLayout packed a user's posts go into one
+// append-only segment, posts/<userId>.vseg, made of blocks:
+//
+//	record  'R' uvarint(len id) id uvarint(len data) data
+//	index   'I' uvarint(len json) json offset(8, big endian) "VSEGIDX1"
+//
+// data is the post JSON, encoded with the storage codec in effect when it was
+// written. Every append writes its records followed by an index block whose
+// JSON, {"prev": <offset of the previous index block or -1>, "posts":
+// {"<postId>": [dataOffset, dataLen]}}, lists only the posts it added; the
+// file always ends with the last index block's offset and magic. Readers
+// follow the chain of index blocks back from the end, newer entries winning.
+// Once a segment has segMaxIndexBlocks index blocks it is compacted into one
+// record per post and a single index block. A segment whose tail is torn (a
+// crash mid-append) is recovered by scanning its blocks from the start.
+
+const (
+	segMagic          = "VSEGIDX1"
+	segTrailerLen     = 16
+	segMaxIndexBlocks = 32
+)
+
+type segIndexBlock struct {
+	Prev  int64               `json:"prev"`
+	Posts map[string][2]int64 `json:"posts"`
+}
+
+type segment struct {
+	path   string
+	f      *os.File
+	size   int64
+	index  map[string][2]int64
+	last   int64 // offset of the last index block, -1 if none
+	blocks int   // index blocks in the chain
+}
+
+// segLocks serialize access to one user's segment; the seeding stage and
+// processUser can write the same user's posts at the same time.
+var segLocks [256]sync.Mutex
+
+func segLock(userID string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return &segLocks[h.Sum32()%uint32(len(segLocks))]
+}
+
+// openSegment opens the segment at path. Without write a missing segment is
+// an os.ErrNotExist error; with write it is created.
+func openSegment(path string, write bool) (*segment, error) {
+	var f *os.File
+	var err error
+	if write {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	} else {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s := &segment{path: path, f: f, size: fi.Size(), index: make(map[string][2]int64), last: -1}
+	if s.size == 0 {
+		return s, nil
+	}
+	if err := s.loadIndex(); err == nil {
+		return s, nil
+	}
+
+	// Torn tail: rebuild the index from the blocks that made it to disk.
+	if err := s.scan(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if write {
+		log.Printf("Recovering segment %s (%d posts)\n", path, len(s.index))
+		if err := s.compact(false); err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *segment) close() error {
+	return s.f.Close()
+}
+
+// loadIndex follows the index chain back from the trailer.
+func (s *segment) loadIndex() error {
+	if s.size < segTrailerLen {
+		return errors.New("segment too short")
+	}
+	tail := make([]byte, segTrailerLen)
+	if _, err := s.f.ReadAt(tail, s.size-segTrailerLen); err != nil {
+		return err
+	}
+	if string(tail[8:]) != segMagic {
+		return errors.New("missing segment trailer")
+	}
+
+	var chain []segIndexBlock
+	off := int64(binary.BigEndian.Uint64(tail[:8]))
+	s.last = off
+	for off >= 0 {
+		if off >= s.size || len(chain) > s.blocksLimit() {
+			return errors.New("corrupt segment index chain")
+		}
+		r := bufio.NewReader(io.NewSectionReader(s.f, off, s.size-off))
+		kind, err := r.ReadByte()
+		if err != nil || kind != 'I' {
+			return errors.New("corrupt segment index block")
+		}
+		n, err := binary.ReadUvarint(r)
+		if err != nil || int64(n) > s.size {
+			return errors.New("corrupt segment index block")
+		}
+		raw := make([]byte, n)
+		if _, err := io.ReadFull(r, raw); err != nil {
+			return err
+		}
+		var blk segIndexBlock
+		if err := json.Unmarshal(raw, &blk); err != nil {
+			return err
+		}
+		chain = append(chain, blk)
+		off = blk.Prev
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		for id, e := range chain[i].Posts {
+			s.index[id] = e
+		}
+	}
+	s.blocks = len(chain)
+	return nil
+}
+
+// blocksLimit bounds the index chain walk so a corrupt prev pointer cannot
+// loop forever.
+func (s *segment) blocksLimit() int {
+	return int(s.size/segTrailerLen) + 1
+}
+
+// scan reads every complete block from the start, for segments whose tail
+// was lost. Records past the last index block are kept.
+func (s *segment) scan() error {
+	r := &offsetReader{r: bufio.NewReader(io.NewSectionReader(s.f, 0, s.size))}
+	s.index = make(map[string][2]int64)
+	s.last, s.blocks = -1, 0
+	for {
+		start := r.off
+		kind, err := r.ReadByte()
+		if err != nil {
+			return nil
+		}
+		switch kind {
+		case 'R':
+			id, err := readSegBytes(r, s.size)
+			if err != nil {
+				return nil
+			}
+			n, err := binary.ReadUvarint(r)
+			if err != nil || r.off+int64(n) > s.size {
+				return nil
+			}
+			s.index[string(id)] = [2]int64{r.off, int64(n)}
+			if _, err := io.CopyN(io.Discard, r, int64(n)); err != nil {
+				return nil
+			}
+		case 'I':
+			if _, err := readSegBytes(r, s.size); err != nil {
+				return nil
+			}
+			if _, err := io.CopyN(io.Discard, r, segTrailerLen); err != nil {
+				return nil
+			}
+			s.last = start
+			s.blocks++
+		default:
+			if start == 0 {
+				return errors.New("not a post segment")
+			}
+			return nil
+		}
+	}
+}
+
+func readSegBytes(r *offsetReader, limit int64) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || r.off+int64(n) > limit {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+type offsetReader struct {
+	r   *bufio.Reader
+	off int64
+}
+
+func (o *offsetReader) Read(p []byte) (int, error) {
+	n, err := o.r.Read(p)
+	o.off += int64(n)
+	return n, err
+}
+
+func (o *offsetReader) ReadByte() (byte, error) {
+	b, err := o.r.ReadByte()
+	if err == nil {
+		o.off++
+	}
+	return b, err
+}
+
+func (s *segment) has(id string) bool {
+	_, ok := s.index[id]
+	return ok
+}
+
+// raw returns a post's stored (still encoded) bytes.
+func (s *segment) raw(id string) ([]byte, error) {
+	e, ok := s.index[id]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	b := make([]byte, e[1])
+	if _, err := s.f.ReadAt(b, e[0]); err != nil {
+		return nil, fmt.Errorf("%s %s: %w", s.path, id, err)
+	}
+	return b, nil
+}
+
+// get returns a post's plain JSON.
+func (s *segment) get(id string) ([]byte, error) {
+	b, err := s.raw(id)
+	if err != nil {
+		return nil, err
+	}
+	return archive.Decode(b)
+}
+
+// ids lists the posts in the segment in file order, for streaming through it.
+func (s *segment) ids() []string {
+	ids := make([]string, 0, len(s.index))
+	for id := range s.index {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return s.index[ids[i]][0] < s.index[ids[j]][0] })
+	return ids
+}
+
+type segRecord struct {
+	id   string
+	data []byte // encoded
+}
+
+// writeBlocks writes recs and an index block for them at offset base,
+// chaining to prev, and returns the new index entries and the index block's
+// offset.
+func writeBlocks(w io.Writer, base, prev int64, recs []segRecord) (map[string][2]int64, int64, error) {
+	bw := bufio.NewWriter(w)
+	off := base
+	var hdr [binary.MaxVarintLen64]byte
+	put := func(b []byte) {
+		bw.Write(b)
+		off += int64(len(b))
+	}
+	added := make(map[string][2]int64, len(recs))
+	for _, rec := range recs {
+		put([]byte{'R'})
+		put(hdr[:binary.PutUvarint(hdr[:], uint64(len(rec.id)))])
+		put([]byte(rec.id))
+		put(hdr[:binary.PutUvarint(hdr[:], uint64(len(rec.data)))])
+		added[rec.id] = [2]int64{off, int64(len(rec.data))}
+		put(rec.data)
+	}
+	idx, err := json.Marshal(segIndexBlock{Prev: prev, Posts: added})
+	if err != nil {
+		return nil, 0, err
+	}
+	at := off
+	put([]byte{'I'})
+	put(hdr[:binary.PutUvarint(hdr[:], uint64(len(idx)))])
+	put(idx)
+	var tail [segTrailerLen]byte
+	binary.BigEndian.PutUint64(tail[:8], uint64(at))
+	copy(tail[8:], segMagic)
+	put(tail[:])
+	return added, at, bw.Flush()
+}
+
+// append adds (or supersedes) posts; data is plain JSON and gets the current
+// storage codec.
+func (s *segment) append(posts map[string][]byte) error {
+	if len(posts) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(posts))
+	for id := range posts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	recs := make([]segRecord, 0, len(ids))
+	for _, id := range ids {
+		var buf bytes.Buffer
+		if err := storage.Encode(&buf, posts[id]); err != nil {
+			return err
+		}
+		recs = append(recs, segRecord{id: id, data: buf.Bytes()})
+	}
+
+	added, at, err := writeBlocks(io.NewOffsetWriter(s.f, s.size), s.size, s.last, recs)
+	if err != nil {
+		return fmt.Errorf("append %s: %w", s.path, err)
+	}
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+	fi, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	s.size = fi.Size()
+	s.last = at
+	s.blocks++
+	for id, e := range added {
+		s.index[id] = e
+	}
+	if s.blocks >= segMaxIndexBlocks {
+		return s.compact(false)
+	}
+	return nil
+}
+
+// compact rewrites the segment with only the current version of each post and
+// a single index block; with recode each post is re-encoded with the current
+// storage codec. The rewrite goes through atomicfile.Write, so an interrupted
+// compaction leaves the old segment in place.
+func (s *segment) compact(recode bool) error {
+	var recs []segRecord
+	for _, id := range s.ids() {
+		data, err := s.raw(id)
+		if err != nil {
+			return err
+		}
+		if recode {
+			plain, err := archive.Decode(data)
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", s.path, id, err)
+			}
+			var buf bytes.Buffer
+			if err := storage.Encode(&buf, plain); err != nil {
+				return err
+			}
+			data = buf.Bytes()
+		}
+		recs = append(recs, segRecord{id: id, data: data})
+	}
+	err := atomicfile.Write(s.path, func(w io.Writer) error {
+		_, _, err := writeBlocks(w, 0, -1, recs)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("compact %s: %w", s.path, err)
+	}
+
+	s.f.Close()
+	ns, err := openSegment(s.path, true)
+	if err != nil {
+		return err
+	}
+	*s = *ns
+	return nil
+}
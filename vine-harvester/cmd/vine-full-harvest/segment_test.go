@@ -0,0 +1,152 @@
+// segment_test.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func appendPosts(t *testing.T, path string, posts map[string]string) {
+	t.Helper()
+	s, err := openSegment(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	m := make(map[string][]byte, len(posts))
+	for id, doc := range posts {
+		m[id] = []byte(doc)
+	}
+	if err := s.append(m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func segmentPosts(t *testing.T, path string) map[string]string {
+	t.Helper()
+	s, err := openSegment(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	got := make(map[string]string)
+	for _, id := range s.ids() {
+		data, err := s.get(id)
+		if err != nil {
+			t.Fatalf("get %s: %v", id, err)
+		}
+		got[id] = string(data)
+	}
+	return got
+}
+
+func TestSegmentRecoversTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.vseg")
+	appendPosts(t, path, map[string]string{"a": `{"v":1}`})
+	fi, _ := os.Stat(path)
+	first := fi.Size()
+	appendPosts(t, path, map[string]string{"b": `{"v":2}`})
+
+	// Losing the second trailer keeps b, whose record is complete.
+	fi, _ = os.Stat(path)
+	os.Truncate(path, fi.Size()-3)
+	if got := fmt.Sprint(segmentPosts(t, path)); got != `map[a:{"v":1} b:{"v":2}]` {
+		t.Fatalf("after torn trailer: %s", got)
+	}
+
+	// Cutting into b's record drops b only.
+	os.Truncate(path, first+4)
+	if got := fmt.Sprint(segmentPosts(t, path)); got != `map[a:{"v":1}]` {
+		t.Fatalf("after torn record: %s", got)
+	}
+
+	// Opening for writing rewrites the segment, so it has a trailer again.
+	appendPosts(t, path, map[string]string{"c": `{"v":3}`})
+	s, err := openSegment(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if err := s.loadIndex(); err != nil {
+		t.Fatalf("recovered segment has no usable index: %v", err)
+	}
+	if len(s.index) != 2 || !s.has("a") || !s.has("c") {
+		t.Fatalf("recovered index = %v", s.index)
+	}
+}
+
+func TestSegmentCompactsLongChains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.vseg")
+	for i := 0; i < segMaxIndexBlocks-1; i++ {
+		appendPosts(t, path, map[string]string{"a": fmt.Sprintf(`{"v":%d}`, i), "keep": `{}`})
+	}
+	s, err := openSegment(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.blocks != segMaxIndexBlocks-1 {
+		t.Fatalf("blocks = %d before compaction", s.blocks)
+	}
+	s.close()
+
+	appendPosts(t, path, map[string]string{"a": `{"v":"last"}`})
+	s, err = openSegment(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if s.blocks != 1 {
+		t.Fatalf("blocks = %d after compaction, want 1", s.blocks)
+	}
+	if got := fmt.Sprint(segmentPosts(t, path)); got != `map[a:{"v":"last"} keep:{}]` {
+		t.Fatalf("compacted posts = %s", got)
+	}
+	if fi, _ := os.Stat(path); fi.Size() > 200 {
+		t.Fatalf("compacted segment still holds old versions (%d bytes)", fi.Size())
+	}
+}
+
+func TestUserPostsAppendOnce(t *testing.T) {
+	root := t.TempDir()
+	store := postsStore{loose: looseStore{root: root}, packed: true}
+	// A loose copy of a post is replaced by its packed one.
+	if err := (looseStore{root: root}).write("7/1", []byte(`{"old":true}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	posts := store.forUser("7")
+	for _, id := range []string{"1", "2", "3"} {
+		if err := posts.write("7/"+id, []byte(`{"id":"`+id+`"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !posts.exists("7/2") {
+		t.Fatal("held-back post not visible before close")
+	}
+	if data, _ := posts.read("7/1"); string(data) != `{"id":"1"}` {
+		t.Fatalf("read before close = %s", data)
+	}
+	if err := posts.write("8/1", nil); err == nil {
+		t.Fatal("wrote another user's post")
+	}
+	if err := posts.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openSegment(store.segPath("7"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if s.blocks != 1 || len(s.index) != 3 {
+		t.Fatalf("segment has %d index blocks and %d posts, want 1 and 3", s.blocks, len(s.index))
+	}
+	if (looseStore{root: root}).exists("7/1") {
+		t.Fatal("loose copy left next to the packed post")
+	}
+	if data, err := store.read("7/1"); err != nil || string(data) != `{"id":"1"}` {
+		t.Fatalf("read after close = %s, %v", data, err)
+	}
+}
@@ -0,0 +1,158 @@
+// sources.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Profiles and posts can come from several places, tried in order until one
+// returns a valid payload: the archive itself, mirrors, a Wayback Machine
+// "id_" snapshot URL, or a local dump directory. Each source is
+//
+//	name=[adapter+]template
+//
+// where template contains {id}. Adapters:
+//
+//	(none)    the body is the profile/post JSON
+//	envelope  the body is a vine.co API response; the entity is in "data"
+//	wayback   raw snapshot body; cache validators are neither sent nor kept
+//
+// A template that is a file path (or file:// URL) reads <id> from disk.
+// The name of the source that served each record is kept with its
+// validators, which a refresh only sends back to that source.
+
+type source struct {
+	Name     string
+	Adapter  string // "", "envelope", "wayback" or "dir"
+	Template string
+}
+
+var profileSrcs, postSrcs []source
+
+func parseSources(spec, base string) ([]source, error) {
+	if strings.TrimSpace(spec) == "" {
+		return []source{{Name: "archive", Template: strings.TrimRight(base, "/") + "/{id}.json"}}, nil
+	}
+	var out []source
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		eq := strings.IndexByte(item, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("source %q: want name=template", item)
+		}
+		src := source{Name: item[:eq], Template: item[eq+1:]}
+		for _, a := range []string{"envelope", "wayback"} {
+			if strings.HasPrefix(src.Template, a+"+") {
+				src.Adapter = a
+				src.Template = src.Template[len(a)+1:]
+			}
+		}
+		if strings.HasPrefix(src.Template, "file://") {
+			src.Template = strings.TrimPrefix(src.Template, "file://")
+			src.Adapter = "dir"
+		} else if !strings.Contains(src.Template, "://") {
+			src.Adapter = "dir"
+		}
+		if !strings.Contains(src.Template, "{id}") {
+			return nil, fmt.Errorf("source %q: template has no {id}", src.Name)
+		}
+		out = append(out, src)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no sources in %q", spec)
+	}
+	return out, nil
+}
+
+// fetch gets one entity from this source. prev, if set, makes the request
+// conditional.
+func (s source) fetch(id string, prev *validators) (map[string]interface{}, validators, string, error) {
+	if s.Adapter == "dir" {
+		if strings.ContainsAny(id, `/\`) || strings.Contains(id, "..") {
+			return nil, validators{}, "", fmt.Errorf("%s: bad id %q", s.Name, id)
+		}
+		path := strings.ReplaceAll(s.Template, "{id}", id)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, validators{}, path, err
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, validators{}, path, &payloadError{Reason: "invalid JSON: " + err.Error(), Body: data}
+		}
+		return m, validators{CheckedAt: time.Now().UTC().Format(time.RFC3339)}, path, nil
+	}
+
+	u := strings.ReplaceAll(s.Template, "{id}", url.PathEscape(id))
+	if s.Adapter == "wayback" {
+		prev = nil
+	}
+	m, val, err := fetchJSONConditional(u, prev)
+	if err != nil {
+		return nil, val, u, err
+	}
+	switch s.Adapter {
+	case "envelope":
+		if err := checkEnvelope(m); err != nil {
+			return m, val, u, err
+		}
+		data, ok := m["data"].(map[string]interface{})
+		if !ok {
+			return m, val, u, &payloadError{Reason: "envelope has no data object"}
+		}
+		m = data
+	case "wayback":
+		val.ETag, val.LastModified = "", ""
+	}
+	return m, val, u, nil
+}
+
+// fetchEntity tries srcs in order and returns the first payload that passes
+// validate, with its validators (Source set). Bad payloads are quarantined as
+// they turn up; if no source succeeds and at least one served a bad payload,
+// the error wraps that *payloadError. prev is only sent to the source that
+// produced it, and errNotModified from there ends the search.
+func fetchEntity(srcs []source, kind, qid, id string, prev *validators, validate func(map[string]interface{}) error) (map[string]interface{}, validators, error) {
+	var firstErr, badPayload error
+	for i, src := range srcs {
+		var cond *validators
+		if prev != nil && (prev.Source == src.Name || (prev.Source == "" && i == 0)) {
+			cond = prev
+		}
+		m, val, loc, err := src.fetch(id, cond)
+		if err == errNotModified {
+			return nil, val, err
+		}
+		if err == nil {
+			err = validate(m)
+		}
+		if err == nil {
+			val.Source = src.Name
+			return m, val, nil
+		}
+		if quarantine(kind, qid, loc, m, err) {
+			badPayload = fmt.Errorf("%s: %w", src.Name, err)
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("%s: %w", src.Name, err)
+		}
+	}
+	if badPayload != nil {
+		return nil, validators{}, badPayload
+	}
+	return nil, validators{}, firstErr
+}
+
+func isPayloadError(err error) bool {
+	var pe *payloadError
+	return errors.As(err, &pe)
+}
@@ -0,0 +1,191 @@
+// sources_test.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseSources(t *testing.T) {
+	cases := []struct {
+		spec string
+		want string // name/adapter/template per source, or the error
+	}{
+		{"", "[archive//https://archive.vine.co/profiles/{id}.json]"},
+		{"mirror=https://m.example/{id}.json, archive=https://archive.vine.co/p/{id}.json",
+			"[mirror//https://m.example/{id}.json archive//https://archive.vine.co/p/{id}.json]"},
+		{"api=envelope+https://vine.co/api/users/profiles/{id}",
+			"[api/envelope/https://vine.co/api/users/profiles/{id}]"},
+		{"wb=wayback+https://web.archive.org/web/2016id_/https://vine.co/{id}",
+			"[wb/wayback/https://web.archive.org/web/2016id_/https://vine.co/{id}]"},
+		{"dump=/data/profiles/{id}.json,file=file:///data/p/{id}.json",
+			"[dump/dir//data/profiles/{id}.json file/dir//data/p/{id}.json]"},
+		{"mirror", `source "mirror": want name=template`},
+		{"mirror=https://m.example/profile.json", `source "mirror": template has no {id}`},
+		{" , ", `no sources in " , "`},
+	}
+	for _, tc := range cases {
+		srcs, err := parseSources(tc.spec, "https://archive.vine.co/profiles/")
+		got := fmt.Sprint(err)
+		if err == nil {
+			var parts []string
+			for _, s := range srcs {
+				parts = append(parts, s.Name+"/"+s.Adapter+"/"+s.Template)
+			}
+			got = fmt.Sprint(parts)
+		}
+		if got != tc.want {
+			t.Errorf("parseSources(%q) = %s, want %s", tc.spec, got, tc.want)
+		}
+	}
+}
+
+// sourceHosts serves profile 1001 under /<source>/1001.json, as each kind of
+// source would, and logs which sources were asked (with "?" for a
+// conditional request).
+type sourceHosts struct {
+	mu   sync.Mutex
+	hits []string
+}
+
+func (h *sourceHosts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+	h.mu.Lock()
+	if r.Header.Get("If-None-Match") != "" {
+		h.hits = append(h.hits, name+"?")
+	} else {
+		h.hits = append(h.hits, name)
+	}
+	h.mu.Unlock()
+
+	if r.URL.Path != "/"+name+"/1001.json" {
+		http.NotFound(w, r)
+		return
+	}
+	profile := `{"userIdStr":"1001","username":"from ` + name + `"}`
+	w.Header().Set("Content-Type", "application/json")
+	switch name {
+	case "bad":
+		w.Write([]byte(`{}`))
+	case "envelope":
+		w.Write([]byte(`{"success":true,"error":"","data":` + profile + `}`))
+	case "good", "wayback":
+		w.Header().Set("ETag", `"`+name+`"`)
+		if r.Header.Get("If-None-Match") == `"`+name+`"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(profile))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// sourcesEnv serves h through refreshEnv and returns a parser for sources
+// written as name=[adapter+]<host>/<name>/{id}.json; "dump" is a local dump
+// holding profile 1001.
+func sourcesEnv(t *testing.T, h http.Handler) (profilesDir, postsRoot string, srcs func(names ...string) []source) {
+	t.Helper()
+	profilesDir, postsRoot = refreshEnv(t, h)
+	host := strings.TrimSuffix(profileSrcs[0].Template, "/profiles/{id}.json")
+	dump := t.TempDir()
+	os.WriteFile(filepath.Join(dump, "1001.json"), []byte(`{"userIdStr":"1001","username":"from dump"}`), 0644)
+	return profilesDir, postsRoot, func(names ...string) []source {
+		var spec []string
+		for _, n := range names {
+			switch n {
+			case "dump":
+				spec = append(spec, n+"="+filepath.Join(dump, "{id}.json"))
+			case "envelope", "wayback":
+				spec = append(spec, n+"="+n+"+"+host+"/"+n+"/{id}.json")
+			default:
+				spec = append(spec, n+"="+host+"/"+n+"/{id}.json")
+			}
+		}
+		out, err := parseSources(strings.Join(spec, ","), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+}
+
+func TestFetchEntityFallsBackInOrder(t *testing.T) {
+	cases := []struct {
+		name        string
+		sources     []string
+		prev        *validators
+		want        string // username, source and ETag, or the error
+		hits        string
+		quarantined int
+	}{
+		{"first good source wins", []string{"good", "bad"}, nil, `from good via good etag="good"`, "[good]", 0},
+		{"skips a missing source", []string{"missing", "good"}, nil, `from good via good etag="good"`, "[missing good]", 0},
+		{"quarantines a bad payload and moves on", []string{"bad", "missing", "good"}, nil, `from good via good etag="good"`, "[bad missing good]", 1},
+		{"unwraps an envelope", []string{"missing", "envelope"}, nil, "from envelope via envelope etag=", "[missing envelope]", 0},
+		{"keeps no validators from wayback", []string{"wayback"}, nil, "from wayback via wayback etag=", "[wayback]", 0},
+		{"reads a local dump", []string{"missing", "dump"}, nil, "from dump via dump etag=", "[missing]", 0},
+		{"reports the bad payload over a miss", []string{"missing", "bad", "missing"}, nil, "bad: invalid payload: empty object", "[missing bad missing]", 1},
+		{"reports the first miss", []string{"missing", "gone"}, nil, "missing: HTTP 404", "[missing gone]", 0},
+		{"revalidates only with the source that served it", []string{"missing", "good"}, &validators{ETag: `"good"`, Source: "good"},
+			"not modified", "[missing good?]", 0},
+		{"revalidates with the first source if none is recorded", []string{"good", "wayback"}, &validators{ETag: `"good"`},
+			"not modified", "[good?]", 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &sourceHosts{}
+			_, _, srcs := sourcesEnv(t, h)
+			validate := func(m map[string]interface{}) error { return validateProfile(m, "1001") }
+
+			m, val, err := fetchEntity(srcs(tc.sources...), "profile", "1001", "1001", tc.prev, validate)
+			got := fmt.Sprint(err)
+			if err == nil {
+				got = fmt.Sprintf("%s via %s etag=%s", m["username"], val.Source, val.ETag)
+			}
+			if got != tc.want && (err == nil || !strings.HasPrefix(got, tc.want)) {
+				t.Errorf("fetchEntity = %s, want %s", got, tc.want)
+			}
+			if got := fmt.Sprint(h.hits); got != tc.hits {
+				t.Errorf("sources asked %s, want %s", got, tc.hits)
+			}
+			records, _ := filepath.Glob(filepath.Join(stateRoot, "quarantine", "profile", "*.json"))
+			if len(records) != tc.quarantined {
+				t.Errorf("quarantined %d payloads, want %d", len(records), tc.quarantined)
+			}
+		})
+	}
+}
+
+func TestSourceIsRecordedWithTheValidators(t *testing.T) {
+	h := &sourceHosts{}
+	profilesDir, postsRoot, srcs := sourcesEnv(t, h)
+	profileSrcs = srcs("missing", "bad", "good")
+
+	if err := processUser("1001", nil, profilesDir, postsRoot, "", 0, nil); err != nil {
+		t.Fatalf("processUser: %v", err)
+	}
+	profile, err := readDoc(profileStore, "1001")
+	if err != nil || profile["username"] != "from good" {
+		t.Fatalf("saved profile = %v, %v", profile, err)
+	}
+	uv := loadUserValidators("1001")
+	if uv.Profile == nil || uv.Profile.Source != "good" || uv.Profile.ETag != `"good"` {
+		t.Fatalf("profile validators = %+v, want ETag \"good\" from source good", uv.Profile)
+	}
+
+	// A refresh goes back to that source with them.
+	h.hits = nil
+	*refresh = true
+	if _, err := loadProfile("1001", profilesDir); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if got := fmt.Sprint(h.hits); got != "[missing bad good?]" {
+		t.Errorf("sources asked on refresh %s, want [missing bad good?]", got)
+	}
+}
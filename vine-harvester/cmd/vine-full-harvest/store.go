@@ -0,0 +1,404 @@
+// store.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"vine-harvester/internal/archive"
+)
+
+// docStore holds saved profiles or posts by key: a user ID for profiles,
+// "<userId>/<postId>" for posts. read and write deal in plain JSON.
+type docStore interface {
+	exists(key string) bool
+	read(key string) ([]byte, error)
+	write(key string, data []byte) error
+}
+
+var (
+	profileStore docStore
+	postStore    postsStore
+)
+
+// looseStore keeps one <key>.json file per document under root, placed by
+// the archive layout.
+type looseStore struct {
+	root string
+}
+
+func (l looseStore) base(key string) string {
+	userID, rest, isPost := strings.Cut(key, "/")
+	if !isPost {
+		return layout.Path(l.root, userID, userID+".json")
+	}
+	return filepath.Join(layout.Path(l.root, userID, userID), filepath.FromSlash(rest)+".json")
+}
+
+func (l looseStore) exists(key string) bool              { return docs().Exists(l.base(key)) }
+func (l looseStore) read(key string) ([]byte, error)     { return docs().Read(l.base(key)) }
+func (l looseStore) write(key string, data []byte) error { return docs().Write(l.base(key), data) }
+
+// postsStore keeps posts either loose or in per-user segments (packed) and
+// reads both, so an outDir can be switched between layouts at any time; a
+// loose file wins over a segment entry.
+type postsStore struct {
+	loose  looseStore
+	packed bool
+}
+
+func splitPostKey(key string) (userID, postID string) {
+	i := strings.LastIndex(key, "/")
+	return key[:i], key[i+1:]
+}
+
+func (p postsStore) segPath(userID string) string {
+	return layout.Path(p.loose.root, userID, userID+".vseg")
+}
+
+// withSegment runs fn on userID's segment under its lock. A missing segment
+// (when not writing) is reported as os.ErrNotExist. An s3:// outDir only
+// holds loose posts, so it never has segments.
+func (p postsStore) withSegment(userID string, write bool, fn func(*segment) error) error {
+	if bucket != nil {
+		return os.ErrNotExist
+	}
+	mu := segLock(userID)
+	mu.Lock()
+	defer mu.Unlock()
+	s, err := openSegment(p.segPath(userID), write)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	return fn(s)
+}
+
+func (p postsStore) exists(key string) bool {
+	if p.loose.exists(key) {
+		return true
+	}
+	userID, postID := splitPostKey(key)
+	found := false
+	p.withSegment(userID, false, func(s *segment) error {
+		found = s.has(postID)
+		return nil
+	})
+	return found
+}
+
+func (p postsStore) read(key string) ([]byte, error) {
+	if p.loose.exists(key) {
+		return p.loose.read(key)
+	}
+	userID, postID := splitPostKey(key)
+	var data []byte
+	err := p.withSegment(userID, false, func(s *segment) error {
+		var err error
+		data, err = s.get(postID)
+		return err
+	})
+	return data, err
+}
+
+func (p postsStore) write(key string, data []byte) error {
+	if !p.packed {
+		return p.loose.write(key, data)
+	}
+	userID, postID := splitPostKey(key)
+	err := p.withSegment(userID, true, func(s *segment) error {
+		return s.append(map[string][]byte{postID: data})
+	})
+	if err != nil {
+		return err
+	}
+	return docs().Remove(p.loose.base(key))
+}
+
+// userPosts is the post store as processUser sees it: one user's posts, with
+// their segment opened once. In packed mode, writes are held back and added
+// to the segment in a single append by close, so a user's posts cost one
+// append instead of one each (a crash before close loses only posts that are
+// fetched again on the next run).
+type userPosts struct {
+	p       postsStore
+	userID  string
+	seg     *segment // nil if the user has no segment yet
+	pending map[string][]byte
+}
+
+func (p postsStore) forUser(userID string) *userPosts {
+	u := &userPosts{p: p, userID: userID}
+	if bucket == nil {
+		mu := segLock(userID)
+		mu.Lock()
+		if s, err := openSegment(p.segPath(userID), false); err == nil {
+			u.seg = s
+		}
+		mu.Unlock()
+	}
+	if p.packed {
+		u.pending = make(map[string][]byte)
+	}
+	return u
+}
+
+// postID checks that key is one of the user's posts.
+func (u *userPosts) postID(key string) (string, error) {
+	userID, postID := splitPostKey(key)
+	if userID != u.userID {
+		return "", fmt.Errorf("post %s does not belong to user %s", key, u.userID)
+	}
+	return postID, nil
+}
+
+func (u *userPosts) exists(key string) bool {
+	postID, err := u.postID(key)
+	if err != nil {
+		return false
+	}
+	if _, ok := u.pending[postID]; ok {
+		return true
+	}
+	return u.p.loose.exists(key) || u.seg != nil && u.seg.has(postID)
+}
+
+func (u *userPosts) read(key string) ([]byte, error) {
+	postID, err := u.postID(key)
+	if err != nil {
+		return nil, err
+	}
+	if data, ok := u.pending[postID]; ok {
+		return data, nil
+	}
+	if u.p.loose.exists(key) || u.seg == nil {
+		return u.p.loose.read(key)
+	}
+	return u.seg.get(postID)
+}
+
+func (u *userPosts) write(key string, data []byte) error {
+	postID, err := u.postID(key)
+	if err != nil {
+		return err
+	}
+	if !u.p.packed {
+		return u.p.loose.write(key, data)
+	}
+	u.pending[postID] = data
+	return nil
+}
+
+// close appends the held-back posts to the user's segment, which is reopened
+// under its lock in case the seeding stage wrote to it meanwhile.
+func (u *userPosts) close() error {
+	if u.seg != nil {
+		u.seg.close()
+		u.seg = nil
+	}
+	if len(u.pending) == 0 {
+		return nil
+	}
+	err := u.p.withSegment(u.userID, true, func(s *segment) error {
+		return s.append(u.pending)
+	})
+	if err != nil {
+		return err
+	}
+	for postID := range u.pending {
+		if err := docs().Remove(u.p.loose.base(u.userID + "/" + postID)); err != nil {
+			return err
+		}
+	}
+	u.pending = nil
+	return nil
+}
+
+// writeDoc saves v as document key of store, as indented JSON.
+func writeDoc(store docStore, key string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.write(key, append(data, '\n'))
+}
+
+// readDoc loads document key of store.
+func readDoc(store docStore, key string) (map[string]interface{}, error) {
+	raw, err := store.read(key)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", key, err)
+	}
+	return m, nil
+}
+
+// ------------------------ layout tools ------------------------
+
+type userEntry struct {
+	dir string
+	fs.DirEntry
+}
+
+// userEntries lists the per-user entries under root: what sits below the
+// layout's shard directories.
+func userEntries(root string, levels int) ([]userEntry, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	var out []userEntry
+	for _, e := range entries {
+		if levels == 0 {
+			out = append(out, userEntry{dir: root, DirEntry: e})
+			continue
+		}
+		if !e.IsDir() || !isShardName(e.Name()) {
+			continue
+		}
+		sub, err := userEntries(filepath.Join(root, e.Name()), levels-1)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sub...)
+	}
+	return out, nil
+}
+
+// eachUserEntry runs fn on every per-user entry under postsRoot whose name
+// passes match, using -workers goroutines.
+func eachUserEntry(postsRoot string, match func(fs.DirEntry) bool, fn func(userEntry) error) error {
+	entries, err := userEntries(postsRoot, layout.Levels)
+	if err != nil {
+		return err
+	}
+	jobs := make(chan userEntry, *workers*2)
+	var done, failed int64
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range jobs {
+				if err := fn(e); err != nil {
+					log.Printf("%s: %v\n", filepath.Join(e.dir, e.Name()), err)
+					atomic.AddInt64(&failed, 1)
+					continue
+				}
+				atomic.AddInt64(&done, 1)
+			}
+		}()
+	}
+	for _, e := range entries {
+		if match(e) {
+			jobs <- e
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	log.Printf("%d users done, %d failed\n", done, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d users failed", failed)
+	}
+	return nil
+}
+
+// packPosts moves every user's loose posts into their segment. The segment
+// is rewritten atomically before any loose file is removed, so the command
+// can be re-run after an interruption.
+func packPosts(postsRoot string) error {
+	store := postsStore{loose: looseStore{root: postsRoot}, packed: true}
+	return eachUserEntry(postsRoot, fs.DirEntry.IsDir, func(e userEntry) error {
+		userID := e.Name()
+		dir := filepath.Join(e.dir, userID)
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		posts := make(map[string][]byte)
+		var bases []string
+		for _, f := range files {
+			base := archive.StoredBase(filepath.Join(dir, f.Name()))
+			if base == "" || f.IsDir() {
+				continue
+			}
+			data, err := docs().Read(base)
+			if err != nil {
+				return err
+			}
+			posts[strings.TrimSuffix(filepath.Base(base), ".json")] = data
+			bases = append(bases, base)
+		}
+		if len(posts) == 0 {
+			os.Remove(dir)
+			return nil
+		}
+		err = store.withSegment(userID, true, func(s *segment) error {
+			if err := s.append(posts); err != nil {
+				return err
+			}
+			return s.compact(false)
+		})
+		if err != nil {
+			return err
+		}
+		for _, base := range bases {
+			if err := docs().Remove(base); err != nil {
+				return err
+			}
+		}
+		os.Remove(dir) // only succeeds once empty
+		return nil
+	})
+}
+
+// unpackPosts writes every segment's posts back out as loose files and then
+// removes the segment.
+func unpackPosts(postsRoot string) error {
+	store := postsStore{loose: looseStore{root: postsRoot}}
+	return eachUserEntry(postsRoot, isSegmentEntry, func(e userEntry) error {
+		userID := strings.TrimSuffix(e.Name(), ".vseg")
+		err := store.withSegment(userID, false, func(s *segment) error {
+			for _, id := range s.ids() {
+				data, err := s.get(id)
+				if err != nil {
+					return err
+				}
+				if err := store.loose.write(userID+"/"+id, data); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return os.Remove(store.segPath(userID))
+	})
+}
+
+// compactSegments compacts every segment; with recode the posts are also
+// re-encoded with the current storage codec (-convertStorage).
+func compactSegments(postsRoot string, recode bool) error {
+	store := postsStore{loose: looseStore{root: postsRoot}}
+	return eachUserEntry(postsRoot, isSegmentEntry, func(e userEntry) error {
+		userID := strings.TrimSuffix(e.Name(), ".vseg")
+		return store.withSegment(userID, true, func(s *segment) error {
+			return s.compact(recode)
+		})
+	})
+}
+
+func isSegmentEntry(e fs.DirEntry) bool {
+	return !e.IsDir() && strings.HasSuffix(e.Name(), ".vseg")
+}
@@ -0,0 +1,235 @@
+// validate.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"vine-harvester/internal/atomicfile"
+	"vine-harvester/internal/scan"
+)
+
+// A 200 that decodes as a JSON object is not necessarily a profile or post:
+// the archive (or something in front of it) also hands out empty objects,
+// error envelopes, truncated bodies and HTML pages. Anything that fails these
+// checks is written to outDir/quarantine/<kind>/ with the reason instead of
+// being saved, and its user is queued for another pass (-retryRounds).
+
+// maxPayloadBytes bounds a single profile/post body.
+const maxPayloadBytes = 16 << 20
+
+// payloadError is a response that arrived but isn't a usable entity.
+type payloadError struct {
+	Reason string
+	Body   []byte // raw body, when the payload didn't decode
+}
+
+func (e *payloadError) Error() string { return "invalid payload: " + e.Reason }
+
+func checkJSONContentType(ct string, body []byte) error {
+	mt := strings.ToLower(strings.TrimSpace(strings.SplitN(ct, ";", 2)[0]))
+	switch {
+	case strings.Contains(mt, "json"):
+		return nil
+	case mt == "" || mt == "application/octet-stream" || mt == "binary/octet-stream" || mt == "text/plain":
+		// S3-style hosts often don't label JSON; accept it if it looks like an object.
+		if t := bytes.TrimSpace(body); len(t) > 0 && t[0] == '{' {
+			return nil
+		}
+	}
+	return &payloadError{Reason: fmt.Sprintf("content-type %q is not JSON", ct), Body: body}
+}
+
+// checkEnvelope rejects empty objects and API error envelopes.
+func checkEnvelope(m map[string]interface{}) error {
+	if len(m) == 0 {
+		return &payloadError{Reason: "empty object"}
+	}
+	if ok, present := m["success"].(bool); present && !ok {
+		return &payloadError{Reason: fmt.Sprintf("error envelope: %v", m["error"])}
+	}
+	if e, ok := m["error"].(string); ok && e != "" {
+		return &payloadError{Reason: "error envelope: " + e}
+	}
+	return nil
+}
+
+// entityID reads an ID stored as either <key>Str or a JSON number.
+func entityID(m map[string]interface{}, key string) string {
+	if v, ok := m[key+"Str"].(string); ok && v != "" {
+		return v
+	}
+	if f, ok := m[key].(float64); ok {
+		return fmt.Sprintf("%.0f", f)
+	}
+	return ""
+}
+
+func validateProfile(m map[string]interface{}, userID string) error {
+	if err := checkEnvelope(m); err != nil {
+		return err
+	}
+	id := entityID(m, "userId")
+	if id == "" {
+		return &payloadError{Reason: "profile has no userId"}
+	}
+	if id != userID {
+		return &payloadError{Reason: fmt.Sprintf("profile userId %s does not match requested %s", id, userID)}
+	}
+	if s, _ := m["username"].(string); s == "" {
+		return &payloadError{Reason: "profile has no username"}
+	}
+	return checkURLFields(m, "avatarUrl", "profileBackground", "shareUrl")
+}
+
+// validatePost checks a post; userID and postID are what we expected (either
+// may be empty when we only know a slug).
+func validatePost(m map[string]interface{}, userID, postID string) error {
+	if err := checkEnvelope(m); err != nil {
+		return err
+	}
+	pid := entityID(m, "postId")
+	uid := entityID(m, "userId")
+	if pid == "" {
+		return &payloadError{Reason: "post has no postId"}
+	}
+	if uid == "" {
+		return &payloadError{Reason: "post has no userId"}
+	}
+	if userID != "" && uid != userID {
+		return &payloadError{Reason: fmt.Sprintf("post userId %s does not match user %s", uid, userID)}
+	}
+	if postID != "" && pid != postID {
+		return &payloadError{Reason: fmt.Sprintf("postId %s does not match requested %s", pid, postID)}
+	}
+	if s, _ := m["videoUrl"].(string); s == "" {
+		return &payloadError{Reason: "post has no videoUrl"}
+	}
+	return checkURLFields(m, "videoUrl", "videoLowURL", "thumbnailUrl", "avatarUrl", "permalinkUrl")
+}
+
+// checkURLFields requires the named fields, when present, to be absolute
+// http(s) URLs.
+func checkURLFields(m map[string]interface{}, keys ...string) error {
+	for _, k := range keys {
+		s, ok := m[k].(string)
+		if !ok || s == "" {
+			continue
+		}
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return &payloadError{Reason: fmt.Sprintf("%s is not an http(s) URL: %q", k, s)}
+		}
+	}
+	return nil
+}
+
+// quarantineRecord is the .json written next to a quarantined body.
+type quarantineRecord struct {
+	Kind   string `json:"kind"`
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Reason string `json:"reason"`
+	At     string `json:"at"`
+}
+
+// quarantine stores a bad payload and its reason. It returns false (and does
+// nothing) for errors that aren't payload problems, such as network errors.
+func quarantine(kind, id, u string, decoded map[string]interface{}, err error) bool {
+	var pe *payloadError
+	if !errors.As(err, &pe) {
+		return false
+	}
+	body := pe.Body
+	if body == nil && decoded != nil {
+		body, _ = json.MarshalIndent(decoded, "", "  ")
+	}
+
+	now := time.Now().UTC()
+	base := filepath.Join(stateRoot, "quarantine", kind,
+		strings.ReplaceAll(id, "/", "_")+"."+now.Format("20060102T150405.000Z"))
+	if err := os.MkdirAll(filepath.Dir(base), 0755); err != nil {
+		log.Printf("Warning: quarantine %s %s: %v\n", kind, id, err)
+		return true
+	}
+	if err := atomicfile.WriteBytes(base+".body", body); err != nil {
+		log.Printf("Warning: quarantine %s %s: %v\n", kind, id, err)
+	}
+	rec := quarantineRecord{Kind: kind, ID: id, URL: u, Reason: pe.Reason, At: now.Format(time.RFC3339)}
+	if err := writeJSONFile(base+".json", rec); err != nil {
+		log.Printf("Warning: quarantine %s %s: %v\n", kind, id, err)
+	}
+	log.Printf("Quarantined %s %s: %s\n", kind, id, pe.Reason)
+	return true
+}
+
+// retryUsers collects users with quarantined profiles or posts.
+var retryUsers = struct {
+	mu sync.Mutex
+	m  map[string]struct{}
+}{m: make(map[string]struct{})}
+
+func markRetry(userID string) {
+	retryUsers.mu.Lock()
+	retryUsers.m[userID] = struct{}{}
+	retryUsers.mu.Unlock()
+}
+
+func takeRetryUsers() []string {
+	retryUsers.mu.Lock()
+	defer retryUsers.mu.Unlock()
+	ids := make([]string, 0, len(retryUsers.m))
+	for id := range retryUsers.m {
+		ids = append(ids, id)
+	}
+	retryUsers.m = make(map[string]struct{})
+	sort.Slice(ids, func(i, j int) bool { return idLess(ids[i], ids[j]) })
+	return ids
+}
+
+// retryBackoff is how much longer each retry round waits before it starts.
+var retryBackoff = 5 * time.Second
+
+// retryQuarantined gives users with quarantined payloads up to -retryRounds
+// more passes. Whoever is still incomplete is listed in
+// outDir/quarantine/retry_users.json, which can be fed back in with
+// fast_harvest_vine.go -profiles.
+func retryQuarantined(sched *userScheduler, filter *harvestFilter, profilesDir, postsRoot, mediaRoot string) error {
+	retryPath := filepath.Join(stateRoot, "quarantine", "retry_users.json")
+	for round := 1; ; round++ {
+		ids := takeRetryUsers()
+		if len(ids) == 0 {
+			os.Remove(retryPath)
+			return nil
+		}
+		if round > *retryRounds {
+			log.Printf("%d users still have quarantined payloads; see %s\n", len(ids), retryPath)
+			return writeJSONFile(retryPath, ids)
+		}
+
+		log.Printf("=== Retry round %d: %d users with quarantined payloads ===\n", round, len(ids))
+		time.Sleep(time.Duration(round) * retryBackoff)
+		users := scan.NewSet(*tmpDir, int64(*dedupMemMB)<<20)
+		for _, id := range ids {
+			if err := users.Add(id); err != nil {
+				users.Close()
+				return err
+			}
+		}
+		err := harvestLevel(users, sched, filter, profilesDir, postsRoot, mediaRoot, nil)
+		users.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
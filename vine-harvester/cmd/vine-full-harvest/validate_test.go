@@ -0,0 +1,147 @@
+// validate_test.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestValidatePayloads(t *testing.T) {
+	cases := []struct {
+		name, kind, doc string
+		want            string // part of the reason; "" = valid
+	}{
+		{"empty profile", "profile", `{}`, "empty object"},
+		{"profile error envelope", "profile", `{"success":false,"error":"Record not found.","code":900}`, "error envelope: Record not found."},
+		{"profile error string", "profile", `{"error":"rate limited"}`, "error envelope: rate limited"},
+		{"profile of another user", "profile", `{"userIdStr":"1002","username":"u"}`, "profile userId 1002 does not match requested 1001"},
+		{"profile with a numeric userId", "profile", `{"userId":1001,"username":"u"}`, ""},
+		{"profile without userId", "profile", `{"username":"u"}`, "profile has no userId"},
+		{"profile without username", "profile", `{"userIdStr":"1001"}`, "profile has no username"},
+		{"profile with a relative avatar", "profile", `{"userIdStr":"1001","username":"u","avatarUrl":"/a.jpg"}`, "avatarUrl is not an http(s) URL"},
+		{"profile", "profile", `{"userIdStr":"1001","username":"u","avatarUrl":"https://v.cdn.vine.co/a.jpg"}`, ""},
+
+		{"empty post", "post", `{}`, "empty object"},
+		{"post error envelope", "post", `{"success":false,"error":"Post not found."}`, "error envelope: Post not found."},
+		{"post of another user", "post", `{"postIdStr":"11","userIdStr":"1002","videoUrl":"https://v.cdn.vine.co/11.mp4"}`, "post userId 1002 does not match user 1001"},
+		{"another post", "post", `{"postIdStr":"12","userIdStr":"1001","videoUrl":"https://v.cdn.vine.co/12.mp4"}`, "postId 12 does not match requested 11"},
+		{"post without videoUrl", "post", `{"postIdStr":"11","userIdStr":"1001"}`, "post has no videoUrl"},
+		{"post with a javascript: thumbnail", "post", `{"postIdStr":"11","userIdStr":"1001","videoUrl":"https://v.cdn.vine.co/11.mp4","thumbnailUrl":"javascript:x"}`, "thumbnailUrl is not an http(s) URL"},
+		{"post", "post", `{"postId":11,"userIdStr":"1001","videoUrl":"https://v.cdn.vine.co/11.mp4"}`, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var m map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.doc), &m); err != nil {
+				t.Fatal(err)
+			}
+			var err error
+			if tc.kind == "profile" {
+				err = validateProfile(m, "1001")
+			} else {
+				err = validatePost(m, "1001", "11")
+			}
+			switch {
+			case tc.want == "" && err != nil:
+				t.Fatalf("rejected: %v", err)
+			case tc.want != "" && (err == nil || !isPayloadError(err) || !strings.Contains(err.Error(), tc.want)):
+				t.Fatalf("err = %v, want a payload error with %q", err, tc.want)
+			}
+		})
+	}
+}
+
+// flakyProfiles serves profile 2002 as {} for the first bad requests, then
+// properly, without any posts.
+type flakyProfiles struct {
+	bad      int32
+	requests int32
+}
+
+func (h *flakyProfiles) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/profiles/2002.json" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if atomic.AddInt32(&h.requests, 1) <= h.bad {
+		w.Write([]byte(`{}`))
+		return
+	}
+	w.Write([]byte(`{"userIdStr":"2002","username":"u","posts":[]}`))
+}
+
+func TestQuarantineAndRetry(t *testing.T) {
+	cases := []struct {
+		name      string
+		bad       int32 // bad answers before good ones
+		rounds    int
+		saved     bool
+		requests  int32
+		retryList bool
+	}{
+		{"recovers in a retry round", 1, 1, true, 2, false},
+		{"still bad after the retries", 3, 2, false, 3, true},
+		{"no retries", 1, 0, false, 1, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &flakyProfiles{bad: tc.bad}
+			profilesDir, postsRoot := refreshEnv(t, h)
+			rounds, backoff := *retryRounds, retryBackoff
+			*retryRounds, retryBackoff = tc.rounds, time.Millisecond
+			t.Cleanup(func() {
+				*retryRounds, retryBackoff = rounds, backoff
+				takeRetryUsers()
+			})
+
+			if err := processUser("2002", nil, profilesDir, postsRoot, "", 0, nil); err == nil || !isPayloadError(err) {
+				t.Fatalf("processUser = %v, want a payload error", err)
+			}
+			records, _ := filepath.Glob(filepath.Join(stateRoot, "quarantine", "profile", "2002.*.json"))
+			if len(records) != 1 {
+				t.Fatalf("quarantine records = %v, want one", records)
+			}
+			var rec quarantineRecord
+			data, _ := os.ReadFile(records[0])
+			if err := json.Unmarshal(data, &rec); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Kind != "profile" || rec.ID != "2002" || rec.Reason != "empty object" || !strings.HasSuffix(rec.URL, "/profiles/2002.json") {
+				t.Errorf("quarantine record = %+v", rec)
+			}
+			if body, err := os.ReadFile(strings.TrimSuffix(records[0], ".json") + ".body"); err != nil || strings.TrimSpace(string(body)) != "{}" {
+				t.Errorf("quarantined body = %q, %v", body, err)
+			}
+
+			sched, err := newUserScheduler("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := retryQuarantined(sched, nil, profilesDir, postsRoot, ""); err != nil {
+				t.Fatalf("retryQuarantined: %v", err)
+			}
+			if got := profileStore.exists("2002"); got != tc.saved {
+				t.Errorf("profile saved = %v, want %v", got, tc.saved)
+			}
+			if got := atomic.LoadInt32(&h.requests); got != tc.requests {
+				t.Errorf("profile requests = %d, want %d", got, tc.requests)
+			}
+			var retry []string
+			data, err = os.ReadFile(filepath.Join(stateRoot, "quarantine", "retry_users.json"))
+			if tc.retryList {
+				if err := json.Unmarshal(data, &retry); err != nil || len(retry) != 1 || retry[0] != "2002" {
+					t.Errorf("retry_users.json = %q, %v; want [2002]", data, err)
+				}
+			} else if !os.IsNotExist(err) {
+				t.Errorf("retry_users.json left behind: %q, %v", data, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,1228 @@
+// vine_full_harvest.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"vine-harvester/internal/archive"
+	"vine-harvester/internal/atomicfile"
+	"vine-harvester/internal/httpclient"
+	"vine-harvester/internal/medialedger"
+	"vine-harvester/internal/s3store"
+	"vine-harvester/internal/scan"
+)
+
+// Flags
+var (
+	inputDir    = flag.String("inputDir", "vine_tweets", "Directory containing Vine-Tweets text files")
+	outDir      = flag.String("outDir", "vine_archive_harvest", "Output root directory, or s3://bucket/prefix to write profiles, posts and media straight to S3/R2 (see S3_ENDPOINT)")
+	stateDir    = flag.String("stateDir", "vine_harvest_state", "With an s3:// outDir: local directory for the run's state (media ledger, slug sources, history, quarantine)")
+	s3PartSize  = flag.Int("s3PartSizeMB", 16, "With an s3:// outDir: objects larger than this many MiB are sent as multipart uploads (min 5)")
+	baseProfile = flag.String("baseProfile", "https://archive.vine.co/profiles", "Base URL for profile JSON (no trailing slash)")
+	basePost    = flag.String("basePost", "https://archive.vine.co/posts", "Base URL for post JSON (no trailing slash)")
+	workers     = flag.Int("workers", 128, "Number of concurrent workers")
+	scanWorkers = flag.Int("scanWorkers", runtime.NumCPU(), "Number of concurrent workers scanning inputDir files")
+	dedupMemMB  = flag.Int("dedupMemMB", 512, "Memory budget (MiB) per slug/user set before spilling sorted runs to disk (0 = never spill)")
+	tmpDir      = flag.String("tmpDir", "", "Directory for dedup spill files and nested zips (default: system temp dir)")
+
+	profileSources = flag.String("profileSources", "", "Ordered profile sources, comma-separated name=[envelope+|wayback+]template with {id}; a template that is a path reads a local dump (default: archive=<baseProfile>/{id}.json)")
+	postSources    = flag.String("postSources", "", "Ordered post sources, same syntax as -profileSources (default: archive=<basePost>/{id}.json)")
+
+	snowballDepth    = flag.Int("snowballDepth", 0, "Follow users referenced by harvested posts (revines, mentions, comments, likes) this many levels deep (0 = off)")
+	snowballLimit    = flag.Int("snowballLimit", 0, "Stop snowballing after this many newly discovered users (0 = no limit)")
+	priority         = flag.String("priority", "", "Comma-separated user ordering keys, most significant first: allowlist, followers, loops, shares, oldest (empty = user ID order)")
+	priorityUsers    = flag.String("priorityUsers", "", "File of user IDs (JSON array or one per line) harvested before everyone else")
+	postOrder        = flag.String("postOrder", "profile", "Order of a user's posts: profile, oldest, newest")
+	download         = flag.Bool("download", false, "Download media files from vines.s3.amazonaws.com")
+	mediaRetries     = flag.Int("mediaRetries", 2, "Passes over failed media downloads at the end of the run")
+	mediaMaxAttempts = flag.Int("mediaMaxAttempts", 5, "Attempts per media file, across runs, before it counts as permanently missing")
+	httpCache        = flag.String("httpCache", "", "Directory for recorded HTTP responses (empty = no cache)")
+	httpCacheMode    = flag.String("httpCacheMode", "replay", "With -httpCache: record (always fetch, save), replay (serve cached, fetch + save misses), offline (cached only, misses fail)")
+	httpCacheMedia   = flag.Bool("httpCacheMedia", false, "With -httpCache: also cache media downloads (default: JSON requests only)")
+	retryRounds      = flag.Int("retryRounds", 1, "Extra passes over users whose profile or posts were quarantined as malformed")
+	refresh          = flag.Bool("refresh", false, "Re-validate saved profiles and posts (ETag/If-Modified-Since); changed ones keep their previous version under outDir/history (stateDir/history with an s3:// outDir)")
+
+	breakerErrorRate   = flag.Float64("breakerErrorRate", 0.5, "Open a host's circuit breaker when this fraction of its recent requests fail (0 = no breaker)")
+	breakerMinRequests = flag.Int("breakerMinRequests", 20, "Requests a host needs in its recent window before the breaker can open")
+	breakerCooldown    = flag.Duration("breakerCooldown", 30*time.Second, "How long an open breaker waits before letting a probe request through (doubles on failed probes, up to 10m)")
+	breakerMaxWait     = flag.Duration("breakerMaxWait", 30*time.Minute, "Give up on a request parked behind an open breaker after this long")
+
+	storageCodecName = flag.String("storageCodec", "none", "Codec for newly written profile/post JSON: none, gzip (.json.gz) or zstd (.json.zst); readers accept any of them (an s3:// outDir only the current one)")
+	convertExisting  = flag.Bool("convertStorage", false, "Rewrite every profile and post under outDir with -storageCodec in place, removing copies in other codecs, then exit")
+	layoutName       = flag.String("layout", "", "Directory layout of profiles and posts: flat, hash1 or hash2 (profiles/ab/cd/<userId>.json); only for a new outDir, otherwise the recorded one is used")
+	migrateTo        = flag.String("migrateLayout", "", "Move outDir's profiles and posts to this layout (flat, hash1, hash2), then exit; re-run to finish an interrupted move")
+	postLayout       = flag.String("postLayout", "loose", "Where new posts are written: loose (posts/<userId>/<postId>.json) or packed (one append-only posts/<userId>.vseg segment per user); reads check both")
+	packExisting     = flag.Bool("packPosts", false, "Move every loose post under outDir into per-user segments, then exit")
+	unpackExisting   = flag.Bool("unpackPosts", false, "Write every segment's posts back out as loose files and remove the segments, then exit")
+	compactExisting  = flag.Bool("compactSegments", false, "Rewrite every post segment without superseded records, then exit")
+
+	httpConfigPath = flag.String("httpConfig", "", "JSON file with HTTP client settings: json/media timeouts, idle connection limits, proxy, caBundle, userAgent, contact")
+	userAgent      = flag.String("userAgent", "", "User-Agent for every request (default: VineFullHarvester/1.0, VineFullHarvesterMedia/1.0 for media)")
+	contact        = flag.String("contact", "", "Contact URL or email appended to the User-Agent (an email is also sent as From)")
+	proxyURL       = flag.String("proxy", "", "HTTP(S) proxy URL (default: HTTP_PROXY/HTTPS_PROXY from the environment)")
+	caBundle       = flag.String("caBundle", "", "PEM file with extra CA certificates to trust")
+	jsonTimeout    = flag.Duration("jsonTimeout", 30*time.Second, "Overall timeout for one profile/post JSON request")
+	mediaTimeout   = flag.Duration("mediaTimeout", 30*time.Minute, "Overall timeout for one media download")
+
+	filterConfig    = flag.String("filterConfig", "", "JSON file with harvest filters (same names as the filter flags; flags given on the command line win)")
+	allowUsers      = flag.String("allowUsers", "", "Only harvest user IDs listed in this file (JSON array or one per line)")
+	denyUsers       = flag.String("denyUsers", "", "Never harvest user IDs listed in this file (JSON array or one per line)")
+	createdAfter    = flag.String("createdAfter", "", "Only keep posts created on or after this date (YYYY-MM-DD or RFC 3339)")
+	createdBefore   = flag.String("createdBefore", "", "Only keep posts created before this date (YYYY-MM-DD or RFC 3339)")
+	minLoops        = flag.Int64("minLoops", 0, "Only keep posts with at least this many loops")
+	minLikes        = flag.Int64("minLikes", 0, "Only keep posts with at least this many likes")
+	verifiedOnly    = flag.Bool("verifiedOnly", false, "Only harvest verified users")
+	excludeExplicit = flag.Bool("excludeExplicit", false, "Skip users and posts flagged as explicit content")
+)
+
+// HTTP clients (shared), built in main from the HTTP client flags
+var jsonClient, mediaClient *http.Client
+
+// media is the download ledger (media_state.jsonl), opened in main with -download
+var media *medialedger.Ledger
+
+// archiveRoot is where profiles, posts and media go: outDir, or "" (the
+// bucket prefix) with an s3:// outDir. stateRoot holds the run's own files
+// and is outDir unless that is a bucket.
+var archiveRoot, stateRoot string
+
+func main() {
+	flag.Parse()
+	scan.TempDir = *tmpDir
+
+	httpCfg, err := httpclient.Load(*httpConfigPath, flag.CommandLine)
+	if err != nil {
+		log.Fatalf("httpConfig: %v", err)
+	}
+
+	archiveRoot, stateRoot = *outDir, *outDir
+	if out := s3store.ParsePath(*outDir); out.S3 {
+		if *postLayout != "loose" || *convertExisting || *packExisting || *unpackExisting || *compactExisting || *migrateTo != "" {
+			log.Fatalf("outDir: -postLayout packed and the -convertStorage, -packPosts, -unpackPosts, -compactSegments and -migrateLayout tools need a local outDir")
+		}
+		if *s3PartSize < 5 {
+			log.Fatalf("s3PartSizeMB: S3 parts must be at least 5 MiB, got %d", *s3PartSize)
+		}
+		s3Cfg := httpCfg
+		if s3Cfg.CABundle == "" {
+			s3Cfg.CABundle = s3store.FirstEnv("AWS_CA_BUNDLE", "R2_CA_BUNDLE")
+		}
+		s3HTTP, err := httpclient.New(s3Cfg, httpCfg.Media, "VineFullHarvester/1.0")
+		if err != nil {
+			log.Fatalf("HTTP client: %v", err)
+		}
+		c, err := s3store.NewClient(context.Background(), s3HTTP)
+		if err != nil {
+			log.Fatalf("outDir: %v", err)
+		}
+		bucket = &bucketArchive{c: c, bucket: out.Bucket, prefix: out.Prefix, partSize: *s3PartSize << 20}
+		archiveRoot, stateRoot = "", *stateDir
+		log.Printf("Writing the archive to %s (run state in %s)\n", *outDir, stateRoot)
+	}
+
+	profilesDir := filepath.Join(archiveRoot, "profiles")
+	postsRoot := filepath.Join(archiveRoot, "posts")
+	mediaRoot := filepath.Join(archiveRoot, "media")
+
+	if err := os.MkdirAll(stateRoot, 0755); err != nil {
+		log.Fatalf("MkdirAll stateRoot: %v", err)
+	}
+	if bucket == nil {
+		if err := os.MkdirAll(profilesDir, 0755); err != nil {
+			log.Fatalf("MkdirAll profilesDir: %v", err)
+		}
+		if err := os.MkdirAll(postsRoot, 0755); err != nil {
+			log.Fatalf("MkdirAll postsRoot: %v", err)
+		}
+		if *download {
+			if err := os.MkdirAll(mediaRoot, 0755); err != nil {
+				log.Fatalf("MkdirAll mediaRoot: %v", err)
+			}
+		}
+	}
+	atomicfile.Sweep(stateRoot)
+
+	codec, err := archive.ParseCodec(*storageCodecName)
+	if err != nil {
+		log.Fatalf("storageCodec: %v", err)
+	}
+	storage = codec
+	if *postLayout != "loose" && *postLayout != "packed" {
+		log.Fatalf("postLayout: unknown layout %q (want loose or packed)", *postLayout)
+	}
+	if *migrateTo != "" {
+		to, err := archive.ParseLayout(*migrateTo)
+		if err != nil {
+			log.Fatalf("migrateLayout: %v", err)
+		}
+		if err := migrateLayout(to, profilesDir, postsRoot); err != nil {
+			log.Fatalf("migrateLayout: %v", err)
+		}
+		return
+	}
+	if layout, err = archive.ResolveLayout(archiveFS(), archiveRoot, *layoutName); err != nil {
+		log.Fatalf("layout: %v", err)
+	}
+	profileStore = looseStore{root: profilesDir}
+	postStore = postsStore{loose: looseStore{root: postsRoot}, packed: *postLayout == "packed"}
+
+	switch {
+	case *convertExisting:
+		if err := convertStorage(profilesDir, postsRoot); err != nil {
+			log.Fatalf("convertStorage: %v", err)
+		}
+		if err := compactSegments(postsRoot, true); err != nil {
+			log.Fatalf("convertStorage: %v", err)
+		}
+		return
+	case *packExisting:
+		if err := packPosts(postsRoot); err != nil {
+			log.Fatalf("packPosts: %v", err)
+		}
+		return
+	case *unpackExisting:
+		if err := unpackPosts(postsRoot); err != nil {
+			log.Fatalf("unpackPosts: %v", err)
+		}
+		return
+	case *compactExisting:
+		if err := compactSegments(postsRoot, false); err != nil {
+			log.Fatalf("compactSegments: %v", err)
+		}
+		return
+	}
+
+	if jsonClient, err = httpclient.New(httpCfg, httpCfg.JSON, "VineFullHarvester/1.0"); err != nil {
+		log.Fatalf("HTTP client: %v", err)
+	}
+	if mediaClient, err = httpclient.New(httpCfg, httpCfg.Media, "VineFullHarvesterMedia/1.0"); err != nil {
+		log.Fatalf("HTTP client: %v", err)
+	}
+
+	if *httpCache != "" {
+		cached := []*http.Client{jsonClient}
+		if *httpCacheMedia {
+			cached = append(cached, mediaClient)
+		}
+		for _, c := range cached {
+			ct, err := newCacheTransport(c.Transport, *httpCache, *httpCacheMode)
+			if err != nil {
+				log.Fatalf("httpCache: %v", err)
+			}
+			c.Transport = ct
+		}
+		atomicfile.Sweep(*httpCache)
+		log.Printf("HTTP cache: %s (%s)\n", *httpCache, *httpCacheMode)
+	}
+
+	filter, err := loadHarvestFilter()
+	if err != nil {
+		log.Fatalf("filters: %v", err)
+	}
+
+	if profileSrcs, err = parseSources(*profileSources, *baseProfile); err != nil {
+		log.Fatalf("profileSources: %v", err)
+	}
+	if postSrcs, err = parseSources(*postSources, *basePost); err != nil {
+		log.Fatalf("postSources: %v", err)
+	}
+
+	sched, err := newUserScheduler(*priority, *priorityUsers)
+	if err != nil {
+		log.Fatalf("priority: %v", err)
+	}
+	defer sched.close()
+	switch *postOrder {
+	case "profile", "oldest", "newest":
+	default:
+		log.Fatalf("-postOrder must be profile, oldest or newest, got %q", *postOrder)
+	}
+
+	if *download {
+		media = medialedger.New(*mediaMaxAttempts)
+		if err := media.Open(filepath.Join(stateRoot, "media_state.jsonl")); err != nil {
+			log.Fatalf("media state: %v", err)
+		}
+		defer media.Close()
+	}
+
+	// Step 1: scan vine_tweets for vine.co/v/... slugs
+	log.Printf("=== Scanning %s for Vine video URLs ===\n", *inputDir)
+	sourcesPath := filepath.Join(stateRoot, "slug_sources.jsonl")
+	sources, err := scan.OpenSourceLog(sourcesPath)
+	if err != nil {
+		log.Fatalf("openSourceLog: %v", err)
+	}
+	slugs, err := collectVineSlugs(*inputDir, sources)
+	if err != nil {
+		log.Fatalf("collectVineSlugs: %v", err)
+	}
+	defer slugs.Close()
+	if err := sources.Close(); err != nil {
+		log.Printf("Warning: failed to write %s: %v\n", sourcesPath, err)
+	} else {
+		log.Printf("Wrote %d slug provenance records to %s\n", sources.Count(), sourcesPath)
+	}
+	slugCount, err := slugs.Count()
+	if err != nil {
+		log.Fatalf("collectVineSlugs: %v", err)
+	}
+	if slugCount == 0 {
+		log.Fatalf("No Vine video URLs found in %s", *inputDir)
+	}
+	log.Printf("Collected %d unique Vine video IDs from %s\n", slugCount, *inputDir)
+
+	// Step 2: from those slugs, fetch posts + discover user IDs
+	log.Println("=== Seeding posts and discovering users from slugs ===")
+	userIDs, err := fetchUsersFromSlugs(slugs, profilesDir, postsRoot, sched, filter)
+	if err != nil {
+		log.Fatalf("fetchUsersFromSlugs: %v", err)
+	}
+	defer userIDs.Close()
+	userCount, err := userIDs.Count()
+	if err != nil {
+		log.Fatalf("fetchUsersFromSlugs: %v", err)
+	}
+	if userCount == 0 {
+		log.Fatalf("No user IDs discovered from Vine tweets")
+	}
+	log.Printf("Discovered %d unique user IDs from vine_tweets\n", userCount)
+
+	// Save discovered user IDs
+	profilesJSONPath := filepath.Join(stateRoot, "profiles.json")
+	if err := writeJSONStringArray(profilesJSONPath, userIDs); err != nil {
+		log.Printf("Warning: failed to write %s: %v\n", profilesJSONPath, err)
+	} else {
+		log.Printf("Wrote discovered user IDs to %s\n", profilesJSONPath)
+	}
+
+	// Step 3: harvest profiles + posts for each user, then (optionally) snowball
+	// out to users the harvested posts reference.
+	if err := harvestUsers(userIDs, sched, filter, profilesDir, postsRoot, mediaRoot); err != nil {
+		log.Fatalf("harvestUsers: %v", err)
+	}
+	if err := retryQuarantined(sched, filter, profilesDir, postsRoot, mediaRoot); err != nil {
+		log.Fatalf("retryQuarantined: %v", err)
+	}
+	if *download {
+		media.Retry(*mediaRetries, *workers, func(u string) error { return downloadMedia(u, mediaRoot) })
+	}
+	breakers.flush()
+	if n := jsonFlights.shared() + mediaFlights.shared(); n > 0 {
+		log.Printf("Coalesced %d duplicate in-flight fetches\n", n)
+	}
+
+	if *refresh {
+		changeLog.mu.Lock()
+		if changeLog.f != nil {
+			changeLog.f.Close()
+		}
+		log.Printf("Refresh: %d profiles/posts changed\n", changeLog.n)
+		changeLog.mu.Unlock()
+	}
+	if filter.active() {
+		log.Printf("Filters skipped %d users and %d posts\n",
+			atomic.LoadInt64(&filter.skippedUsers), atomic.LoadInt64(&filter.skippedPosts))
+	}
+
+	log.Println("All done.")
+}
+
+// ------------------------ Step 1: scan vine_tweets for slugs ------------------------
+
+func collectVineSlugs(root string, sources *scan.SourceLog) (*scan.Set, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	var paths []string
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// skip this entry
+			return nil
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slugSet := scan.NewSet(*tmpDir, int64(*dedupMemMB)<<20)
+
+	workerCount := *scanWorkers
+	if workerCount < 1 {
+		workerCount = 1
+	}
+	jobs := make(chan string, workerCount*2)
+	var wg sync.WaitGroup
+
+	for i := 0; i < workerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				var stats scanStats
+				err := scan.WalkFile(path, func(member string, r io.Reader) error {
+					return scanSlugsFromReader(member, r, slugSet, sources, &stats)
+				})
+				if err != nil {
+					log.Printf("scanSlugsFromReader(%s): %v\n", path, err)
+				}
+				log.Printf("%s: %d bytes, %d Vine URLs\n", path, stats.Bytes, stats.Matches)
+			}
+		}()
+	}
+
+	for _, path := range paths {
+		if slugSet.Err() != nil {
+			break
+		}
+		jobs <- path
+	}
+	close(jobs)
+	wg.Wait()
+	if err := slugSet.Err(); err != nil {
+		slugSet.Close()
+		return nil, err
+	}
+
+	return slugSet, nil
+}
+
+// scanStats counts what one input file contributed.
+type scanStats struct {
+	Bytes   int64
+	Matches int64
+}
+
+// scanSlugsFromReader pulls vine.co/v/... slugs out of one member of the tweet
+// corpus (JSON, JSONL, tweets.js, CSV or plain text) and records where each one
+// came from.
+func scanSlugsFromReader(member string, r io.Reader, slugSet *scan.Set, sources *scan.SourceLog, stats *scanStats) error {
+	cr := &scan.CountingReader{R: r}
+	var addErr error
+	err := scan.ParseDump(member, cr, func(src scan.Source) {
+		if addErr == nil {
+			addErr = slugSet.Add(src.Slug)
+		}
+		sources.Record(src)
+		stats.Matches++
+	})
+	stats.Bytes += cr.N
+	if addErr != nil {
+		return addErr
+	}
+	return err
+}
+
+// ------------------------ Step 2: from slugs → posts + user IDs ------------------------
+
+func fetchUsersFromSlugs(slugs *scan.Set, profilesDir, postsRoot string, sched *userScheduler, filter *harvestFilter) (*scan.Set, error) {
+	userSet := scan.NewSet(*tmpDir, int64(*dedupMemMB)<<20)
+
+	jobs := make(chan string, *workers*2)
+	var wg sync.WaitGroup
+
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			for slug := range jobs {
+				postData, val, err := fetchEntity(postSrcs, "post", slug, slug, nil, func(m map[string]interface{}) error {
+					return validatePost(m, "", "")
+				})
+				if err != nil {
+					log.Printf("[seed worker %d] post slug %s: %v\n", workerID, slug, err)
+					continue
+				}
+
+				// Rewrite URLs
+				postData = rewriteURLs(postData).(map[string]interface{})
+
+				// Extract userId
+				userID := ""
+				if v, ok := postData["userIdStr"].(string); ok && v != "" {
+					userID = v
+				} else if f, ok := postData["userId"].(float64); ok {
+					userID = fmt.Sprintf("%.0f", f)
+				}
+
+				// Extract real post ID
+				realID := ""
+				if v, ok := postData["postIdStr"].(string); ok && v != "" {
+					realID = v
+				} else if f, ok := postData["postId"].(float64); ok {
+					realID = fmt.Sprintf("%.0f", f)
+				} else {
+					realID = slug
+				}
+
+				if userID == "" {
+					continue
+				}
+				// Record userID; a failed spill stops the feed below.
+				userSet.Add(userID)
+				sched.countShare(userID, slug)
+
+				// Filtered users stay in userSet so processUser reports them,
+				// but none of their posts are saved.
+				if !filter.allowsUserID(userID) || !filter.allowsPostFields(postData) {
+					continue
+				}
+				if filter.needsProfile() {
+					profile, err := loadProfile(userID, profilesDir)
+					if err != nil {
+						log.Printf("[seed worker %d] profile for %s: %v\n", workerID, userID, err)
+						continue
+					}
+					if !filter.allowsProfile(profile) {
+						continue
+					}
+				}
+
+				// Save this post immediately under user
+				if key := userID + "/" + realID; !postStore.exists(key) {
+					if err := writeDoc(postStore, key, postData); err != nil {
+						log.Printf("[seed worker %d] write seed post %s for user %s: %v\n",
+							workerID, realID, userID, err)
+					} else {
+						saveValidators(userID, nil, map[string]validators{realID: val})
+					}
+				}
+			}
+		}(i)
+	}
+
+	err := slugs.Each(func(slug string) error {
+		if err := userSet.Err(); err != nil {
+			return err
+		}
+		jobs <- slug
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+	if err == nil {
+		err = userSet.Err()
+	}
+	if err != nil {
+		userSet.Close()
+		return nil, err
+	}
+	return userSet, nil
+}
+
+// ------------------------ Step 3: per-user profile + posts ------------------------
+
+// harvestUsers runs processUser over the seed users. With -snowballDepth > 0 it
+// then expands breadth-first: every user referenced by a harvested post
+// (revines, mentions, comment/like authors) that hasn't been queued yet becomes
+// part of the next level, until the depth or -snowballLimit is reached. How
+// each user was reached is appended to user_discovery.jsonl.
+func harvestUsers(seeds *scan.Set, sched *userScheduler, filter *harvestFilter, profilesDir, postsRoot, mediaRoot string) error {
+	discoveryPath := filepath.Join(stateRoot, "user_discovery.jsonl")
+	discovery, err := os.Create(discoveryPath)
+	if err != nil {
+		return err
+	}
+	defer discovery.Close()
+	dw := bufio.NewWriter(discovery)
+	defer dw.Flush()
+	denc := json.NewEncoder(dw)
+
+	memLimit := int64(*dedupMemMB) << 20
+	visited := scan.NewSet(*tmpDir, memLimit)
+	defer visited.Close()
+
+	level := seeds
+	err = seeds.Each(func(uid string) error {
+		if err := visited.Add(uid); err != nil {
+			return err
+		}
+		return denc.Encode(userDiscovery{UserID: uid, Depth: 0, Via: "tweet"})
+	})
+	if err != nil {
+		return err
+	}
+
+	discovered := 0
+	maxDepth := *snowballDepth
+	for depth := 0; ; depth++ {
+		expand := depth < maxDepth
+		log.Printf("=== Harvesting profiles + posts per user (depth %d) ===\n", depth)
+
+		var refs *scan.Set
+		var onRef func(userRef)
+		if expand {
+			refs = scan.NewSet(*tmpDir, memLimit)
+			onRef = func(r userRef) { refs.Add(r.key()) }
+		}
+
+		if err := harvestLevel(level, sched, filter, profilesDir, postsRoot, mediaRoot, onRef); err != nil {
+			return err
+		}
+		if refs != nil {
+			// Refs come from the workers, which cannot stop the level; a
+			// failed spill only ends the expansion here.
+			if err := refs.Err(); err != nil {
+				refs.Close()
+				return err
+			}
+		}
+		if level != seeds {
+			level.Close()
+		}
+		if !expand {
+			return nil
+		}
+
+		next := scan.NewSet(*tmpDir, memLimit)
+		remaining := -1
+		if *snowballLimit > 0 {
+			remaining = *snowballLimit - discovered
+		}
+		n, err := nextSnowballLevel(refs, visited, next, remaining, func(d userDiscovery) error {
+			d.Depth = depth + 1
+			return denc.Encode(d)
+		})
+		refs.Close()
+		if err != nil {
+			next.Close()
+			return err
+		}
+		discovered += n
+		log.Printf("Snowball: %d new users referenced at depth %d (%d discovered so far)\n", n, depth+1, discovered)
+		if n == 0 {
+			next.Close()
+			return nil
+		}
+		if err := next.Each(visited.Add); err != nil {
+			next.Close()
+			return err
+		}
+		level = next
+		if *snowballLimit > 0 && discovered >= *snowballLimit {
+			maxDepth = depth + 1 // harvest this last level, expand no further
+		}
+	}
+}
+
+func harvestLevel(users *scan.Set, sched *userScheduler, filter *harvestFilter, profilesDir, postsRoot, mediaRoot string, onRef func(userRef)) error {
+	jobs := make(chan string, *workers*2)
+	var wg sync.WaitGroup
+
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			for uid := range jobs {
+				if err := processUser(uid, filter, profilesDir, postsRoot, mediaRoot, workerID, onRef); err != nil {
+					log.Printf("[worker %d] user %s: %v\n", workerID, uid, err)
+				}
+			}
+		}(i)
+	}
+
+	var err error
+	if sched.enabled() {
+		var ranked *scan.Set
+		if ranked, err = sched.rank(users, profilesDir); err == nil {
+			err = ranked.Each(func(key string) error {
+				jobs <- userOfRank(key)
+				return nil
+			})
+			ranked.Close()
+		}
+	} else {
+		err = users.Each(func(uid string) error {
+			jobs <- uid
+			return nil
+		})
+	}
+	close(jobs)
+	wg.Wait()
+	return err
+}
+
+// userDiscovery is one line of user_discovery.jsonl.
+type userDiscovery struct {
+	UserID   string `json:"userId"`
+	Depth    int    `json:"depth"`
+	Via      string `json:"via"` // tweet, revine, mention, comment, like, reference
+	FromUser string `json:"fromUser,omitempty"`
+	FromPost string `json:"fromPost,omitempty"`
+}
+
+// userRef is a user referenced from a harvested post.
+type userRef struct {
+	UserID   string
+	Via      string
+	FromUser string
+	FromPost string
+}
+
+// key packs a ref so that, sorted, all refs to one user sit together with the
+// user ID first.
+func (r userRef) key() string {
+	return r.UserID + "\t" + r.Via + "\t" + r.FromUser + "\t" + r.FromPost
+}
+
+func parseUserRefKey(k string) userDiscovery {
+	parts := strings.SplitN(k, "\t", 4)
+	for len(parts) < 4 {
+		parts = append(parts, "")
+	}
+	return userDiscovery{UserID: parts[0], Via: parts[1], FromUser: parts[2], FromPost: parts[3]}
+}
+
+// nextSnowballLevel walks the sorted refs alongside the sorted visited set and
+// adds every referenced user not yet visited to next (at most limit users when
+// limit >= 0). The first ref for each user is reported as its provenance.
+func nextSnowballLevel(refs, visited, next *scan.Set, limit int, record func(userDiscovery) error) (int, error) {
+	ri, err := refs.Iter()
+	if err != nil {
+		return 0, err
+	}
+	defer ri.Close()
+	vi, err := visited.Iter()
+	if err != nil {
+		return 0, err
+	}
+	defer vi.Close()
+
+	added := 0
+	hasV := vi.Next()
+	last := ""
+	for ri.Next() {
+		if limit >= 0 && added >= limit {
+			break
+		}
+		d := parseUserRefKey(ri.Key())
+		if d.UserID == last {
+			continue
+		}
+		last = d.UserID
+		for hasV && vi.Key() < d.UserID {
+			hasV = vi.Next()
+		}
+		if hasV && vi.Key() == d.UserID {
+			continue
+		}
+		if err := next.Add(d.UserID); err != nil {
+			return added, err
+		}
+		if err := record(d); err != nil {
+			return added, err
+		}
+		added++
+	}
+	if err := ri.Err(); err != nil {
+		return added, err
+	}
+	return added, vi.Err()
+}
+
+// vineUserLinkRe matches user links embedded in post text and entities.
+var vineUserLinkRe = regexp.MustCompile(`(?:vine://user/|vine\.co/u/)([0-9]+)`)
+
+// collectUserRefs finds other accounts a post points at: the original poster of
+// a revine, mentioned users, and comment/like authors when those lists are
+// present. The kind of reference is inferred from the key it was found under.
+func collectUserRefs(post map[string]interface{}, ownerID, postID string) []userRef {
+	seen := make(map[string]struct{})
+	var out []userRef
+	add := func(id, via string) {
+		id = strings.TrimSpace(id)
+		if id == "" || id == "0" || id == ownerID {
+			return
+		}
+		if via == "" {
+			via = "reference"
+		}
+		if _, ok := seen[id+via]; ok {
+			return
+		}
+		seen[id+via] = struct{}{}
+		out = append(out, userRef{UserID: id, Via: via, FromUser: ownerID, FromPost: postID})
+	}
+
+	var walk func(v interface{}, via string, root bool)
+	walk = func(v interface{}, via string, root bool) {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			if !root {
+				if id := scan.JSONString(t["userIdStr"]); id != "" {
+					add(id, via)
+				} else if id := scan.JSONString(t["userId"]); id != "" {
+					add(id, via)
+				}
+				if typ, _ := t["type"].(string); strings.EqualFold(typ, "mention") {
+					if id := scan.JSONString(t["idStr"]); id != "" {
+						add(id, "mention")
+					} else if id := scan.JSONString(t["id"]); id != "" {
+						add(id, "mention")
+					}
+				}
+			}
+			for k, vv := range t {
+				walk(vv, refKind(k, via), false)
+			}
+		case []interface{}:
+			for _, vv := range t {
+				walk(vv, via, false)
+			}
+		case string:
+			for _, m := range vineUserLinkRe.FindAllStringSubmatch(t, -1) {
+				kind := via
+				if kind == "" {
+					kind = "mention"
+				}
+				add(m[1], kind)
+			}
+		}
+	}
+	walk(post, "", true)
+	return out
+}
+
+func refKind(key, inherited string) string {
+	k := strings.ToLower(key)
+	switch {
+	case strings.Contains(k, "repost") || strings.Contains(k, "revine"):
+		return "revine"
+	case strings.Contains(k, "comment"):
+		return "comment"
+	case strings.Contains(k, "like"):
+		return "like"
+	case strings.Contains(k, "mention") || k == "entities":
+		return "mention"
+	}
+	return inherited
+}
+
+// loadProfile returns userID's profile, fetching and saving it first if we
+// don't have it on disk yet.
+func loadProfile(userID, profilesDir string) (map[string]interface{}, error) {
+	hist := historyDir("profiles", userID)
+	validate := func(m map[string]interface{}) error { return validateProfile(m, userID) }
+
+	if !profileStore.exists(userID) {
+		profile, val, err := fetchEntity(profileSrcs, "profile", userID, userID, nil, validate)
+		if err != nil {
+			if isPayloadError(err) {
+				markRetry(userID)
+			}
+			return nil, fmt.Errorf("fetch profile: %w", err)
+		}
+		// Rewrite URLs in profile
+		profile = rewriteURLs(profile).(map[string]interface{})
+
+		if err := writeDoc(profileStore, userID, profile); err != nil {
+			return nil, fmt.Errorf("write profile JSON: %w", err)
+		}
+		saveValidators(userID, &val, nil)
+		return profile, nil
+	}
+
+	// Profiles are read several times per run (scheduling, filters,
+	// processUser); only the first read re-validates.
+	if *refresh {
+		if _, done := refreshedProfiles.LoadOrStore(userID, struct{}{}); !done {
+			prev := loadUserValidators(userID).Profile
+			profile, _, val, err := refreshEntity(profileSrcs, "profile", userID, userID, hist, prev, profileStore, validate)
+			if err != nil {
+				return nil, fmt.Errorf("refresh profile: %w", err)
+			}
+			saveValidators(userID, &val, nil)
+			return profile, nil
+		}
+	}
+
+	profile, err := readDoc(profileStore, userID)
+	if err != nil {
+		return nil, fmt.Errorf("read profile JSON: %w", err)
+	}
+	return profile, nil
+}
+
+func processUser(userID string, filter *harvestFilter, profilesDir, postsRoot, mediaRoot string, workerID int, onRef func(userRef)) (err error) {
+	if !filter.allowsUserID(userID) {
+		atomic.AddInt64(&filter.skippedUsers, 1)
+		return nil
+	}
+
+	// 1) Ensure profile JSON exists, then load it to get post IDs
+	profile, err := loadProfile(userID, profilesDir)
+	if err != nil {
+		return err
+	}
+	if !filter.allowsProfile(profile) {
+		atomic.AddInt64(&filter.skippedUsers, 1)
+		log.Printf("[worker %d] user %s: skipped by filters\n", workerID, userID)
+		return nil
+	}
+
+	postIDs := orderPostIDs(collectPostIDsFromProfile(profile), *postOrder)
+	if len(postIDs) == 0 {
+		log.Printf("[worker %d] user %s: no post IDs in profile\n", workerID, userID)
+		return nil
+	}
+
+	// Validators are keyed by the ID a post is stored under and saved once
+	// the user is done.
+	var known userValidators
+	if *refresh {
+		known = loadUserValidators(userID)
+	}
+	learned := make(map[string]validators)
+	defer func() { saveValidators(userID, nil, learned) }()
+
+	posts := postStore.forUser(userID)
+	defer func() {
+		if cerr := posts.close(); cerr != nil && err == nil {
+			err = fmt.Errorf("save posts: %w", cerr)
+		}
+	}()
+
+	for _, pid := range postIDs {
+		validate := func(m map[string]interface{}) error { return validatePost(m, userID, pid) }
+
+		if *refresh && posts.exists(userID+"/"+pid) {
+			var prev *validators
+			if v, ok := known.Posts[pid]; ok {
+				prev = &v
+			}
+			postData, status, val, err := refreshEntity(postSrcs, "post", userID+"/"+pid, pid, historyDir("posts", userID, pid), prev, posts, validate)
+			if err != nil {
+				log.Printf("[worker %d] user %s post %s refresh: %v\n", workerID, userID, pid, err)
+				continue
+			}
+			learned[pid] = val
+			if !filter.allowsPost(postData) {
+				continue
+			}
+			if onRef != nil {
+				for _, ref := range collectUserRefs(postData, userID, pid) {
+					onRef(ref)
+				}
+			}
+			if *download && status == entityChanged {
+				for _, mu := range collectMediaURLs(postData) {
+					if err := downloadMedia(mu, mediaRoot); err != nil {
+						log.Printf("[worker %d] user %s post %s media %s: %v\n",
+							workerID, userID, pid, mu, err)
+					}
+				}
+			}
+			continue
+		}
+
+		postData, val, err := fetchEntity(postSrcs, "post", userID+"/"+pid, pid, nil, validate)
+		if err != nil {
+			if isPayloadError(err) {
+				markRetry(userID)
+			}
+			log.Printf("[worker %d] user %s post %s: %v\n", workerID, userID, pid, err)
+			continue
+		}
+
+		// validatePost made sure the post carries pid as its own ID, so pid
+		// is the key it is stored, refreshed and validated under.
+		if !filter.allowsPost(postData) {
+			continue
+		}
+
+		if onRef != nil {
+			for _, ref := range collectUserRefs(postData, userID, pid) {
+				onRef(ref)
+			}
+		}
+
+		if posts.exists(userID + "/" + pid) {
+			continue
+		}
+
+		postData = rewriteURLs(postData).(map[string]interface{})
+
+		if err := writeDoc(posts, userID+"/"+pid, postData); err != nil {
+			log.Printf("[worker %d] user %s post %s write: %v\n", workerID, userID, pid, err)
+		} else {
+			learned[pid] = val
+		}
+
+		if *download {
+			mediaURLs := collectMediaURLs(postData)
+			for _, mu := range mediaURLs {
+				media.Add(mu)
+			}
+			for _, mu := range mediaURLs {
+				if err := downloadMedia(mu, mediaRoot); err != nil {
+					log.Printf("[worker %d] user %s post %s media %s: %v\n",
+						workerID, userID, pid, mu, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// ------------------------ HTTP + JSON helpers ------------------------
+
+func fetchJSONMap(u string) (map[string]interface{}, error) {
+	out, _, err := fetchJSONConditional(u, nil)
+	return out, err
+}
+
+// errNotModified is returned by fetchJSONConditional for a 304.
+var errNotModified = errors.New("not modified")
+
+// fetchJSONConditional is fetchJSONMap that sends prev's ETag/Last-Modified
+// (if any) and returns the validators of the response.
+func fetchJSONConditional(u string, prev *validators) (map[string]interface{}, validators, error) {
+	// Identical concurrent requests share one response; each caller decodes
+	// its own copy of the body.
+	key := canonicalURL(u)
+	if prev != nil {
+		key += "\x00" + prev.ETag + "\x00" + prev.LastModified
+	}
+	v, err := jsonFlights.Do(key, func() (interface{}, error) {
+		return fetchJSONBody(u, prev)
+	})
+	fb, _ := v.(*fetchedBody)
+	var val validators
+	if fb != nil {
+		val = fb.val
+	}
+	if err != nil {
+		return nil, val, err
+	}
+
+	var out map[string]interface{}
+	if err := json.Unmarshal(fb.body, &out); err != nil {
+		return nil, val, &payloadError{Reason: "invalid or truncated JSON: " + err.Error(), Body: fb.body}
+	}
+	return out, val, nil
+}
+
+// fetchedBody is a JSON response body shared by coalesced callers.
+type fetchedBody struct {
+	body []byte
+	val  validators
+}
+
+func fetchJSONBody(u string, prev *validators) (*fetchedBody, error) {
+	fb := &fetchedBody{}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if prev != nil {
+		if prev.ETag != "" {
+			req.Header.Set("If-None-Match", prev.ETag)
+		}
+		if prev.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.LastModified)
+		}
+	}
+
+	resp, err := doRequest(jsonClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	fb.val.ETag = resp.Header.Get("ETag")
+	fb.val.LastModified = resp.Header.Get("Last-Modified")
+	fb.val.CheckedAt = time.Now().UTC().Format(time.RFC3339)
+
+	if resp.StatusCode == http.StatusNotModified {
+		return fb, errNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return fb, fmt.Errorf("HTTP %d for %s", resp.StatusCode, u)
+	}
+
+	fb.body, err = io.ReadAll(io.LimitReader(resp.Body, maxPayloadBytes+1))
+	if err != nil {
+		return fb, err
+	}
+	if len(fb.body) > maxPayloadBytes {
+		return fb, &payloadError{Reason: fmt.Sprintf("body larger than %d bytes", maxPayloadBytes)}
+	}
+	if err := checkJSONContentType(resp.Header.Get("Content-Type"), fb.body); err != nil {
+		return fb, err
+	}
+	return fb, nil
+}
+
+// writeJSONStringArray streams a set out as an indented JSON array of strings,
+// in the same shape writeJSONFile produces for a []string.
+func writeJSONStringArray(path string, set *scan.Set) error {
+	return atomicfile.Write(path, func(f io.Writer) error {
+		w := bufio.NewWriter(f)
+		w.WriteString("[")
+		first := true
+		err := set.Each(func(s string) error {
+			b, err := json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			if !first {
+				w.WriteString(",")
+			}
+			first = false
+			w.WriteString("\n  ")
+			_, err = w.Write(b)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if !first {
+			w.WriteString("\n")
+		}
+		w.WriteString("]\n")
+		return w.Flush()
+	})
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	return atomicfile.Write(path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	})
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// ------------------------ URL rewriting ------------------------
+
+func rewriteURLs(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, vv := range t {
+			t[k] = rewriteURLs(vv)
+		}
+		return t
+	case []interface{}:
+		for i, vv := range t {
+			t[i] = rewriteURLs(vv)
+		}
+		return t
+	case string:
+		s := t
+		// Normalize Vine CDN URLs to vines.s3.amazonaws.com
+		if strings.Contains(s, "v.cdn.vine.co") || strings.Contains(s, "mtc.cdn.vine.co") {
+			s = strings.ReplaceAll(s, "http://v.cdn.vine.co", "https://vines.s3.amazonaws.com")
+			s = strings.ReplaceAll(s, "https://v.cdn.vine.co", "https://vines.s3.amazonaws.com")
+			s = strings.ReplaceAll(s, "http://mtc.cdn.vine.co", "https://vines.s3.amazonaws.com")
+			s = strings.ReplaceAll(s, "https://mtc.cdn.vine.co", "https://vines.s3.amazonaws.com")
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+// ------------------------ postId collection ------------------------
+
+func collectPostIDsFromProfile(profile map[string]interface{}) []string {
+	seen := make(map[string]struct{})
+	var out []string
+
+	addID := func(id string) {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			return
+		}
+		if _, ok := seen[id]; ok {
+			return
+		}
+		seen[id] = struct{}{}
+		out = append(out, id)
+	}
+
+	// 1) Preferred: profile["posts"] list
+	if rawPosts, ok := profile["posts"]; ok && rawPosts != nil {
+		switch v := rawPosts.(type) {
+		case []interface{}:
+			for _, item := range v {
+				switch t := item.(type) {
+				case string:
+					addID(t)
+				case float64:
+					addID(fmt.Sprintf("%.0f", t))
+				case map[string]interface{}:
+					if s, ok2 := t["postIdStr"].(string); ok2 && s != "" {
+						addID(s)
+					} else if f, ok2 := t["postId"].(float64); ok2 {
+						addID(fmt.Sprintf("%.0f", f))
+					}
+				default:
+					// ignore
+				}
+			}
+		}
+	}
+
+	// 2) Fallback: deep scan for postId/postIdStr anywhere
+	if len(out) == 0 {
+		var walk func(v interface{})
+		walk = func(v interface{}) {
+			switch t := v.(type) {
+			case map[string]interface{}:
+				for k, vv := range t {
+					kl := strings.ToLower(k)
+					if (kl == "postid" || kl == "postidstr") && vv != nil {
+						switch idv := vv.(type) {
+						case string:
+							addID(idv)
+						case float64:
+							addID(fmt.Sprintf("%.0f", idv))
+						}
+					}
+					walk(vv)
+				}
+			case []interface{}:
+				for _, vv := range t {
+					walk(vv)
+				}
+			default:
+				// nothing
+			}
+		}
+		walk(profile)
+	}
+
+	return out
+}
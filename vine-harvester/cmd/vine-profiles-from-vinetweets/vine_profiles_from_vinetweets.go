@@ -0,0 +1,275 @@
+// vine_profiles_from_vinetweets.go
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"vine-harvester/internal/httpclient"
+	"vine-harvester/internal/scan"
+)
+
+// Minimal post structure: we only care about userIdStr.
+type Post struct {
+	UserIdStr string `json:"userIdStr"`
+}
+
+// Flags
+var (
+	inputDir        = flag.String("inputDir", "E:/vine_tweets", "Directory containing Vine-Tweets *.txt files")
+	postBase        = flag.String("postBase", "https://archive.vine.co/posts", "Base URL for post JSON (no trailing slash)")
+	outProfilesJSON = flag.String("outProfilesJson", "profiles.json", "Output JSON file for userIdStr list")
+	workers         = flag.Int("workers", 64, "Number of concurrent HTTP workers")
+	limit           = flag.Int("limit", 0, "Optional limit on number of video IDs to process (0 = all)")
+	outSlugSources  = flag.String("outSlugSources", "slug_sources.jsonl", "Output JSONL file recording which tweet each video ID came from (empty = skip)")
+	dedupMemMB      = flag.Int("dedupMemMB", 512, "Memory budget (MiB) per ID set before spilling sorted runs to disk (0 = never spill)")
+	tmpDir          = flag.String("tmpDir", "", "Directory for dedup spill files and nested zips (default: system temp dir)")
+
+	httpConfigPath = flag.String("httpConfig", "", "JSON file with HTTP client settings: json timeouts, idle connection limits, proxy, caBundle, userAgent, contact")
+	userAgent      = flag.String("userAgent", "", "User-Agent for every request (default: VineArchiveProfileHarvester/1.0)")
+	contact        = flag.String("contact", "", "Contact URL or email appended to the User-Agent (an email is also sent as From)")
+	proxyURL       = flag.String("proxy", "", "HTTP(S) proxy URL (default: HTTP_PROXY/HTTPS_PROXY from the environment)")
+	caBundle       = flag.String("caBundle", "", "PEM file with extra CA certificates to trust")
+	jsonTimeout    = flag.Duration("jsonTimeout", 30*time.Second, "Overall timeout for one post JSON request")
+)
+
+func main() {
+	flag.Parse()
+	scan.TempDir = *tmpDir
+
+	httpCfg, err := httpclient.Load(*httpConfigPath, flag.CommandLine)
+	if err != nil {
+		log.Fatalf("httpConfig: %v", err)
+	}
+	client, err := httpclient.New(httpCfg, httpCfg.JSON, "VineArchiveProfileHarvester/1.0")
+	if err != nil {
+		log.Fatalf("HTTP client: %v", err)
+	}
+
+	// 1) Collect unique video IDs from Vine-Tweets text files
+	var sources *scan.SourceLog
+	if *outSlugSources != "" {
+		sources, err = scan.OpenSourceLog(*outSlugSources)
+		if err != nil {
+			log.Fatalf("openSourceLog failed: %v", err)
+		}
+	}
+	ids, err := collectVideoIDs(*inputDir, sources)
+	if err != nil {
+		log.Fatalf("collectVideoIDs failed: %v", err)
+	}
+	defer ids.Close()
+	if err := sources.Close(); err != nil {
+		log.Printf("Warning: failed to write %s: %v\n", *outSlugSources, err)
+	} else if sources != nil {
+		log.Printf("Wrote %d slug provenance records to %s\n", sources.Count(), *outSlugSources)
+	}
+	idCount, err := ids.Count()
+	if err != nil {
+		log.Fatalf("collectVideoIDs failed: %v", err)
+	}
+	log.Printf("Collected %d unique vine video IDs\n", idCount)
+	if idCount == 0 {
+		log.Println("No video IDs found. Check inputDir and that you extracted the dataset .txt files.")
+		return
+	}
+
+	if *limit > 0 && idCount > int64(*limit) {
+		log.Printf("Limiting to first %d IDs (of %d)\n", *limit, idCount)
+	}
+
+	// Collect unique userIdStr values
+	userIDs := scan.NewSet(*tmpDir, int64(*dedupMemMB)<<20)
+	defer userIDs.Close()
+
+	type job struct {
+		id string
+	}
+	jobs := make(chan job, *workers*2)
+
+	// 2) Worker pool to fetch post JSONs
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			for j := range jobs {
+				p, err := fetchPost(client, *postBase, j.id)
+				if err != nil {
+					// 404s are expected for some IDs – only log noisy stuff occasionally.
+					if !strings.Contains(err.Error(), "status 404") {
+						log.Printf("[worker %d] %s: %v\n", workerID, j.id, err)
+					}
+					continue
+				}
+				if p.UserIdStr == "" {
+					continue
+				}
+
+				// A failed spill is picked up by the feeder through Err.
+				userIDs.Add(p.UserIdStr)
+			}
+		}(i)
+	}
+
+	start := time.Now()
+
+	// Feed jobs (IDs come out sorted, so -limit picks a stable subset)
+	go func() {
+		fed := 0
+		err := ids.Each(func(id string) error {
+			if *limit > 0 && fed >= *limit {
+				return scan.ErrStop
+			}
+			if err := userIDs.Err(); err != nil {
+				return err
+			}
+			jobs <- job{id: id}
+			fed++
+			return nil
+		})
+		if err != nil {
+			log.Printf("Reading video IDs: %v\n", err)
+		}
+		close(jobs)
+	}()
+
+	wg.Wait()
+	log.Printf("Finished fetching posts in %v\n", time.Since(start))
+	if err := userIDs.Err(); err != nil {
+		log.Fatalf("collecting user IDs failed: %v", err)
+	}
+
+	// 3) Write profiles.json as array of userIdStr strings
+	if err := writeUserIDsJSON(*outProfilesJSON, userIDs); err != nil {
+		log.Fatalf("writeUserIDsJSON failed: %v", err)
+	}
+	userCount, err := userIDs.Count()
+	if err != nil {
+		log.Fatalf("counting user IDs failed: %v", err)
+	}
+	log.Printf("Done. Unique userIdStr count: %d\n", userCount)
+}
+
+// ----------------- Collect video IDs from Vine-Tweets dataset -----------------
+
+func collectVideoIDs(dir string, sources *scan.SourceLog) (*scan.Set, error) {
+	log.Println("Scanning for Vine-Tweets text files (plain, compressed or archived) in:", dir)
+
+	idsSet := scan.NewSet(*tmpDir, int64(*dedupMemMB)<<20)
+
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Skipping %s: %v\n", path, err)
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if !scan.IsCandidate(d.Name()) {
+			return nil
+		}
+
+		var addErr error
+		err = scan.WalkFile(path, func(member string, r io.Reader) error {
+			return scan.ParseDump(member, r, func(src scan.Source) {
+				if addErr == nil {
+					addErr = idsSet.Add(src.Slug)
+				}
+				sources.Record(src)
+			})
+		})
+		if addErr != nil {
+			return addErr
+		}
+		if err != nil {
+			log.Printf("Error scanning %s: %v\n", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		idsSet.Close()
+		return nil, err
+	}
+
+	return idsSet, nil
+}
+
+// ----------------- HTTP fetching -----------------
+
+func fetchPost(client *http.Client, base, id string) (*Post, error) {
+	u := fmt.Sprintf("%s/%s.json", strings.TrimRight(base, "/"), url.PathEscape(id))
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Many IDs will 404; that’s fine.
+	if resp.StatusCode != http.StatusOK {
+		// Drain body and return error
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	var p Post
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// ----------------- Output -----------------
+
+func writeUserIDsJSON(path string, ids *scan.Set) error {
+	log.Println("Writing userIdStr list to", path)
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// Same layout as an indented []string, streamed so the list never has to
+	// fit in memory.
+	w := bufio.NewWriter(out)
+	w.WriteString("[")
+	first := true
+	err = ids.Each(func(id string) error {
+		b, err := json.Marshal(id)
+		if err != nil {
+			return err
+		}
+		if !first {
+			w.WriteString(",")
+		}
+		first = false
+		w.WriteString("\n  ")
+		_, err = w.Write(b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !first {
+		w.WriteString("\n")
+	}
+	w.WriteString("]\n")
+	return w.Flush()
+}
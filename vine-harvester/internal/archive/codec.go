@@ -0,0 +1,97 @@
+// codec.go
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Profiles and posts can be stored compressed (-storageCodec). The codec adds
+// its extension to the file name (<postId>.json.gz), while readers go by the
+// magic bytes of the content. An outDir can therefore mix codecs, e.g. after
+// the codec changed between runs; vine_full_harvest -convertStorage rewrites
+// an existing outDir with one codec.
+// zstd compresses best and decodes fastest; both codecs run in process.
+
+type Codec struct {
+	Name string
+	Ext  string // appended to the .json name
+}
+
+var Codecs = []Codec{
+	{Name: "none", Ext: ""},
+	{Name: "gzip", Ext: ".gz"},
+	{Name: "zstd", Ext: ".zst"},
+}
+
+func ParseCodec(name string) (Codec, error) {
+	for _, c := range Codecs {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return Codec{}, fmt.Errorf("unknown storage codec %q (want none, gzip or zstd)", name)
+}
+
+// Stored documents are told apart by their magic bytes.
+var (
+	magicGzip = []byte{0x1f, 0x8b}
+	magicZstd = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// The zstd coders are shared; EncodeAll and DecodeAll are safe for concurrent
+// use.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// Decode undoes whatever codec raw was written with, going by its magic
+// bytes; plain JSON is returned as is.
+func Decode(raw []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(raw, magicGzip):
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	case bytes.HasPrefix(raw, magicZstd):
+		return zstdDecoder.DecodeAll(raw, nil)
+	}
+	return raw, nil
+}
+
+// Encode writes the plain JSON data to w with codec c.
+func (c Codec) Encode(w io.Writer, data []byte) error {
+	switch c.Name {
+	case "gzip":
+		zw := gzip.NewWriter(w)
+		if _, err := zw.Write(data); err != nil {
+			return err
+		}
+		return zw.Close()
+	case "zstd":
+		_, err := w.Write(zstdEncoder.EncodeAll(data, nil))
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// StoredBase maps a file name back to its document base, or "" if the file
+// is not a stored profile/post.
+func StoredBase(path string) string {
+	for _, c := range Codecs {
+		if strings.HasSuffix(path, ".json"+c.Ext) {
+			return strings.TrimSuffix(path, c.Ext)
+		}
+	}
+	return ""
+}
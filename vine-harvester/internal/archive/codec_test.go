@@ -0,0 +1,46 @@
+// codec_test.go
+package archive
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	doc := []byte(`{"postIdStr":"1","description":"` + strings.Repeat("loop ", 200) + `"}` + "\n")
+
+	for _, c := range Codecs {
+		var buf bytes.Buffer
+		if err := c.Encode(&buf, doc); err != nil {
+			t.Fatalf("%s: encode: %v", c.Name, err)
+		}
+		if c.Name != "none" && buf.Len() >= len(doc) {
+			t.Errorf("%s: %d bytes did not shrink (%d)", c.Name, len(doc), buf.Len())
+		}
+		got, err := Decode(buf.Bytes())
+		if err != nil || !bytes.Equal(got, doc) {
+			t.Fatalf("%s: decode = %q, %v", c.Name, got, err)
+		}
+
+		if c.Name == "zstd" {
+			if _, err := Decode(buf.Bytes()[:buf.Len()-4]); err == nil {
+				t.Errorf("zstd: truncated frame decoded without error")
+			}
+		}
+	}
+}
+
+func TestStoredBase(t *testing.T) {
+	for path, want := range map[string]string{
+		"posts/1/2.json":     "posts/1/2.json",
+		"posts/1/2.json.gz":  "posts/1/2.json",
+		"posts/1/2.json.zst": "posts/1/2.json",
+		"posts/1.vseg":       "",
+		"media/v.mp4":        "",
+	} {
+		if got := StoredBase(path); got != want {
+			t.Errorf("StoredBase(%s) = %q, want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// layout.go
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Profiles and posts can be spread over per-user shard directories so that no
+// single directory (or object-store prefix) holds hundreds of thousands of
+// entries. -layout picks the scheme:
+//
+//	flat    profiles/<userId>.json        posts/<userId>/, posts/<userId>.vseg
+//	hash1   profiles/ab/<userId>.json     posts/ab/<userId>/, ...
+//	hash2   profiles/ab/cd/<userId>.json  posts/ab/cd/<userId>/, ...
+//
+// where ab, cd are the first bytes of the hex SHA-256 of the user ID. The
+// scheme an outDir uses is recorded in outDir/layout.json (no file means
+// flat); vine_full_harvest -migrateLayout moves an existing archive to another
+// scheme.
+
+type Layout struct {
+	Name   string
+	Levels int
+}
+
+var Layouts = []Layout{
+	{Name: "flat", Levels: 0},
+	{Name: "hash1", Levels: 1},
+	{Name: "hash2", Levels: 2},
+}
+
+func ParseLayout(name string) (Layout, error) {
+	for _, l := range Layouts {
+		if l.Name == name {
+			return l, nil
+		}
+	}
+	return Layout{}, fmt.Errorf("unknown layout %q (want flat, hash1 or hash2)", name)
+}
+
+// Path returns where the entry name belonging to userID lives under root.
+func (l Layout) Path(root, userID, name string) string {
+	parts := []string{root}
+	if l.Levels > 0 {
+		sum := sha256.Sum256([]byte(userID))
+		h := hex.EncodeToString(sum[:l.Levels])
+		for i := 0; i < l.Levels; i++ {
+			parts = append(parts, h[2*i:2*i+2])
+		}
+	}
+	return filepath.Join(append(parts, name)...)
+}
+
+// LayoutState is outDir/layout.json. MigratingTo is set while
+// vine_full_harvest -migrateLayout runs; a harvest refuses to start until the
+// migration has finished.
+type LayoutState struct {
+	Layout      string `json:"layout"`
+	MigratingTo string `json:"migratingTo,omitempty"`
+}
+
+// LayoutStatePath is layout.json of the archive at root.
+func LayoutStatePath(root string) string {
+	return filepath.Join(root, "layout.json")
+}
+
+func ReadLayoutState(fsys FS, root string) (LayoutState, error) {
+	st := LayoutState{Layout: "flat"}
+	data, err := fsys.Read(LayoutStatePath(root))
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, fmt.Errorf("%s: %w", LayoutStatePath(root), err)
+	}
+	return st, nil
+}
+
+func WriteLayoutState(fsys FS, root string, st LayoutState) error {
+	return fsys.Write(LayoutStatePath(root), func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(st)
+	})
+}
+
+// ResolveLayout picks the layout for a run on the archive at root: the one it
+// records, which name (-layout) may only name again unless the archive holds
+// no profiles or posts yet. Moving needs vine_full_harvest -migrateLayout.
+func ResolveLayout(fsys FS, root, name string) (Layout, error) {
+	st, err := ReadLayoutState(fsys, root)
+	if err != nil {
+		return Layout{}, err
+	}
+	if st.MigratingTo != "" {
+		return Layout{}, fmt.Errorf("outDir is being migrated from %s to %s; finish with vine_full_harvest -migrateLayout %s",
+			st.Layout, st.MigratingTo, st.MigratingTo)
+	}
+	recorded, err := ParseLayout(st.Layout)
+	if err != nil {
+		return Layout{}, err
+	}
+	if name == "" || name == recorded.Name {
+		return recorded, nil
+	}
+	want, err := ParseLayout(name)
+	if err != nil {
+		return Layout{}, err
+	}
+	empty, err := isEmpty(fsys, root)
+	if err != nil {
+		return Layout{}, err
+	}
+	if empty {
+		return want, WriteLayoutState(fsys, root, LayoutState{Layout: want.Name})
+	}
+	return Layout{}, fmt.Errorf("outDir uses the %s layout; move it with vine_full_harvest -migrateLayout %s",
+		recorded.Name, want.Name)
+}
+
+// isEmpty reports whether the archive at root has no profiles or posts yet.
+func isEmpty(fsys FS, root string) (bool, error) {
+	for _, dir := range []string{"profiles", "posts"} {
+		if empty, err := fsys.Empty(filepath.Join(root, dir)); err != nil || !empty {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,142 @@
+// store.go
+package archive
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+
+	"vine-harvester/internal/atomicfile"
+)
+
+// FS is where an archive's files live: Local for an outDir on disk, or a
+// bucket. Paths are the caller's (outDir-relative for a bucket).
+type FS interface {
+	Exists(path string) (bool, error)
+	// Read wraps os.ErrNotExist when path is missing.
+	Read(path string) ([]byte, error)
+	// Write replaces path with what fill writes; a failed fill leaves path
+	// untouched.
+	Write(path string, fill func(w io.Writer) error) error
+	// Remove deletes path; a missing path is not an error.
+	Remove(path string) error
+	// Empty reports whether nothing is stored under dir yet.
+	Empty(dir string) (bool, error)
+}
+
+// Local is the local filesystem; writes go through atomicfile.Write.
+type Local struct{}
+
+func (Local) Exists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (Local) Read(path string) ([]byte, error) { return os.ReadFile(path) }
+
+func (Local) Write(path string, fill func(w io.Writer) error) error {
+	return atomicfile.Write(path, fill)
+}
+
+func (Local) Remove(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (Local) Empty(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	return len(entries) == 0, err
+}
+
+// Store reads and writes JSON documents (profiles and posts), named by their
+// base path ending in .json, in FS with Codec.
+type Store struct {
+	FS    FS
+	Codec Codec // what new documents are written with
+	// CurrentOnly looks documents up under Codec's name alone, so a check is
+	// a single request where each one costs (a bucket). Otherwise the other
+	// codecs are tried after it.
+	CurrentOnly bool
+}
+
+// Path returns the file that holds document base, trying the current codec
+// first, and whether it exists. A missing document reports where it would be
+// written.
+func (s Store) Path(base string) (string, bool, error) {
+	p := base + s.Codec.Ext
+	if ok, err := s.FS.Exists(p); ok || err != nil || s.CurrentOnly {
+		return p, ok, err
+	}
+	for _, c := range Codecs {
+		if c == s.Codec {
+			continue
+		}
+		if ok, err := s.FS.Exists(base + c.Ext); ok || err != nil {
+			return base + c.Ext, ok, err
+		}
+	}
+	return p, false, nil
+}
+
+// Exists reports whether document base is stored. A failed check is logged
+// and counts as missing, so the document is fetched again.
+func (s Store) Exists(base string) bool {
+	_, ok, err := s.Path(base)
+	if err != nil {
+		log.Printf("Warning: %v\n", err)
+	}
+	return ok
+}
+
+// Read returns the plain JSON bytes of document base.
+func (s Store) Read(base string) ([]byte, error) {
+	path, _, err := s.Path(base)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := s.FS.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(raw)
+}
+
+// Write writes the plain JSON data as document base with the current codec.
+// A copy stored with another codec is left for vine_full_harvest
+// -convertStorage to remove; Path finds the current one first.
+func (s Store) Write(base string, data []byte) error {
+	return s.FS.Write(base+s.Codec.Ext, func(w io.Writer) error {
+		return s.Codec.Encode(w, data)
+	})
+}
+
+// WriteJSON writes v, indented, as document base.
+func (s Store) WriteJSON(base string, v interface{}) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	return s.Write(base, buf.Bytes())
+}
+
+// Remove removes document base in every codec.
+func (s Store) Remove(base string) error {
+	for _, c := range Codecs {
+		if err := s.FS.Remove(base + c.Ext); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// store_test.go
+package archive
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// countingFS is Local, counting existence checks.
+type countingFS struct {
+	Local
+	checks int
+}
+
+func (c *countingFS) Exists(path string) (bool, error) {
+	c.checks++
+	return c.Local.Exists(path)
+}
+
+func TestStorePathOrder(t *testing.T) {
+	dir := t.TempDir()
+	fsys := &countingFS{}
+	gz := Store{FS: fsys, Codec: Codecs[1]}
+	os.WriteFile(filepath.Join(dir, "1.json"), []byte(`{"v":"plain"}`), 0644)
+	if err := gz.Write(filepath.Join(dir, "2.json"), []byte(`{"v":"gz"}`)); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "2.json"), []byte(`{"v":"stale"}`), 0644)
+
+	for _, tc := range []struct {
+		name        string
+		currentOnly bool
+		base, want  string
+		found       bool
+		checks      int
+	}{
+		{name: "current codec first", base: "2.json", want: "2.json.gz", found: true, checks: 1},
+		{name: "falls back to other codecs", base: "1.json", want: "1.json", found: true, checks: 2},
+		{name: "missing reports the write path", base: "3.json", want: "3.json.gz", checks: 3},
+		{name: "current only", currentOnly: true, base: "1.json", want: "1.json.gz", checks: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fsys.checks = 0
+			s := gz
+			s.CurrentOnly = tc.currentOnly
+			p, ok, err := s.Path(filepath.Join(dir, tc.base))
+			if err != nil || p != filepath.Join(dir, tc.want) || ok != tc.found {
+				t.Fatalf("Path = %s, %v, %v; want %s, %v", p, ok, err, tc.want, tc.found)
+			}
+			if fsys.checks != tc.checks {
+				t.Fatalf("%d existence checks, want %d", fsys.checks, tc.checks)
+			}
+		})
+	}
+
+	if got, err := gz.Read(filepath.Join(dir, "2.json")); err != nil || string(got) != `{"v":"gz"}` {
+		t.Fatalf("Read = %s, %v", got, err)
+	}
+	if _, err := gz.Read(filepath.Join(dir, "3.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Read of a missing document = %v", err)
+	}
+	if err := gz.Remove(filepath.Join(dir, "2.json")); err != nil {
+		t.Fatal(err)
+	}
+	if gz.Exists(filepath.Join(dir, "2.json")) {
+		t.Fatal("Remove left a copy behind")
+	}
+}
+
+func TestResolveLayout(t *testing.T) {
+	fsys := Local{}
+	dir := t.TempDir()
+
+	if l, err := ResolveLayout(fsys, dir, ""); err != nil || l.Name != "flat" {
+		t.Fatalf("no layout.json = %v, %v", l.Name, err)
+	}
+	// An empty archive takes the requested layout and records it.
+	if l, err := ResolveLayout(fsys, dir, "hash1"); err != nil || l.Name != "hash1" {
+		t.Fatalf("empty archive = %v, %v", l.Name, err)
+	}
+	if st, err := ReadLayoutState(fsys, dir); err != nil || st.Layout != "hash1" {
+		t.Fatalf("layout.json = %+v, %v", st, err)
+	}
+
+	p := Layouts[1].Path(filepath.Join(dir, "profiles"), "42", "42.json")
+	os.MkdirAll(filepath.Dir(p), 0755)
+	os.WriteFile(p, []byte(`{}`), 0644)
+	if _, err := ResolveLayout(fsys, dir, "hash2"); err == nil {
+		t.Fatal("layout of a non-empty archive changed without a migration")
+	}
+	if l, err := ResolveLayout(fsys, dir, "hash1"); err != nil || l.Name != "hash1" {
+		t.Fatalf("naming the recorded layout = %v, %v", l.Name, err)
+	}
+	if _, err := ResolveLayout(fsys, dir, "hash3"); err == nil {
+		t.Fatal("unknown layout accepted")
+	}
+
+	WriteLayoutState(fsys, dir, LayoutState{Layout: "hash1", MigratingTo: "hash2"})
+	if _, err := ResolveLayout(fsys, dir, ""); err == nil {
+		t.Fatal("half-migrated archive accepted")
+	}
+}
+
+func TestLayoutPath(t *testing.T) {
+	// The shard is the first bytes of the hex SHA-256 of the user ID.
+	for _, tc := range []struct {
+		layout Layout
+		want   string
+	}{
+		{Layouts[0], filepath.Join("posts", "1")},
+		{Layouts[1], filepath.Join("posts", "6b", "1")},
+		{Layouts[2], filepath.Join("posts", "6b", "86", "1")},
+	} {
+		if got := tc.layout.Path("posts", "1", "1"); got != tc.want {
+			t.Errorf("%s: Path = %s, want %s", tc.layout.Name, got, tc.want)
+		}
+	}
+}
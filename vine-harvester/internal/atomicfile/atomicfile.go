@@ -0,0 +1,208 @@
+// atomicfile.go
+package atomicfile
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Write and WriteBytes replace a file through a uniquely named temp file, so
+// readers only ever see a complete file. Temp files are named
+// <name>.<host>-<pid>.<random>.tmp; the owner part is what lets Sweep tell a
+// crashed run's leftovers from the temps of a harvester still writing to the
+// same root.
+
+// StaleAge is how old a temp file must be before Sweep removes it without
+// knowing its writer is gone. It is far longer than any single write,
+// including a media download at the longest -mediaTimeout.
+var StaleAge = 24 * time.Hour
+
+var (
+	rootsMu sync.RWMutex
+	roots   []string
+)
+
+// hostTag and owner tag this process's temp files. The host name keeps the
+// separators of a temp name out.
+var (
+	hostTag = strings.NewReplacer(".", "_", "-", "_", string(filepath.Separator), "_").Replace(hostname())
+	owner   = hostTag + "-" + strconv.Itoa(os.Getpid())
+)
+
+func hostname() string {
+	h, _ := os.Hostname()
+	return h
+}
+
+// Write writes path through a uniquely named temp file, so concurrent writers
+// of one path never share a temp file and readers only ever see a complete
+// file. The temp file goes into the .tmp directory of the swept root path is
+// under (see Sweep), else next to path. fill writes the contents; the file is
+// fsynced before the rename and the directory after it. On error the temp file
+// is removed and path is left untouched.
+func Write(path string, fill func(w io.Writer) error) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmpDir := tempDir(path)
+	if tmpDir != dir {
+		if err := os.MkdirAll(tmpDir, 0755); err != nil {
+			return err
+		}
+	}
+	f, err := os.CreateTemp(tmpDir, filepath.Base(path)+"."+owner+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if err := fill(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	SyncDir(dir)
+	return nil
+}
+
+// WriteBytes is os.WriteFile through Write.
+func WriteBytes(path string, data []byte) error {
+	return Write(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// SyncDir makes a rename in dir durable. It is best effort: some platforms
+// (Windows) cannot fsync a directory.
+func SyncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// tempDir is where Write stages path: the .tmp directory of the innermost
+// swept root holding path, or path's own directory.
+func tempDir(path string) string {
+	rootsMu.RLock()
+	defer rootsMu.RUnlock()
+	best := ""
+	for _, root := range roots {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if len(root) > len(best) {
+			best = root
+		}
+	}
+	if best == "" {
+		return filepath.Dir(path)
+	}
+	return filepath.Join(best, ".tmp")
+}
+
+// Sweep has later writes under root staged in root/.tmp, so a sweep never has
+// to walk the archive itself, and clears that directory of what crashed runs
+// left behind: temps of a dead process on this host, and anything older than
+// StaleAge. Temps of another live harvester sharing root are left alone. Call
+// it at startup, before this process writes under root; a temp carrying this
+// process's own PID is then from an earlier run that had the same PID (a
+// container's PID 1, say).
+func Sweep(root string) {
+	dir := filepath.Join(root, ".tmp")
+	entries, _ := os.ReadDir(dir)
+	removed := 0
+	for _, e := range entries {
+		if !stale(e) {
+			continue
+		}
+		if os.RemoveAll(filepath.Join(dir, e.Name())) == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Printf("Removed %d stale temp files from %s\n", removed, dir)
+	}
+	rootsMu.Lock()
+	roots = append(roots, root)
+	rootsMu.Unlock()
+}
+
+func stale(e os.DirEntry) bool {
+	if info, err := e.Info(); err == nil && time.Since(info.ModTime()) > StaleAge {
+		return true
+	}
+	host, pid, ok := tempOwner(e.Name())
+	if !ok || host != hostTag {
+		return false
+	}
+	return pid == os.Getpid() || !processAlive(pid)
+}
+
+// tempOwner reads the host and PID out of a temp file name written by Write.
+func tempOwner(name string) (host string, pid int, ok bool) {
+	name, ok = strings.CutSuffix(name, ".tmp")
+	if !ok {
+		return "", 0, false
+	}
+	i := strings.LastIndexByte(name, '.')
+	if i < 0 {
+		return "", 0, false
+	}
+	name = name[:i]
+	i = strings.LastIndexByte(name, '.')
+	if i < 0 {
+		return "", 0, false
+	}
+	tag := name[i+1:]
+	j := strings.LastIndexByte(tag, '-')
+	if j < 0 {
+		return "", 0, false
+	}
+	pid, err := strconv.Atoi(tag[j+1:])
+	if err != nil || pid <= 0 {
+		return "", 0, false
+	}
+	return tag[:j], pid, true
+}
+
+// processAlive reports whether pid runs on this host. Where that cannot be
+// told (Windows has no signal 0) the process counts as alive and only
+// StaleAge clears its temps.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return !errors.Is(p.Signal(syscall.Signal(0)), os.ErrProcessDone)
+}
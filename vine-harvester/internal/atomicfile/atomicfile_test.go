@@ -0,0 +1,119 @@
+// atomicfile_test.go
+package atomicfile
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWritesStageInSweptRoot(t *testing.T) {
+	root := t.TempDir()
+	defer func() { roots = nil }()
+
+	stale := filepath.Join(root, ".tmp", "p.json."+hostTag+"-"+strconv.Itoa(os.Getpid())+".123.tmp")
+	os.MkdirAll(filepath.Dir(stale), 0755)
+	os.WriteFile(stale, []byte("half"), 0644)
+	// A post that happens to end in .tmp is not a temp file.
+	post := filepath.Join(root, "posts", "1", "x.tmp")
+	os.MkdirAll(filepath.Dir(post), 0755)
+	os.WriteFile(post, []byte("{}"), 0644)
+
+	Sweep(root)
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("stale temp file survived the sweep: %v", err)
+	}
+	if _, err := os.Stat(post); err != nil {
+		t.Fatalf("sweep touched the archive: %v", err)
+	}
+
+	target := filepath.Join(root, "profiles", "ab", "42.json")
+	if got, want := tempDir(target), filepath.Join(root, ".tmp"); got != want {
+		t.Fatalf("tempDir = %s, want %s", got, want)
+	}
+	if got := tempDir(filepath.Join(root+"x", "a.json")); got != root+"x" {
+		t.Fatalf("tempDir outside the root = %s", got)
+	}
+	if err := WriteBytes(target, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(target); err != nil || string(data) != "{}" {
+		t.Fatalf("target = %q, %v", data, err)
+	}
+	if left, _ := os.ReadDir(filepath.Join(root, ".tmp")); len(left) != 0 {
+		t.Fatalf("temp files left after a write: %v", left)
+	}
+}
+
+// deadPID returns the PID of a process that has exited and been reaped.
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestSweepKeepsLiveWritersTemps(t *testing.T) {
+	root := t.TempDir()
+	defer func() { roots = nil }()
+	dir := filepath.Join(root, ".tmp")
+	os.MkdirAll(dir, 0755)
+
+	// PID 1 stands in for another harvester that is still running.
+	live := "1"
+	if !processAlive(1) {
+		t.Skip("no PID 1 to stand in for a live writer")
+	}
+	for _, tc := range []struct {
+		name  string
+		age   time.Duration
+		swept bool
+	}{
+		{name: "1.json." + hostTag + "-" + strconv.Itoa(deadPID(t)) + ".11.tmp", swept: true},
+		{name: "2.json." + hostTag + "-" + live + ".22.tmp"},
+		{name: "3.json." + hostTag + "-" + live + ".33.tmp", age: 2 * StaleAge, swept: true},
+		{name: "4.json.otherhost-" + strconv.Itoa(deadPID(t)) + ".44.tmp"},
+		{name: "5.json.otherhost-7.55.tmp", age: 2 * StaleAge, swept: true},
+		{name: "6.json.123456.tmp"},
+		{name: "7.json.123456.tmp", age: 2 * StaleAge, swept: true},
+	} {
+		path := filepath.Join(dir, tc.name)
+		os.WriteFile(path, []byte("part"), 0644)
+		if tc.age > 0 {
+			old := time.Now().Add(-tc.age)
+			os.Chtimes(path, old, old)
+		}
+		defer func(name string, swept bool) {
+			_, err := os.Stat(filepath.Join(dir, name))
+			if gone := os.IsNotExist(err); gone != swept {
+				t.Errorf("%s: removed %v, want %v", name, gone, swept)
+			}
+		}(tc.name, tc.swept)
+	}
+	Sweep(root)
+}
+
+func TestTempOwner(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		host string
+		pid  int
+		ok   bool
+	}{
+		{name: "42.json.box_1-77.123456.tmp", host: "box_1", pid: 77, ok: true},
+		{name: "a.b.json.gz.h-9.1.tmp", host: "h", pid: 9, ok: true},
+		{name: "42.json.123456.tmp"},
+		{name: "42.json.h-x.1.tmp"},
+		{name: "42.json.h-9.1"},
+	} {
+		host, pid, ok := tempOwner(tc.name)
+		if host != tc.host || pid != tc.pid || ok != tc.ok {
+			t.Errorf("tempOwner(%q) = %q, %d, %v", tc.name, host, pid, ok)
+		}
+	}
+}
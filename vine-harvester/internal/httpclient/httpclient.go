@@ -0,0 +1,190 @@
+// httpclient.go
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Every harvester request goes through a client from New. Settings come from
+// the -httpConfig file with the HTTP flags applied on top (see Load). JSON
+// fetches and media downloads get separate timeouts, since a limit that suits
+// a post JSON kills a large MP4. Proxies come from the config or
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXY.
+
+// Config is the -httpConfig file; durations are Go duration strings ("10s",
+// "30m").
+type Config struct {
+	UserAgent           string   `json:"userAgent,omitempty"`
+	Contact             string   `json:"contact,omitempty"`
+	Proxy               string   `json:"proxy,omitempty"`
+	CABundle            string   `json:"caBundle,omitempty"`
+	MaxIdleConns        int      `json:"maxIdleConns,omitempty"`
+	MaxIdleConnsPerHost int      `json:"maxIdleConnsPerHost,omitempty"`
+	MaxConnsPerHost     int      `json:"maxConnsPerHost,omitempty"`
+	IdleConnTimeout     Duration `json:"idleConnTimeout,omitempty"`
+	JSON                Timeouts `json:"json"`
+	Media               Timeouts `json:"media"`
+}
+
+// Timeouts bound one kind of request.
+type Timeouts struct {
+	Connect Duration `json:"connect,omitempty"` // TCP connect and TLS handshake
+	Header  Duration `json:"header,omitempty"`  // waiting for response headers
+	Total   Duration `json:"total,omitempty"`   // whole request including the body (0 = none)
+}
+
+// Duration reads a Go duration string from JSON.
+type Duration struct{ time.Duration }
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// Defaults is the configuration before any file or flag.
+func Defaults() Config {
+	return Config{
+		MaxIdleConns:        200,
+		MaxIdleConnsPerHost: 200,
+		IdleConnTimeout:     Duration{90 * time.Second},
+		JSON:                Timeouts{Connect: Duration{10 * time.Second}, Header: Duration{15 * time.Second}, Total: Duration{30 * time.Second}},
+		Media:               Timeouts{Connect: Duration{10 * time.Second}, Header: Duration{30 * time.Second}, Total: Duration{30 * time.Minute}},
+	}
+}
+
+// Load reads the config file at path (none when empty) over the defaults,
+// then applies the HTTP flags of fs that were set on the command line:
+// -userAgent, -contact, -proxy, -caBundle, -jsonTimeout and -mediaTimeout.
+// A command defines only the ones it has.
+func Load(path string, fs *flag.FlagSet) (Config, error) {
+	cfg := Defaults()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if fs == nil {
+		return cfg, nil
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "userAgent":
+			cfg.UserAgent = f.Value.String()
+		case "contact":
+			cfg.Contact = f.Value.String()
+		case "proxy":
+			cfg.Proxy = f.Value.String()
+		case "caBundle":
+			cfg.CABundle = f.Value.String()
+		case "jsonTimeout":
+			cfg.JSON.Total.Duration = flagDuration(f)
+		case "mediaTimeout":
+			cfg.Media.Total.Duration = flagDuration(f)
+		}
+	})
+	return cfg, nil
+}
+
+func flagDuration(f *flag.Flag) time.Duration {
+	if g, ok := f.Value.(flag.Getter); ok {
+		if d, ok := g.Get().(time.Duration); ok {
+			return d
+		}
+	}
+	d, _ := time.ParseDuration(f.Value.String())
+	return d
+}
+
+// New builds a client with timeouts t; defaultUA is used when the config sets
+// no User-Agent.
+func New(cfg Config, t Timeouts, defaultUA string) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		pu, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+		proxy = http.ProxyURL(pu)
+	}
+
+	tlsConfig := &tls.Config{}
+	if cfg.CABundle != "" {
+		pem, err := os.ReadFile(cfg.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("caBundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("caBundle %s: no PEM certificates found", cfg.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	dialer := &net.Dialer{Timeout: t.Connect.Duration, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   t.Connect.Duration,
+		ResponseHeaderTimeout: t.Header.Duration,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout.Duration,
+		ForceAttemptHTTP2:     true,
+	}
+
+	ua := cfg.UserAgent
+	if ua == "" {
+		ua = defaultUA
+	}
+	if cfg.Contact != "" {
+		ua += " (+" + cfg.Contact + ")"
+	}
+	return &http.Client{
+		Timeout:   t.Total.Duration,
+		Transport: &headerTransport{base: transport, userAgent: ua, contact: cfg.Contact},
+	}, nil
+}
+
+// headerTransport stamps the configured User-Agent on every request, plus a
+// From header when the contact is an email address.
+type headerTransport struct {
+	base      http.RoundTripper
+	userAgent string
+	contact   string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	if strings.Contains(t.contact, "@") {
+		req.Header.Set("From", t.contact)
+	}
+	return t.base.RoundTrip(req)
+}
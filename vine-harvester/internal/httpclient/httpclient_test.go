@@ -0,0 +1,167 @@
+// httpclient_test.go
+package httpclient
+
+import (
+	"encoding/pem"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, c *http.Client, url string) (string, error) {
+	t.Helper()
+	resp, err := c.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return string(b), err
+}
+
+func TestNewUsesConfiguredProxy(t *testing.T) {
+	var host string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.URL.Host
+		io.WriteString(w, "via proxy")
+	}))
+	defer proxy.Close()
+
+	cfg := Defaults()
+	cfg.Proxy = proxy.URL
+	c, err := New(cfg, cfg.JSON, "Test/1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := get(t, c, "http://archive.vine.invalid/posts/1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "via proxy" || host != "archive.vine.invalid" {
+		t.Fatalf("got %q for host %q, want the proxy to answer for archive.vine.invalid", body, host)
+	}
+
+	cfg.Proxy = "://bad"
+	if _, err := New(cfg, cfg.JSON, "Test/1.0"); err == nil {
+		t.Fatal("unparseable proxy accepted")
+	}
+}
+
+func TestNewTrustsCABundle(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+
+	cfg := Defaults()
+	c, err := New(cfg, cfg.JSON, "Test/1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(t, c, srv.URL); err == nil {
+		t.Fatal("self-signed server trusted without a CA bundle")
+	}
+
+	cfg.CABundle = filepath.Join(dir, "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(cfg.CABundle, cert, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = New(cfg, cfg.JSON, "Test/1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := get(t, c, srv.URL); err != nil || body != "ok" {
+		t.Fatalf("with CA bundle: %q, %v", body, err)
+	}
+
+	for name, data := range map[string]string{"empty.pem": "", "junk.pem": "not a certificate"} {
+		cfg.CABundle = filepath.Join(dir, name)
+		os.WriteFile(cfg.CABundle, []byte(data), 0644)
+		if _, err := New(cfg, cfg.JSON, "Test/1.0"); err == nil {
+			t.Errorf("%s accepted as a CA bundle", name)
+		}
+	}
+	cfg.CABundle = filepath.Join(dir, "missing.pem")
+	if _, err := New(cfg, cfg.JSON, "Test/1.0"); err == nil {
+		t.Error("missing CA bundle accepted")
+	}
+}
+
+func TestNewSetsUserAgentAndContact(t *testing.T) {
+	var ua, from string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ua, from = r.Header.Get("User-Agent"), r.Header.Get("From")
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name, userAgent, contact string
+		wantUA, wantFrom         string
+	}{
+		{name: "default", wantUA: "Test/1.0"},
+		{name: "configured", userAgent: "Archiver/2.0", wantUA: "Archiver/2.0"},
+		{name: "contact URL", contact: "https://example.org/archive", wantUA: "Test/1.0 (+https://example.org/archive)"},
+		{name: "contact email", userAgent: "Archiver/2.0", contact: "ops@example.org", wantUA: "Archiver/2.0 (+ops@example.org)", wantFrom: "ops@example.org"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Defaults()
+			cfg.UserAgent, cfg.Contact = tc.userAgent, tc.contact
+			c, err := New(cfg, cfg.JSON, "Test/1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, _ := http.NewRequest("GET", srv.URL, nil)
+			req.Header.Set("User-Agent", "caller")
+			resp, err := c.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if ua != tc.wantUA || from != tc.wantFrom {
+				t.Fatalf("User-Agent %q, From %q; want %q, %q", ua, from, tc.wantUA, tc.wantFrom)
+			}
+			if req.Header.Get("User-Agent") != "caller" {
+				t.Fatal("caller's request was modified")
+			}
+		})
+	}
+}
+
+func TestLoadAppliesFileThenFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "http.json")
+	os.WriteFile(path, []byte(`{"userAgent":"File/1.0","contact":"ops@example.org","maxConnsPerHost":8,"json":{"connect":"2s","total":"45s"},"media":{"header":"1m"}}`), 0644)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("userAgent", "", "")
+	fs.String("proxy", "", "")
+	fs.Duration("jsonTimeout", 30*time.Second, "")
+	fs.Duration("mediaTimeout", 30*time.Minute, "")
+	if err := fs.Parse([]string{"-userAgent", "Flag/1.0", "-mediaTimeout", "5m"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Defaults()
+	want.UserAgent, want.Contact, want.MaxConnsPerHost = "Flag/1.0", "ops@example.org", 8
+	want.JSON.Connect.Duration, want.JSON.Total.Duration = 2*time.Second, 45*time.Second
+	want.Media.Header.Duration, want.Media.Total.Duration = time.Minute, 5*time.Minute
+	if cfg != want {
+		t.Fatalf("Load =\n%+v\nwant\n%+v", cfg, want)
+	}
+
+	if cfg, err := Load("", nil); err != nil || cfg != Defaults() {
+		t.Fatalf("Load with no file or flags = %+v, %v", cfg, err)
+	}
+	os.WriteFile(path, []byte(`{"json":{"total":"soon"}}`), 0644)
+	if _, err := Load(path, nil); err == nil {
+		t.Fatal("bad duration accepted")
+	}
+}
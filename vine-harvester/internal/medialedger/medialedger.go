@@ -0,0 +1,249 @@
+// medialedger.go
+package medialedger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"vine-harvester/internal/atomicfile"
+)
+
+// Every media URL moves through pending -> inflight -> done | failed | missing.
+// Transitions are appended to a journal (media_state.jsonl), so a later run
+// knows what is still owed: on Open the journal is replayed (last line per URL
+// wins) and compacted, and anything left pending or inflight by a crash is
+// treated as failed. Failed downloads are retried at the end of the run (see
+// Retry), and across runs until the ledger's attempt cap. A download error
+// wrapping ErrGone (a 403, 404 or 410 from the media host) marks the file
+// missing for good.
+
+const (
+	Pending  = "pending"
+	Inflight = "inflight"
+	Done     = "done"
+	Failed   = "failed"
+	Missing  = "missing"
+)
+
+// ErrGone is wrapped by download errors that retrying won't fix.
+var ErrGone = errors.New("media gone")
+
+// Entry is one journal line.
+type Entry struct {
+	URL      string `json:"url"`
+	State    string `json:"state"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+	At       string `json:"at"`
+}
+
+// Ledger tracks the media URLs of a run. It is safe for concurrent use.
+type Ledger struct {
+	maxAttempts int
+
+	mu sync.Mutex
+	m  map[string]*Entry
+	f  *os.File
+}
+
+// New returns an empty ledger that gives each URL up to maxAttempts downloads
+// across runs. Until Open it journals nothing.
+func New(maxAttempts int) *Ledger {
+	return &Ledger{maxAttempts: maxAttempts, m: make(map[string]*Entry)}
+}
+
+// Open replays and compacts the journal at path, then keeps it open for
+// appending.
+func (l *Ledger) Open(path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if data, err := os.ReadFile(path); err == nil {
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			var e Entry
+			if len(bytes.TrimSpace(line)) == 0 || json.Unmarshal(line, &e) != nil || e.URL == "" {
+				continue // a torn last line after a crash
+			}
+			if e.State == Pending || e.State == Inflight {
+				e.State = Failed
+				e.Error = "interrupted"
+			}
+			l.m[e.URL] = &e
+		}
+	}
+
+	urls := make([]string, 0, len(l.m))
+	for u := range l.m {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	var buf bytes.Buffer
+	for _, u := range urls {
+		line, _ := json.Marshal(l.m[u])
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if err := atomicfile.WriteBytes(path, buf.Bytes()); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.f = f
+	return nil
+}
+
+func (l *Ledger) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+}
+
+// set records a transition; l.mu must be held.
+func (l *Ledger) set(e *Entry, state string, err error) {
+	e.State = state
+	e.Error = ""
+	if err != nil {
+		e.Error = err.Error()
+	}
+	e.At = time.Now().UTC().Format(time.RFC3339)
+	if l.f == nil {
+		return
+	}
+	line, _ := json.Marshal(e)
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		log.Printf("Warning: media_state.jsonl: %v\n", err)
+	}
+}
+
+// Add notes a media URL we want, without downloading it yet.
+func (l *Ledger) Add(rawURL string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.m[rawURL]; !ok {
+		e := &Entry{URL: rawURL}
+		l.m[rawURL] = e
+		l.set(e, Pending, nil)
+	}
+}
+
+// Start moves rawURL to inflight. It returns false if there is nothing to do:
+// already done, known missing, being downloaded by another worker, or out of
+// attempts. A done entry is only trusted while present reports the file is
+// still there; one that was deleted since is downloaded again, with a fresh
+// count of attempts.
+func (l *Ledger) Start(rawURL string, present func() bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.m[rawURL]
+	if !ok {
+		e = &Entry{URL: rawURL}
+		l.m[rawURL] = e
+	}
+	switch {
+	case e.State == Done:
+		if present() {
+			return false
+		}
+		e.Attempts = 0
+	case e.State == Missing || e.State == Inflight:
+		return false
+	case e.State == Failed && e.Attempts >= l.maxAttempts:
+		return false
+	}
+	e.Attempts++
+	l.set(e, Inflight, nil)
+	return true
+}
+
+// Finish records the outcome of a download Start allowed.
+func (l *Ledger) Finish(rawURL string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.m[rawURL]
+	switch {
+	case err == nil:
+		l.set(e, Done, nil)
+	case errors.Is(err, ErrGone):
+		l.set(e, Missing, err)
+	default:
+		l.set(e, Failed, err)
+	}
+}
+
+// Retryable lists URLs that are pending, or failed with attempts left.
+func (l *Ledger) Retryable() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []string
+	for u, e := range l.m {
+		if e.State == Pending || (e.State == Failed && e.Attempts < l.maxAttempts) {
+			out = append(out, u)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Counts tallies entries by state; failures out of attempts count as missing.
+func (l *Ledger) Counts() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := make(map[string]int)
+	for _, e := range l.m {
+		if e.State == Failed && e.Attempts >= l.maxAttempts {
+			c[Missing]++
+			continue
+		}
+		c[e.State]++
+	}
+	return c
+}
+
+// Retry makes up to passes passes over media that is still owed (including
+// failures left by earlier runs), downloading with workers goroutines, then
+// reports what is permanently missing.
+func (l *Ledger) Retry(passes, workers int, download func(rawURL string) error) {
+	for pass := 1; pass <= passes; pass++ {
+		urls := l.Retryable()
+		if len(urls) == 0 {
+			break
+		}
+		log.Printf("=== Media retry pass %d: %d files ===\n", pass, len(urls))
+		time.Sleep(time.Duration(pass) * 5 * time.Second)
+
+		jobs := make(chan string, workers*2)
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for u := range jobs {
+					if err := download(u); err != nil {
+						log.Printf("media retry %s: %v\n", u, err)
+					}
+				}
+			}()
+		}
+		for _, u := range urls {
+			jobs <- u
+		}
+		close(jobs)
+		wg.Wait()
+	}
+
+	c := l.Counts()
+	log.Printf("Media: %d done, %d permanently missing, %d failed (will retry next run), %d pending\n",
+		c[Done], c[Missing], c[Failed], c[Pending])
+}
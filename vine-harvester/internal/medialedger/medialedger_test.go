@@ -0,0 +1,186 @@
+// medialedger_test.go
+package medialedger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	urlA = "https://vines.s3.amazonaws.com/v/videos/a.mp4"
+	urlB = "https://vines.s3.amazonaws.com/v/videos/b.mp4"
+	urlC = "https://vines.s3.amazonaws.com/v/thumbs/c.jpg"
+	urlD = "https://vines.s3.amazonaws.com/v/thumbs/d.jpg"
+)
+
+func present() bool { return true }
+
+// journal reads the states recorded at path, in order, as url=state/attempts.
+func journal(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			t.Fatalf("journal line %q: %v", line, err)
+		}
+		out = append(out, fmt.Sprintf("%s=%s/%d", filepath.Base(e.URL), e.State, e.Attempts))
+	}
+	return out
+}
+
+func TestLedgerPersistsTransitions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "media_state.jsonl")
+	l := New(3)
+	if err := l.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{urlA, urlB, urlC, urlD} {
+		l.Add(u)
+	}
+	l.Add(urlA) // already known: no new line
+
+	for _, u := range []string{urlA, urlB, urlC} {
+		if !l.Start(u, present) {
+			t.Fatalf("Start(%s) refused a pending URL", u)
+		}
+	}
+	if l.Start(urlA, present) {
+		t.Fatal("Start allowed a second download of an inflight URL")
+	}
+	l.Finish(urlA, nil)
+	l.Finish(urlB, errors.New("connection reset"))
+	l.Finish(urlC, fmt.Errorf("media HTTP 404: %w", ErrGone))
+	// urlD is still pending when the run stops.
+	l.Close()
+
+	want := []string{
+		"a.mp4=pending/0", "b.mp4=pending/0", "c.jpg=pending/0", "d.jpg=pending/0",
+		"a.mp4=inflight/1", "b.mp4=inflight/1", "c.jpg=inflight/1",
+		"a.mp4=done/1", "b.mp4=failed/1", "c.jpg=missing/1",
+	}
+	if got := journal(t, path); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("journal\n%v\nwant\n%v", got, want)
+	}
+
+	// A second run replays the journal, compacted to one line per URL in URL
+	// order. It owes the failed download and the one left pending (now failed
+	// with no attempt used), but not the done or missing ones.
+	l = New(3)
+	if err := l.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	want = []string{"c.jpg=missing/1", "d.jpg=failed/0", "a.mp4=done/1", "b.mp4=failed/1"}
+	if got := journal(t, path); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("compacted journal\n%v\nwant\n%v", got, want)
+	}
+	if got := l.Retryable(); fmt.Sprint(got) != fmt.Sprint([]string{urlD, urlB}) {
+		t.Fatalf("Retryable = %v", got)
+	}
+	if l.Start(urlA, present) || l.Start(urlC, present) {
+		t.Fatal("Start allowed a done or missing URL")
+	}
+	c := l.Counts()
+	if c[Done] != 1 || c[Failed] != 2 || c[Missing] != 1 || c[Pending] != 0 {
+		t.Fatalf("Counts = %v", c)
+	}
+}
+
+func TestLedgerTreatsInterruptedAsFailed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "media_state.jsonl")
+	l := New(3)
+	if err := l.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	l.Add(urlA)
+	l.Start(urlA, present)
+	l.Close() // crash mid-download
+	// and a torn last line
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"url":"` + urlB + `","sta`)
+	f.Close()
+
+	l = New(3)
+	if err := l.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if got := journal(t, path); fmt.Sprint(got) != "[a.mp4=failed/1]" {
+		t.Fatalf("journal after a crash = %v", got)
+	}
+	if got := l.Retryable(); fmt.Sprint(got) != fmt.Sprint([]string{urlA}) {
+		t.Fatalf("Retryable = %v", got)
+	}
+}
+
+func TestLedgerAttemptCap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "media_state.jsonl")
+	for run := 1; run <= 3; run++ {
+		l := New(2)
+		if err := l.Open(path); err != nil {
+			t.Fatal(err)
+		}
+		started := l.Start(urlA, present)
+		if want := run <= 2; started != want {
+			t.Fatalf("run %d: Start = %v, want %v", run, started, want)
+		}
+		if started {
+			l.Finish(urlA, errors.New("timeout"))
+		}
+		if run >= 2 {
+			if got := l.Retryable(); len(got) != 0 {
+				t.Fatalf("run %d: out of attempts but Retryable = %v", run, got)
+			}
+			if c := l.Counts(); c[Missing] != 1 || c[Failed] != 0 {
+				t.Fatalf("run %d: Counts = %v, want it counted missing", run, c)
+			}
+		}
+		l.Close()
+	}
+	if got := journal(t, path); fmt.Sprint(got) != "[a.mp4=failed/2]" {
+		t.Fatalf("journal = %v", got)
+	}
+}
+
+func TestLedgerRedownloadsDeletedDoneFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "media_state.jsonl")
+	l := New(2)
+	if err := l.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Start(urlA, present)
+	l.Finish(urlA, errors.New("timeout"))
+	l.Start(urlA, present)
+	l.Finish(urlA, nil)
+
+	stats := 0
+	gone := func() bool { stats++; return false }
+	if !l.Start(urlA, gone) {
+		t.Fatal("Start trusted done for a file that is gone")
+	}
+	if stats != 1 {
+		t.Fatalf("file checked %d times, want 1", stats)
+	}
+	// The earlier attempts do not count against the new download.
+	l.Finish(urlA, errors.New("timeout"))
+	if got := l.Retryable(); fmt.Sprint(got) != fmt.Sprint([]string{urlA}) {
+		t.Fatalf("Retryable = %v", got)
+	}
+
+	l.Start(urlB, present)
+	l.Finish(urlB, nil)
+	if l.Start(urlB, present) {
+		t.Fatal("Start redownloaded a done file that is present")
+	}
+}
@@ -0,0 +1,225 @@
+// s3store.go
+package s3store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// Path is either an S3 location or a local path.
+type Path struct {
+	Bucket string
+	Prefix string
+	Local  string
+	S3     bool
+}
+
+// ParsePath reads s3://bucket/prefix (the prefix gets a trailing slash) or a
+// local path.
+func ParsePath(p string) Path {
+	if strings.HasPrefix(p, "s3://") {
+		rest := strings.TrimPrefix(p, "s3://")
+		parts := strings.SplitN(rest, "/", 2)
+		bucket := parts[0]
+		prefix := ""
+		if len(parts) == 2 {
+			prefix = parts[1]
+		}
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return Path{
+			Bucket: bucket,
+			Prefix: prefix,
+			S3:     true,
+		}
+	}
+	return Path{
+		Local: p,
+		S3:    false,
+	}
+}
+
+// S3/R2 access is configured from the environment. Each setting accepts the
+// AWS/S3 name or the R2_* name the Node server and index builder use, so one
+// env file points every piece at the same bucket:
+//
+//	S3_ENDPOINT | R2_ENDPOINT | AWS_ENDPOINT_URL_S3 | AWS_ENDPOINT_URL
+//	    S3-compatible endpoint (R2: https://<account>.r2.cloudflarestorage.com);
+//	    unset means AWS S3 itself
+//	AWS_REGION | R2_REGION | AWS_DEFAULT_REGION
+//	    default: the profile's region, or "auto" with a custom endpoint
+//	AWS_ACCESS_KEY_ID + AWS_SECRET_ACCESS_KEY (+ AWS_SESSION_TOKEN)
+//	R2_ACCESS_KEY_ID + R2_SECRET_ACCESS_KEY
+//	    static keys; without them the standard chain is used (AWS_PROFILE and
+//	    the shared ~/.aws/config and credentials files, SSO, instance roles)
+//	S3_FORCE_PATH_STYLE | R2_FORCE_PATH_STYLE
+//	    true: https://endpoint/bucket/key, false: https://bucket.endpoint/key;
+//	    default true with a custom endpoint, false for AWS
+//	AWS_CA_BUNDLE | R2_CA_BUNDLE
+//	    PEM file with extra CA certificates to trust
+//	AWS_MAX_ATTEMPTS | R2_MAX_ATTEMPTS, AWS_RETRY_MODE | R2_RETRY_MODE
+//	    attempts per request (including the first) and standard|adaptive
+//	AWS_REQUEST_CHECKSUM_CALCULATION, AWS_RESPONSE_CHECKSUM_VALIDATION
+//	    when_supported|when_required; default when_required with a custom
+//	    endpoint, when_supported for AWS
+
+// Config is the S3 setup read from the environment.
+type Config struct {
+	Endpoint     string
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	PathStyle    bool
+	CABundle     string
+	MaxAttempts  int
+	RetryMode    aws.RetryMode
+}
+
+// FirstEnv returns the first of the named variables that is set.
+func FirstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// LoadConfig reads the S3 settings from the environment.
+func LoadConfig() (Config, error) {
+	c := Config{
+		Endpoint: FirstEnv("S3_ENDPOINT", "R2_ENDPOINT", "AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"),
+		Region:   FirstEnv("AWS_REGION", "R2_REGION", "AWS_DEFAULT_REGION"),
+		CABundle: FirstEnv("AWS_CA_BUNDLE", "R2_CA_BUNDLE"),
+	}
+	// Keys are taken as pairs so an id from one scheme never meets a secret
+	// from the other.
+	switch {
+	case os.Getenv("AWS_ACCESS_KEY_ID") != "":
+		c.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		c.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		c.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	case os.Getenv("R2_ACCESS_KEY_ID") != "":
+		c.AccessKey = os.Getenv("R2_ACCESS_KEY_ID")
+		c.SecretKey = os.Getenv("R2_SECRET_ACCESS_KEY")
+	}
+	if c.AccessKey != "" && c.SecretKey == "" {
+		return c, fmt.Errorf("access key %s is set without its secret access key", c.AccessKey)
+	}
+	if c.Region == "" && c.Endpoint != "" {
+		c.Region = "auto"
+	}
+
+	c.PathStyle = c.Endpoint != ""
+	if v := FirstEnv("S3_FORCE_PATH_STYLE", "R2_FORCE_PATH_STYLE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return c, fmt.Errorf("S3_FORCE_PATH_STYLE: %w", err)
+		}
+		c.PathStyle = b
+	}
+	if v := FirstEnv("AWS_MAX_ATTEMPTS", "R2_MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return c, fmt.Errorf("AWS_MAX_ATTEMPTS: want a positive number, got %q", v)
+		}
+		c.MaxAttempts = n
+	}
+	if v := FirstEnv("AWS_RETRY_MODE", "R2_RETRY_MODE"); v != "" {
+		mode, err := aws.ParseRetryMode(v)
+		if err != nil {
+			return c, fmt.Errorf("AWS_RETRY_MODE: %w", err)
+		}
+		c.RetryMode = mode
+	}
+	return c, nil
+}
+
+// NewClient builds an S3 client for Cloudflare R2, AWS S3 or any other
+// S3-compatible endpoint from the environment (see LoadConfig). A non-nil
+// httpClient carries the requests instead of the SDK's own; it must then
+// trust AWS_CA_BUNDLE itself.
+func NewClient(ctx context.Context, httpClient *http.Client) (*s3.Client, error) {
+	c, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []func(*config.LoadOptions) error
+	if c.Region != "" {
+		opts = append(opts, config.WithRegion(c.Region))
+	}
+	if c.AccessKey != "" {
+		opts = append(opts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(c.AccessKey, c.SecretKey, c.SessionToken),
+		))
+	}
+	if httpClient != nil {
+		opts = append(opts, config.WithHTTPClient(httpClient))
+	} else if c.CABundle != "" {
+		f, err := os.Open(c.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("CA bundle: %w", err)
+		}
+		defer f.Close()
+		opts = append(opts, config.WithCustomCABundle(f))
+	}
+	if c.MaxAttempts > 0 {
+		opts = append(opts, config.WithRetryMaxAttempts(c.MaxAttempts))
+	}
+	if c.RetryMode != "" {
+		opts = append(opts, config.WithRetryMode(c.RetryMode))
+	}
+	// S3-compatible stores do not all accept the flexible checksums the SDK
+	// sends by default (trailing aws-chunked CRC32 on uploads), so a custom
+	// endpoint only gets them where the API requires one.
+	if c.Endpoint != "" && os.Getenv("AWS_REQUEST_CHECKSUM_CALCULATION") == "" {
+		opts = append(opts, config.WithRequestChecksumCalculation(aws.RequestChecksumCalculationWhenRequired))
+	}
+	if c.Endpoint != "" && os.Getenv("AWS_RESPONSE_CHECKSUM_VALIDATION") == "" {
+		opts = append(opts, config.WithResponseChecksumValidation(aws.ResponseChecksumValidationWhenRequired))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS config: %w", err)
+	}
+	if cfg.Region == "" {
+		return nil, fmt.Errorf("no S3 region: set AWS_REGION (or R2_REGION), a profile region, or S3_ENDPOINT")
+	}
+
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if c.Endpoint != "" {
+			// A service-scoped endpoint: other AWS services the credential
+			// chain talks to (STS, SSO) keep their own.
+			o.BaseEndpoint = aws.String(c.Endpoint)
+		}
+		o.UsePathStyle = c.PathStyle
+	}), nil
+}
+
+// IsNotFound reports whether err is S3 saying the key does not exist.
+func IsNotFound(err error) bool {
+	var ae smithy.APIError
+	if !errors.As(err, &ae) {
+		return false
+	}
+	switch ae.ErrorCode() {
+	case "NoSuchKey", "NotFound":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+// s3store_test.go
+package s3store
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"vine-harvester/internal/s3store/s3test"
+)
+
+// s3Env is every variable LoadConfig and NewClient read.
+var s3Env = []string{
+	"S3_ENDPOINT", "R2_ENDPOINT", "AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL",
+	"AWS_REGION", "R2_REGION", "AWS_DEFAULT_REGION",
+	"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+	"R2_ACCESS_KEY_ID", "R2_SECRET_ACCESS_KEY",
+	"S3_FORCE_PATH_STYLE", "R2_FORCE_PATH_STYLE",
+	"AWS_CA_BUNDLE", "R2_CA_BUNDLE",
+	"AWS_MAX_ATTEMPTS", "R2_MAX_ATTEMPTS", "AWS_RETRY_MODE", "R2_RETRY_MODE",
+	"AWS_REQUEST_CHECKSUM_CALCULATION", "AWS_RESPONSE_CHECKSUM_VALIDATION",
+}
+
+func setEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for _, k := range s3Env {
+		t.Setenv(k, env[k])
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		env     map[string]string
+		want    Config
+		wantErr bool
+	}{
+		{
+			name: "AWS defaults",
+			env:  map[string]string{"AWS_REGION": "us-east-1"},
+			want: Config{Region: "us-east-1"},
+		},
+		{
+			name: "R2 names",
+			env: map[string]string{
+				"R2_ENDPOINT":      "https://acct.r2.cloudflarestorage.com",
+				"R2_ACCESS_KEY_ID": "r2id", "R2_SECRET_ACCESS_KEY": "r2secret",
+				"R2_MAX_ATTEMPTS": "5", "R2_RETRY_MODE": "adaptive",
+			},
+			want: Config{
+				Endpoint: "https://acct.r2.cloudflarestorage.com", Region: "auto",
+				AccessKey: "r2id", SecretKey: "r2secret", PathStyle: true,
+				MaxAttempts: 5, RetryMode: aws.RetryModeAdaptive,
+			},
+		},
+		{
+			name: "AWS pair wins over R2 pair",
+			env: map[string]string{
+				"S3_ENDPOINT": "http://minio:9000", "S3_FORCE_PATH_STYLE": "false",
+				"AWS_ACCESS_KEY_ID": "awsid", "AWS_SECRET_ACCESS_KEY": "awssecret", "AWS_SESSION_TOKEN": "tok",
+				"R2_ACCESS_KEY_ID": "r2id", "R2_SECRET_ACCESS_KEY": "r2secret",
+				"AWS_RETRY_MODE": "standard",
+			},
+			want: Config{
+				Endpoint: "http://minio:9000", Region: "auto",
+				AccessKey: "awsid", SecretKey: "awssecret", SessionToken: "tok",
+				RetryMode: aws.RetryModeStandard,
+			},
+		},
+		{
+			name:    "id without its own secret",
+			env:     map[string]string{"AWS_ACCESS_KEY_ID": "awsid", "R2_SECRET_ACCESS_KEY": "r2secret"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown retry mode",
+			env:     map[string]string{"AWS_RETRY_MODE": "eager"},
+			wantErr: true,
+		},
+		{
+			name:    "zero attempts",
+			env:     map[string]string{"AWS_MAX_ATTEMPTS": "0"},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setEnv(t, tc.env)
+			got, err := LoadConfig()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("LoadConfig() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tc.want {
+				t.Fatalf("LoadConfig() = %+v, %v\nwant %+v", got, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewClientUsesEndpoint(t *testing.T) {
+	setEnv(t, nil)
+	srv := s3test.NewServer(t)
+	t.Setenv("AWS_MAX_ATTEMPTS", "4")
+	t.Setenv("AWS_RETRY_MODE", "adaptive")
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := c.Options()
+	if aws.ToString(o.BaseEndpoint) != srv.URL || !o.UsePathStyle {
+		t.Errorf("endpoint %q, path style %v", aws.ToString(o.BaseEndpoint), o.UsePathStyle)
+	}
+	if o.RetryMaxAttempts != 4 || o.RetryMode != aws.RetryModeAdaptive {
+		t.Errorf("retries: %d attempts, mode %q", o.RetryMaxAttempts, o.RetryMode)
+	}
+	if o.RequestChecksumCalculation != aws.RequestChecksumCalculationWhenRequired {
+		t.Errorf("custom endpoint gets request checksums %v", o.RequestChecksumCalculation)
+	}
+
+	_, err = c.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("vines"),
+		Key:    aws.String("a/b.json"),
+		Body:   bytes.NewReader([]byte(`{}`)),
+	})
+	if err != nil {
+		t.Fatalf("PutObject: %v", err)
+	}
+	out, err := c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("vines"), Key: aws.String("a/b.json")})
+	if err != nil {
+		t.Fatalf("GetObject: %v", err)
+	}
+	data, _ := io.ReadAll(out.Body)
+	out.Body.Close()
+	if string(data) != `{}` {
+		t.Fatalf("GetObject = %q", data)
+	}
+	_, err = c.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("vines"), Key: aws.String("a/c.json")})
+	if !IsNotFound(err) {
+		t.Fatalf("HeadObject of a missing key = %v, want not found", err)
+	}
+	if n := srv.BadSignatures(); n != 0 {
+		t.Fatalf("%d requests were refused for their signature", n)
+	}
+}
+
+func TestNewClientKeepsChecksumSetting(t *testing.T) {
+	setEnv(t, nil)
+	s3test.NewServer(t)
+	t.Setenv("AWS_REQUEST_CHECKSUM_CALCULATION", "when_supported")
+
+	c, err := NewClient(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Options().RequestChecksumCalculation; got != aws.RequestChecksumCalculationWhenSupported {
+		t.Fatalf("request checksums = %v, want the env setting", got)
+	}
+}
@@ -0,0 +1,367 @@
+// s3test.go
+package s3test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// The credentials requests must be signed with.
+const (
+	AccessKey = "AKIDS3TEST"
+	SecretKey = "s3test-secret"
+)
+
+// Server is an in-memory S3 stand-in for tests. It checks the SigV4 signature
+// of every request, so a client that signs wrongly fails the way it would
+// against R2 or AWS. Objects are held as "<bucket>/<key>"; requests are
+// counted by operation (GET, HEAD, PUT, DELETE, List, DeleteObjects,
+// CreateMultipart, UploadPart, Complete, Abort).
+type Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	upSeq   int
+	ops     map[string]int
+	badSigs int
+}
+
+// NewServer starts a stand-in and points the S3 environment (see
+// s3store.LoadConfig) at it for the rest of the test.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	s := &Server{
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+		ops:     make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+
+	none := filepath.Join(t.TempDir(), "none")
+	for k, v := range map[string]string{
+		"S3_ENDPOINT":                 s.URL,
+		"AWS_REGION":                  "auto",
+		"AWS_ACCESS_KEY_ID":           AccessKey,
+		"AWS_SECRET_ACCESS_KEY":       SecretKey,
+		"AWS_SESSION_TOKEN":           "",
+		"AWS_CONFIG_FILE":             none,
+		"AWS_SHARED_CREDENTIALS_FILE": none,
+		"AWS_EC2_METADATA_DISABLED":   "true",
+		"AWS_MAX_ATTEMPTS":            "1",
+	} {
+		t.Setenv(k, v)
+	}
+	return s
+}
+
+// Put stores an object directly.
+func (s *Server) Put(bucket, key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[bucket+"/"+key] = append([]byte(nil), data...)
+}
+
+// Get returns a stored object.
+func (s *Server) Get(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[bucket+"/"+key]
+	return data, ok
+}
+
+// Keys lists the keys in bucket, sorted.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.objects {
+		if b, key, _ := strings.Cut(k, "/"); b == bucket {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Ops returns how many requests of an operation were served, and
+// ResetOps starts counting afresh.
+func (s *Server) Ops(op string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ops[op]
+}
+
+func (s *Server) ResetOps() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops = make(map[string]int)
+}
+
+// BadSignatures is the number of requests refused for their signature.
+func (s *Server) BadSignatures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.badSigs
+}
+
+var authRe = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=([^/]+)/(\d{8})/([^/]+)/s3/aws4_request, ?SignedHeaders=([^,]+), ?Signature=([0-9a-f]{64})$`)
+
+// verify re-signs the request with the headers it says it signed and
+// compares signatures.
+func verify(r *http.Request, body []byte) error {
+	m := authRe.FindStringSubmatch(r.Header.Get("Authorization"))
+	if m == nil {
+		return fmt.Errorf("malformed Authorization %q", r.Header.Get("Authorization"))
+	}
+	if m[1] != AccessKey {
+		return fmt.Errorf("unknown access key %s", m[1])
+	}
+	at, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return err
+	}
+	if d := time.Since(at); d > 15*time.Minute || d < -15*time.Minute {
+		return fmt.Errorf("request time %s too far off", at)
+	}
+	payload := r.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		return fmt.Errorf("no X-Amz-Content-Sha256")
+	}
+	if payload != "UNSIGNED-PAYLOAD" {
+		if sum := sha256Hex(body); sum != payload {
+			return fmt.Errorf("payload hash %s, body hashes to %s", payload, sum)
+		}
+	}
+
+	req, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	req.Host = r.Host
+	for _, h := range strings.Split(m[4], ";") {
+		switch h {
+		case "host":
+		case "content-length":
+			req.ContentLength = r.ContentLength
+		default:
+			req.Header[http.CanonicalHeaderKey(h)] = r.Header.Values(h)
+		}
+	}
+	signer := v4.NewSigner(func(o *v4.SignerOptions) { o.DisableURIPathEscaping = true })
+	creds := aws.Credentials{AccessKeyID: AccessKey, SecretAccessKey: SecretKey}
+	if err := signer.SignHTTP(context.Background(), creds, req, payload, "s3", m[3], at); err != nil {
+		return err
+	}
+	want := authRe.FindStringSubmatch(req.Header.Get("Authorization"))
+	if want == nil || want[5] != m[5] {
+		return fmt.Errorf("signature mismatch (signed headers %s)", m[4])
+	}
+	return nil
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func etag(b []byte) string {
+	sum := md5.Sum(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func fail(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if err := verify(r, body); err != nil {
+		s.mu.Lock()
+		s.badSigs++
+		s.mu.Unlock()
+		fail(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+
+	// Path-style only: /<bucket>/<key>.
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	q := r.URL.Query()
+	op := r.Method
+	switch {
+	case r.Method == "POST" && q.Has("uploads"):
+		op = "CreateMultipart"
+	case r.Method == "PUT" && q.Has("partNumber"):
+		op = "UploadPart"
+	case r.Method == "POST" && q.Has("uploadId"):
+		op = "Complete"
+	case r.Method == "DELETE" && q.Has("uploadId"):
+		op = "Abort"
+	case r.Method == "POST" && q.Has("delete"):
+		op = "DeleteObjects"
+	case r.Method == "GET" && key == "":
+		op = "List"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops[op]++
+	full := bucket + "/" + key
+	switch op {
+	case "HEAD", "GET":
+		data, ok := s.objects[full]
+		if !ok {
+			if op == "HEAD" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+		if rng := r.Header.Get("Range"); rng != "" && op == "GET" {
+			var from, to int
+			if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &from, &to); err != nil || from > to || to >= len(data) {
+				fail(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", from, to, len(data)))
+			w.Header().Set("Content-Length", strconv.Itoa(to-from+1))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[from : to+1])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if op == "GET" {
+			w.Write(data)
+		}
+	case "PUT":
+		s.objects[full] = body
+		w.Header().Set("ETag", etag(body))
+	case "DELETE":
+		delete(s.objects, full)
+		w.WriteHeader(http.StatusNoContent)
+	case "DeleteObjects":
+		var req struct {
+			Object []struct{ Key string }
+		}
+		xml.Unmarshal(body, &req)
+		for _, o := range req.Object {
+			delete(s.objects, bucket+"/"+o.Key)
+		}
+		fmt.Fprint(w, "<DeleteResult></DeleteResult>")
+	case "CreateMultipart":
+		s.upSeq++
+		id := fmt.Sprintf("upload-%d", s.upSeq)
+		s.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", bucket, key, id)
+	case "UploadPart":
+		up := s.uploads[q.Get("uploadId")]
+		if up == nil {
+			fail(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		up[n] = body
+		w.Header().Set("ETag", etag(body))
+	case "Complete":
+		up := s.uploads[q.Get("uploadId")]
+		if up == nil {
+			fail(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var req struct {
+			Part []struct {
+				PartNumber int
+				ETag       string
+			}
+		}
+		xml.Unmarshal(body, &req)
+		var buf bytes.Buffer
+		for i, p := range req.Part {
+			data := up[p.PartNumber]
+			if p.PartNumber != i+1 || etag(data) != p.ETag {
+				fail(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			if i < len(req.Part)-1 && len(data) < 5<<20 {
+				fail(w, http.StatusBadRequest, "EntityTooSmall")
+				return
+			}
+			buf.Write(data)
+		}
+		s.objects[full] = buf.Bytes()
+		delete(s.uploads, q.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case "Abort":
+		delete(s.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case "List":
+		s.list(w, bucket, q)
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, bucket string, q map[string][]string) {
+	get := func(k string) string {
+		if v := q[k]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	prefix := get("prefix")
+	max := 1000
+	if v := get("max-keys"); v != "" {
+		max, _ = strconv.Atoi(v)
+	}
+	after := get("continuation-token")
+	if after == "" {
+		after = get("start-after")
+	}
+	var keys []string
+	for k := range s.objects {
+		if b, key, _ := strings.Cut(k, "/"); b == bucket && strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	truncated := len(keys) > max
+	if truncated {
+		keys = keys[:max]
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "<ListBucketResult><Name>%s</Name><Prefix>%s</Prefix><KeyCount>%d</KeyCount><MaxKeys>%d</MaxKeys><IsTruncated>%v</IsTruncated>",
+		bucket, prefix, len(keys), max, truncated)
+	if truncated {
+		fmt.Fprintf(&b, "<NextContinuationToken>%s</NextContinuationToken>", keys[len(keys)-1])
+	}
+	for _, k := range keys {
+		data := s.objects[bucket+"/"+k]
+		var esc bytes.Buffer
+		xml.EscapeText(&esc, []byte(k))
+		fmt.Fprintf(&b, "<Contents><Key>%s</Key><Size>%d</Size><ETag>%s</ETag><LastModified>2016-01-01T00:00:00.000Z</LastModified></Contents>",
+			esc.String(), len(data), etag(data))
+	}
+	b.WriteString("</ListBucketResult>")
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, b.String())
+}
@@ -0,0 +1,344 @@
+// dedup.go
+package scan
+
+import (
+	"bufio"
+	"container/heap"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Set is a set of strings with bounded memory. Keys are held in sharded
+// in-memory maps until their estimated size passes the limit; then everything
+// in memory is sorted and written to a run file on disk. Iteration does a
+// k-way merge over the runs and what is still in memory, so output is always
+// sorted and duplicate-free regardless of how often the set spilled.
+//
+// Add is safe for concurrent use; iterate only once adding has finished. If a
+// spill fails the set stops taking keys: Add, Err and Iter all return that
+// error from then on.
+type Set struct {
+	shards   [dedupShardCount]dedupShard
+	memBytes atomic.Int64
+	limit    int64 // <= 0: never spill
+	tmpRoot  string
+
+	spillMu sync.Mutex
+	dir     string
+	runs    []string
+	err     error
+	failed  atomic.Bool // err is set; read without spillMu on the Add path
+}
+
+type dedupShard struct {
+	mu sync.Mutex
+	m  map[string]struct{}
+}
+
+const (
+	dedupShardCount = 64
+	// dedupEntryOverhead approximates the per-key cost of a map entry plus its
+	// string header, on top of the key bytes themselves.
+	dedupEntryOverhead = 64
+)
+
+// NewSet returns an empty set that spills to a directory under tmpRoot (the
+// system temp dir when empty) once it holds about limitBytes.
+func NewSet(tmpRoot string, limitBytes int64) *Set {
+	s := &Set{limit: limitBytes, tmpRoot: tmpRoot}
+	for i := range s.shards {
+		s.shards[i].m = make(map[string]struct{})
+	}
+	return s
+}
+
+func (s *Set) shard(key string) *dedupShard {
+	// FNV-1a; inlined to keep the hot path allocation-free.
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &s.shards[h%dedupShardCount]
+}
+
+// Add inserts key. It fails once a spill has failed, without holding on to
+// the key, so memory stays bounded.
+func (s *Set) Add(key string) error {
+	if s.failed.Load() {
+		return s.Err()
+	}
+	sh := s.shard(key)
+	sh.mu.Lock()
+	if _, ok := sh.m[key]; ok {
+		sh.mu.Unlock()
+		return nil
+	}
+	sh.m[key] = struct{}{}
+	sh.mu.Unlock()
+
+	if s.memBytes.Add(int64(len(key))+dedupEntryOverhead) > s.limit && s.limit > 0 {
+		return s.spill()
+	}
+	return nil
+}
+
+// Err returns the error of a failed spill, if any. Loops feeding workers that
+// Add check it to stop early.
+func (s *Set) Err() error {
+	if !s.failed.Load() {
+		return nil
+	}
+	s.spillMu.Lock()
+	defer s.spillMu.Unlock()
+	return s.err
+}
+
+// spill moves everything held in memory into a new sorted run file.
+func (s *Set) spill() error {
+	s.spillMu.Lock()
+	defer s.spillMu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.memBytes.Load() <= s.limit {
+		return nil // someone else just spilled
+	}
+
+	var keys []string
+	var freed int64
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		m := sh.m
+		sh.m = make(map[string]struct{})
+		sh.mu.Unlock()
+		for k := range m {
+			keys = append(keys, k)
+			freed += int64(len(k)) + dedupEntryOverhead
+		}
+	}
+	s.memBytes.Add(-freed)
+	sort.Strings(keys)
+
+	if s.dir == "" {
+		dir, err := os.MkdirTemp(s.tmpRoot, "vine-dedup-")
+		if err != nil {
+			return s.fail(err)
+		}
+		s.dir = dir
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("run-%06d.txt", len(s.runs)))
+	if err := writeRunFile(path, keys); err != nil {
+		return s.fail(err)
+	}
+	s.runs = append(s.runs, path)
+	log.Printf("dedup: spilled %d keys to %s", len(keys), path)
+	return nil
+}
+
+// fail records a spill error (spillMu held) and drops whatever is still in
+// memory: the set is incomplete now, and nothing more is buffered.
+func (s *Set) fail(err error) error {
+	s.err = fmt.Errorf("dedup spill: %w", err)
+	s.failed.Store(true)
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		sh.m = make(map[string]struct{})
+		sh.mu.Unlock()
+	}
+	s.memBytes.Store(0)
+	return s.err
+}
+
+func writeRunFile(path string, keys []string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, 1<<20)
+	for _, k := range keys {
+		w.WriteString(k)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Each calls fn for every key in ascending order. A non-nil error from fn stops
+// the iteration and is returned (ErrStop stops it silently).
+func (s *Set) Each(fn func(key string) error) error {
+	it, err := s.Iter()
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for it.Next() {
+		if err := fn(it.Key()); err != nil {
+			if err == ErrStop {
+				return nil
+			}
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// ErrStop can be returned from an Each callback to end the iteration early.
+var ErrStop = errors.New("stop iteration")
+
+// Count returns the number of distinct keys (a full merge pass once spilled).
+func (s *Set) Count() (int64, error) {
+	var n int64
+	err := s.Each(func(string) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// Close removes any run files.
+func (s *Set) Close() error {
+	s.spillMu.Lock()
+	defer s.spillMu.Unlock()
+	if s.dir == "" {
+		return nil
+	}
+	err := os.RemoveAll(s.dir)
+	s.dir, s.runs = "", nil
+	return err
+}
+
+// Iter merges the sorted runs and the in-memory keys.
+type Iter struct {
+	h     runHeap
+	files []*os.File
+	key   string
+	last  string
+	first bool
+	err   error
+}
+
+// Iter starts a merged pass over the set; Close the iterator when done.
+func (s *Set) Iter() (*Iter, error) {
+	s.spillMu.Lock()
+	defer s.spillMu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	var mem []string
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		for k := range sh.m {
+			mem = append(mem, k)
+		}
+		sh.mu.Unlock()
+	}
+	sort.Strings(mem)
+
+	it := &Iter{first: true}
+	if len(mem) > 0 {
+		it.h = append(it.h, &runCursor{mem: mem, key: mem[0], pos: 1})
+	}
+	for _, path := range s.runs {
+		f, err := os.Open(path)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.files = append(it.files, f)
+		c := &runCursor{sc: bufio.NewScanner(f)}
+		if c.advance() {
+			it.h = append(it.h, c)
+		} else if c.err != nil {
+			it.Close()
+			return nil, c.err
+		}
+	}
+	heap.Init(&it.h)
+	return it, nil
+}
+
+func (it *Iter) Next() bool {
+	for len(it.h) > 0 {
+		c := it.h[0]
+		k := c.key
+		if c.advance() {
+			heap.Fix(&it.h, 0)
+		} else {
+			if c.err != nil {
+				it.err = c.err
+				return false
+			}
+			heap.Pop(&it.h)
+		}
+		if !it.first && k == it.last {
+			continue
+		}
+		it.first = false
+		it.last, it.key = k, k
+		return true
+	}
+	return false
+}
+
+func (it *Iter) Key() string { return it.key }
+func (it *Iter) Err() error  { return it.err }
+
+func (it *Iter) Close() {
+	for _, f := range it.files {
+		f.Close()
+	}
+	it.files = nil
+}
+
+// runCursor reads one sorted run, either from disk or from a sorted slice.
+type runCursor struct {
+	sc  *bufio.Scanner
+	mem []string
+	pos int
+	key string
+	err error
+}
+
+func (c *runCursor) advance() bool {
+	if c.sc == nil {
+		if c.pos >= len(c.mem) {
+			return false
+		}
+		c.key = c.mem[c.pos]
+		c.pos++
+		return true
+	}
+	if !c.sc.Scan() {
+		c.err = c.sc.Err()
+		return false
+	}
+	c.key = c.sc.Text()
+	return true
+}
+
+type runHeap []*runCursor
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return h[i].key < h[j].key }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*runCursor)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
@@ -0,0 +1,173 @@
+// dedup_test.go
+package scan
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func collect(t *testing.T, s *Set) []string {
+	t.Helper()
+	var keys []string
+	if err := s.Each(func(k string) error {
+		keys = append(keys, k)
+		return nil
+	}); err != nil {
+		t.Fatalf("Each: %v", err)
+	}
+	return keys
+}
+
+func TestSetSpillsAndMergesRuns(t *testing.T) {
+	s := NewSet(t.TempDir(), 10*(dedupEntryOverhead+8))
+
+	want := make(map[string]bool)
+	// Every key is added three times, far apart, so its copies land in
+	// different runs and in memory.
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 500; i++ {
+			k := fmt.Sprintf("slug%04d", (i*7919+round)%500)
+			s.Add(k)
+			want[k] = true
+		}
+	}
+	if len(s.runs) < 2 {
+		t.Fatalf("expected several spilled runs, got %d", len(s.runs))
+	}
+
+	got := collect(t, s)
+	if len(got) != len(want) {
+		t.Fatalf("got %d keys, want %d", len(got), len(want))
+	}
+	if !sort.StringsAreSorted(got) {
+		t.Fatalf("keys not sorted: %v", got[:10])
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i] == got[i-1] {
+			t.Fatalf("duplicate key %q", got[i])
+		}
+	}
+	for _, k := range got {
+		if !want[k] {
+			t.Fatalf("unexpected key %q", k)
+		}
+	}
+
+	n, err := s.Count()
+	if err != nil || n != int64(len(want)) {
+		t.Fatalf("Count = %d, %v; want %d", n, err, len(want))
+	}
+
+	dir := s.dir
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("spill dir %s still exists after Close", dir)
+	}
+}
+
+func TestSetConcurrentAdd(t *testing.T) {
+	s := NewSet(t.TempDir(), 50*(dedupEntryOverhead+8))
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				s.Add(fmt.Sprintf("u%07d", (i+w*250)%3000))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	got := collect(t, s)
+	if len(got) != 3000 {
+		t.Fatalf("got %d keys, want 3000", len(got))
+	}
+	for i, k := range got {
+		if want := fmt.Sprintf("u%07d", i); k != want {
+			t.Fatalf("key %d = %q, want %q", i, k, want)
+		}
+	}
+}
+
+func TestSetWithoutLimitNeverSpills(t *testing.T) {
+	s := NewSet(t.TempDir(), 0)
+	defer s.Close()
+	for i := 0; i < 10000; i++ {
+		s.Add(fmt.Sprint(i))
+	}
+	if len(s.runs) != 0 || s.dir != "" {
+		t.Fatalf("set spilled without a limit: %d runs in %q", len(s.runs), s.dir)
+	}
+	if n, _ := s.Count(); n != 10000 {
+		t.Fatalf("Count = %d, want 10000", n)
+	}
+}
+
+func TestSetEachStop(t *testing.T) {
+	s := NewSet(t.TempDir(), 4*(dedupEntryOverhead+1))
+	defer s.Close()
+	for _, k := range []string{"e", "a", "d", "b", "c", "a", "f"} {
+		s.Add(k)
+	}
+
+	var seen []string
+	err := s.Each(func(k string) error {
+		if k == "c" {
+			return ErrStop
+		}
+		seen = append(seen, k)
+		return nil
+	})
+	if err != nil || fmt.Sprint(seen) != "[a b]" {
+		t.Fatalf("Each with ErrStop = %v, %v; want [a b], nil", seen, err)
+	}
+
+	boom := errors.New("boom")
+	if err := s.Each(func(string) error { return boom }); err != boom {
+		t.Fatalf("Each error = %v, want %v", err, boom)
+	}
+}
+
+func TestSetStopsBufferingAfterFailedSpill(t *testing.T) {
+	// A file where the spill directory should go makes every spill fail.
+	root := filepath.Join(t.TempDir(), "not-a-dir")
+	if err := os.WriteFile(root, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewSet(filepath.Join(root, "sub"), 10*(dedupEntryOverhead+8))
+	defer s.Close()
+
+	var addErr error
+	added := 0
+	for i := 0; i < 1000 && addErr == nil; i++ {
+		addErr = s.Add(fmt.Sprintf("slug%04d", i))
+		added++
+	}
+	if addErr == nil || added > 11 {
+		t.Fatalf("Add kept accepting keys: %d added, err %v", added, addErr)
+	}
+	if s.Err() == nil {
+		t.Fatal("Err is nil after a failed spill")
+	}
+	for i := 0; i < 1000; i++ {
+		if err := s.Add(fmt.Sprintf("more%04d", i)); err == nil {
+			t.Fatal("Add succeeded after a failed spill")
+		}
+	}
+	if n := s.memBytes.Load(); n != 0 {
+		t.Fatalf("%d bytes still buffered after a failed spill", n)
+	}
+	if _, err := s.Iter(); err == nil {
+		t.Fatal("Iter hides the failed spill")
+	}
+}
@@ -0,0 +1,269 @@
+// input.go
+package scan
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Tweet dumps usually ship as .gz/.bz2/.zst/.xz files or inside .zip/.tar(.gz)
+// archives. Compression is detected from magic bytes rather than the file name,
+// and nested wrappers (e.g. a .zip full of .txt.gz) are streamed through without
+// extracting anything to disk.
+
+var (
+	magicGzip  = []byte{0x1f, 0x8b}
+	magicBzip2 = []byte("BZh")
+	magicZstd  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicXz    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	magicZip   = []byte("PK\x03\x04")
+	magicZipE  = []byte("PK\x05\x06") // empty archive
+)
+
+const (
+	// maxArchiveDepth bounds how many wrappers we unwrap (guards against zip bombs
+	// that nest archives forever).
+	maxArchiveDepth = 8
+	// maxStagedZip caps how much of a zip found inside another stream we copy
+	// to disk; zip needs random access, so a nested one is staged whole.
+	maxStagedZip = 8 << 30
+)
+
+// TempDir is where zips found inside other streams are staged while they are
+// read ("" = the system temp dir). Staging on disk keeps memory flat however
+// many workers hit nested archives at once.
+var TempDir string
+
+// inputExts lists the file names worth opening as tweet dumps: the plain .txt
+// dumps, JSON/CSV exports, and every compressed/archived form of them.
+var inputExts = []string{".txt", ".json", ".jsonl", ".js", ".csv", ".tsv", ".gz", ".tgz", ".bz2", ".tbz2", ".zst", ".zstd", ".xz", ".txz", ".zip", ".tar"}
+
+// IsCandidate reports whether a file name looks like part of a tweet dump. The
+// actual format is sniffed from magic bytes once the file is opened.
+func IsCandidate(name string) bool {
+	lower := strings.ToLower(name)
+	for _, ext := range inputExts {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// SizedReaderAt is what archive/zip needs for random access (*io.SectionReader
+// satisfies it). Walk uses it for a top-level zip instead of buffering.
+type SizedReaderAt interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// MemberFunc receives one plain-text member of an input file.
+type MemberFunc func(member string, r io.Reader) error
+
+// WithProgress wraps fn so every member that came out of a compressed file or
+// an archive gets a progress line once it has been read.
+func WithProgress(top string, fn MemberFunc) MemberFunc {
+	return func(member string, r io.Reader) error {
+		cr := &CountingReader{R: r}
+		err := fn(member, cr)
+		if member != top {
+			log.Printf("  %s: %d bytes scanned", member, cr.N)
+		}
+		return err
+	}
+}
+
+// Walk sniffs r and unwraps compression and archive layers until it reaches
+// plain streams, calling fn once per leaf member. Errors in one archive member
+// are logged and do not stop the remaining members, but the archive as a
+// whole then reports an error, so callers never take it as fully read.
+func Walk(name string, r io.Reader, fn MemberFunc) error {
+	return walkInput(name, r, 0, fn)
+}
+
+// WalkFile opens a local file and walks it with progress lines for the
+// members of compressed files and archives.
+func WalkFile(path string, fn MemberFunc) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", path, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", path, err)
+	}
+	return Walk(path, io.NewSectionReader(f, 0, fi.Size()), WithProgress(path, fn))
+}
+
+func walkInput(name string, r io.Reader, depth int, fn MemberFunc) error {
+	if depth > maxArchiveDepth {
+		return fmt.Errorf("%s: archives nested deeper than %d levels", name, maxArchiveDepth)
+	}
+
+	br := bufio.NewReaderSize(r, 64*1024)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+
+	switch {
+	case bytes.HasPrefix(head, magicGzip):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("%s: gzip: %w", name, err)
+		}
+		defer zr.Close()
+		return walkInput(innerName(name), zr, depth+1, fn)
+
+	case bytes.HasPrefix(head, magicBzip2):
+		return walkInput(innerName(name), bzip2.NewReader(br), depth+1, fn)
+
+	case bytes.HasPrefix(head, magicZstd):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("%s: zstd: %w", name, err)
+		}
+		defer zr.Close()
+		return walkInput(innerName(name), zr, depth+1, fn)
+
+	case bytes.HasPrefix(head, magicXz):
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("%s: xz: %w", name, err)
+		}
+		return walkInput(innerName(name), xr, depth+1, fn)
+
+	case bytes.HasPrefix(head, magicZip) || bytes.HasPrefix(head, magicZipE):
+		ra, ok := r.(SizedReaderAt)
+		if !ok || depth > 0 {
+			f, size, err := stageZip(br)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+			ra = io.NewSectionReader(f, 0, size)
+		}
+		return walkZip(name, ra, depth, fn)
+
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return walkTar(name, br, depth, fn)
+
+	default:
+		return fn(name, br)
+	}
+}
+
+// stageZip copies a zip that has no random access of its own to a temp file.
+func stageZip(r io.Reader) (*os.File, int64, error) {
+	f, err := os.CreateTemp(TempDir, "vine-zip-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, maxStagedZip+1))
+	if err == nil && n > maxStagedZip {
+		err = fmt.Errorf("nested zip larger than %d bytes", int64(maxStagedZip))
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, err
+	}
+	return f, n, nil
+}
+
+func walkZip(name string, ra SizedReaderAt, depth int, fn MemberFunc) error {
+	zr, err := zip.NewReader(ra, ra.Size())
+	if err != nil {
+		return fmt.Errorf("%s: zip: %w", name, err)
+	}
+	failed := 0
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		member := name + ":" + zf.Name
+		rc, err := zf.Open()
+		if err == nil {
+			err = walkInput(member, rc, depth+1, fn)
+			rc.Close()
+		}
+		if err != nil {
+			log.Printf("%s: %v", member, err)
+			failed++
+		}
+	}
+	return membersFailed(name, failed)
+}
+
+func walkTar(name string, r io.Reader, depth int, fn MemberFunc) error {
+	tr := tar.NewReader(r)
+	failed := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return membersFailed(name, failed)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: tar: %w", name, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		member := name + ":" + hdr.Name
+		if err := walkInput(member, tr, depth+1, fn); err != nil {
+			log.Printf("%s: %v", member, err)
+			failed++
+		}
+	}
+}
+
+// membersFailed is an archive's result once every member has been tried.
+func membersFailed(name string, failed int) error {
+	if failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s: %d member(s) could not be read", name, failed)
+}
+
+// innerName strips one compression suffix so members read naturally in logs
+// ("dump.tar.gz" -> "dump.tar", "dump.tgz" -> "dump.tar").
+func innerName(name string) string {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".tgz", ".tbz2", ".txz"} {
+		if strings.HasSuffix(lower, ext) {
+			return name[:len(name)-len(ext)] + ".tar"
+		}
+	}
+	for _, ext := range []string{".gz", ".bz2", ".zst", ".zstd", ".xz"} {
+		if strings.HasSuffix(lower, ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return name
+}
+
+// CountingReader counts the bytes read through it.
+type CountingReader struct {
+	R io.Reader
+	N int64
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.R.Read(p)
+	c.N += int64(n)
+	return n, err
+}
@@ -0,0 +1,140 @@
+// input_test.go
+package scan
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zipBytes(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarBytes(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, data := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		tw.Write(data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// walkAll collects every leaf member Walk reports, by name.
+func walkAll(t *testing.T, name string, r io.Reader) (map[string]string, error) {
+	t.Helper()
+	got := make(map[string]string)
+	err := Walk(name, r, func(member string, r io.Reader) error {
+		b, err := io.ReadAll(r)
+		got[member] = string(b)
+		return err
+	})
+	return got, err
+}
+
+func TestWalkNestedArchives(t *testing.T) {
+	TempDir = t.TempDir()
+	defer func() { TempDir = "" }()
+
+	inner := zipBytes(t, map[string][]byte{"deep.txt": []byte("deep")})
+	outer := zipBytes(t, map[string][]byte{
+		"a.txt.gz":  gzipBytes(t, []byte("alpha")),
+		"b.txt":     []byte("bravo"),
+		"inner.zip": inner,
+	})
+	input := gzipBytes(t, tarBytes(t, map[string][]byte{"dump/outer.zip": outer}))
+
+	// A plain reader has no random access, so both zips must be staged.
+	got, err := walkAll(t, "dump.tgz", bytes.NewBuffer(input))
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	want := map[string]string{
+		"dump.tar:dump/outer.zip:a.txt":              "alpha",
+		"dump.tar:dump/outer.zip:b.txt":              "bravo",
+		"dump.tar:dump/outer.zip:inner.zip:deep.txt": "deep",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("members = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+
+	left, _ := os.ReadDir(TempDir)
+	if len(left) != 0 {
+		t.Fatalf("staged zips left behind: %v", left)
+	}
+}
+
+func TestWalkTopLevelZipUsesReaderAt(t *testing.T) {
+	// Staging into a missing directory fails, so this only passes if the zip
+	// is read in place.
+	TempDir = filepath.Join(t.TempDir(), "missing")
+	defer func() { TempDir = "" }()
+
+	data := zipBytes(t, map[string][]byte{"x.txt": []byte("x"), "y.txt": []byte("y")})
+	got, err := walkAll(t, "top.zip", io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	var names []string
+	for k := range got {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "top.zip:x.txt" || names[1] != "top.zip:y.txt" {
+		t.Fatalf("members = %v", names)
+	}
+}
+
+func TestWalkReportsFailedMembers(t *testing.T) {
+	corrupt := gzipBytes(t, []byte("lost"))
+	corrupt = corrupt[:len(corrupt)-6]
+	data := zipBytes(t, map[string][]byte{"good.txt": []byte("kept"), "bad.txt.gz": corrupt})
+
+	got, err := walkAll(t, "in.zip", io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	if err == nil {
+		t.Fatal("Walk succeeded with an unreadable member")
+	}
+	if got["in.zip:good.txt"] != "kept" {
+		t.Fatalf("readable member not walked: %v", got)
+	}
+}
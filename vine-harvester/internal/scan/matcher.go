@@ -0,0 +1,174 @@
+// matcher.go
+package scan
+
+import "bytes"
+
+// Matcher finds vine.co/v/<slug> URLs in a byte stream without splitting it
+// into lines, so a multi-megabyte minified line is no different from a short
+// one. Matches that straddle chunk boundaries are stitched back together.
+// It is an io.Writer: feed it with io.Copy.
+type Matcher struct {
+	// Emit is called for every slug; tweetID is the leading numeric field of
+	// the line the URL was on, if it had one.
+	Emit func(slug, tweetID string)
+
+	Bytes   int64 // bytes consumed
+	Matches int64 // URLs found
+
+	buf      []byte // carry + current chunk
+	carry    []byte // tail of the previous chunk that may begin a URL
+	slug     []byte // slug still being read when the previous chunk ended
+	slugLen  int    // its full length; only the first maxSlugLen bytes are kept
+	inSlug   bool
+	lineHead []byte // first bytes of the current line, for the tweet ID
+}
+
+var vineURLPrefix = []byte("vine.co/v/")
+
+const (
+	maxSlugLen  = 64 // real slugs are 11 chars; anything longer is noise
+	lineHeadLen = 32 // enough for a numeric tweet ID and a separator
+)
+
+func (m *Matcher) Write(p []byte) (int, error) {
+	m.Bytes += int64(len(p))
+
+	start := 0
+	if m.inSlug {
+		n := alnumPrefix(p)
+		m.growSlug(p[:n])
+		m.saveLineHead(p[:n], 0)
+		if n == len(p) {
+			return len(p), nil
+		}
+		m.finishSlug(m.lineHead)
+		start = n
+	}
+
+	m.buf = append(append(m.buf[:0], m.carry...), p[start:]...)
+	buf := m.buf
+	carried := len(m.carry)
+	m.carry = m.carry[:0]
+
+	pos := 0
+	for {
+		i := bytes.Index(buf[pos:], vineURLPrefix)
+		if i < 0 {
+			break
+		}
+		at := pos + i
+		slugStart := at + len(vineURLPrefix)
+		n := alnumPrefix(buf[slugStart:])
+		head := m.headAt(buf, at, carried)
+		m.slug, m.slugLen = m.slug[:0], 0
+		m.growSlug(buf[slugStart : slugStart+n])
+		if slugStart+n == len(buf) {
+			// The slug may continue in the next chunk.
+			m.inSlug = true
+			m.saveLineHead(buf, carried)
+			return len(p), nil
+		}
+		m.finishSlug(head)
+		pos = slugStart + n
+	}
+
+	// Keep just enough of the tail to catch a prefix split across chunks.
+	tail := len(vineURLPrefix) - 1
+	if rest := len(buf) - pos; rest < tail {
+		tail = rest
+	}
+	m.carry = append(m.carry, buf[len(buf)-tail:]...)
+	m.saveLineHead(buf, carried)
+	return len(p), nil
+}
+
+// Flush emits a slug that ran up to the very end of the stream.
+func (m *Matcher) Flush() {
+	if m.inSlug {
+		m.finishSlug(m.lineHead)
+	}
+	m.carry = m.carry[:0]
+}
+
+// growSlug extends the slug being read. Past maxSlugLen it is already noise
+// (a base64 or minified blob after the prefix), so only its length is kept
+// and the buffer stops growing.
+func (m *Matcher) growSlug(b []byte) {
+	m.slugLen += len(b)
+	if room := maxSlugLen - len(m.slug); room > 0 {
+		if room > len(b) {
+			room = len(b)
+		}
+		m.slug = append(m.slug, b[:room]...)
+	}
+}
+
+func (m *Matcher) finishSlug(head []byte) {
+	m.inSlug = false
+	if m.slugLen == 0 || m.slugLen > maxSlugLen {
+		return
+	}
+	m.Matches++
+	if m.Emit != nil {
+		m.Emit(string(m.slug), leadingTweetID(head))
+	}
+}
+
+// headAt returns the start of the line containing buf[at], falling back to the
+// head saved from earlier chunks when the line began before this one.
+func (m *Matcher) headAt(buf []byte, at, carried int) []byte {
+	if nl := bytes.LastIndexByte(buf[:at], '\n'); nl >= 0 {
+		return clampHead(buf[nl+1:])
+	}
+	if len(m.lineHead) >= lineHeadLen || carried >= at {
+		return m.lineHead
+	}
+	return clampHead(append(append([]byte(nil), m.lineHead...), buf[carried:at]...))
+}
+
+// saveLineHead remembers the beginning of the line the chunk ended on.
+func (m *Matcher) saveLineHead(buf []byte, carried int) {
+	fresh := buf[carried:]
+	if nl := bytes.LastIndexByte(fresh, '\n'); nl >= 0 {
+		m.lineHead = append(m.lineHead[:0], clampHead(fresh[nl+1:])...)
+		return
+	}
+	if room := lineHeadLen - len(m.lineHead); room > 0 {
+		if room > len(fresh) {
+			room = len(fresh)
+		}
+		m.lineHead = append(m.lineHead, fresh[:room]...)
+	}
+}
+
+func clampHead(b []byte) []byte {
+	if len(b) > lineHeadLen {
+		return b[:lineHeadLen]
+	}
+	return b
+}
+
+func alnumPrefix(b []byte) int {
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return i
+		}
+	}
+	return len(b)
+}
+
+// leadingTweetID returns the first whitespace-separated field of a line when it
+// is all digits (the Vine-Tweets dumps start each line with the tweet ID).
+func leadingTweetID(head []byte) string {
+	head = bytes.TrimLeft(head, " \t\r")
+	end := bytes.IndexAny(head, " \t")
+	if end <= 0 {
+		return ""
+	}
+	for _, c := range head[:end] {
+		if c < '0' || c > '9' {
+			return ""
+		}
+	}
+	return string(head[:end])
+}
@@ -0,0 +1,63 @@
+// matcher_test.go
+package scan
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMatcherAcrossChunkBoundaries(t *testing.T) {
+	input := "123 http://vine.co/v/abcDEF123 x\n" +
+		"456\thttps://vine.co/v/Zz9 and vine.co/v/ second\n" +
+		strings.Repeat("y", 100) + " vine.co/v/tail"
+
+	want := "[abcDEF123/123 Zz9/456 tail/]"
+	// Feeding one byte at a time splits every prefix, slug and line head.
+	for _, chunk := range []int{1, 3, 7, len(input)} {
+		var got []string
+		m := &Matcher{Emit: func(slug, tweetID string) {
+			got = append(got, slug+"/"+tweetID)
+		}}
+		for i := 0; i < len(input); i += chunk {
+			end := i + chunk
+			if end > len(input) {
+				end = len(input)
+			}
+			m.Write([]byte(input[i:end]))
+		}
+		m.Flush()
+		if fmt.Sprint(got) != want {
+			t.Errorf("chunk %d: got %v, want %s", chunk, got, want)
+		}
+		if m.Bytes != int64(len(input)) || m.Matches != 3 {
+			t.Errorf("chunk %d: Bytes=%d Matches=%d", chunk, m.Bytes, m.Matches)
+		}
+	}
+}
+
+func TestMatcherDropsOverlongSlugs(t *testing.T) {
+	blob := strings.Repeat("QUJD", 1<<18) // 1 MiB of base64 after the prefix
+	input := "1 vine.co/v/" + blob + " vine.co/v/ok1\n"
+
+	for _, chunk := range []int{5, 4096, len(input)} {
+		var got []string
+		m := &Matcher{Emit: func(slug, tweetID string) {
+			got = append(got, slug+"/"+tweetID)
+		}}
+		for i := 0; i < len(input); i += chunk {
+			end := i + chunk
+			if end > len(input) {
+				end = len(input)
+			}
+			m.Write([]byte(input[i:end]))
+			if cap(m.slug) > 2*maxSlugLen {
+				t.Fatalf("chunk %d: slug buffer grew to %d bytes", chunk, cap(m.slug))
+			}
+		}
+		m.Flush()
+		if fmt.Sprint(got) != "[ok1/1]" {
+			t.Errorf("chunk %d: got %v", chunk, got)
+		}
+	}
+}
@@ -0,0 +1,505 @@
+// tweets.go
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// regex to extract vine.co/v/<id> slugs
+var vineURLRe = regexp.MustCompile(`vine\.co\/v\/([A-Za-z0-9]+)`)
+
+// Source records where a slug was seen, so we can later explain why a Vine
+// is in the archive and when it was shared.
+type Source struct {
+	Slug       string `json:"slug"`
+	TweetID    string `json:"tweet_id,omitempty"`
+	Author     string `json:"author,omitempty"`
+	AuthorID   string `json:"author_id,omitempty"`
+	CreatedAt  string `json:"created_at,omitempty"`
+	SourceFile string `json:"source_file"`
+}
+
+// SourceLog appends Source records as JSON lines. It is safe for
+// concurrent use, and a nil *SourceLog discards everything.
+type SourceLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+	n   int64
+}
+
+// OpenSourceLog creates (or truncates) the JSONL file at path.
+func OpenSourceLog(path string) (*SourceLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriterSize(f, 256*1024)
+	return &SourceLog{f: f, w: w, enc: json.NewEncoder(w)}, nil
+}
+
+func (l *SourceLog) Record(s Source) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(s); err != nil {
+		log.Printf("slug sources: %v", err)
+		return
+	}
+	l.n++
+}
+
+// Count returns how many records have been written.
+func (l *SourceLog) Count() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.n
+}
+
+func (l *SourceLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.w.Flush(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+type dumpFormat int
+
+const (
+	formatText     dumpFormat = iota
+	formatJSON                // Twitter API v1.1/v2 JSON, a JSON array, or JSONL
+	formatTweetsJS            // Twitter archive tweets.js ("window.YTD.tweets.part0 = [...]")
+	formatCSV
+	formatTSV
+)
+
+func sniffDumpFormat(member string, head []byte) dumpFormat {
+	trimmed := bytes.TrimLeft(head, " \t\r\n\xef\xbb\xbf")
+	lower := strings.ToLower(member)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("window.YTD.")):
+		return formatTweetsJS
+	case len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '['):
+		return formatJSON
+	case strings.HasSuffix(lower, ".csv"):
+		return formatCSV
+	case strings.HasSuffix(lower, ".tsv"):
+		return formatTSV
+	default:
+		return formatText
+	}
+}
+
+// ParseDump reads one member of the tweet corpus and calls emit for every
+// Vine slug it finds, with as much provenance as the format carries.
+func ParseDump(member string, r io.Reader, emit func(Source)) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	head, _ := br.Peek(4096)
+
+	switch sniffDumpFormat(member, head) {
+	case formatTweetsJS:
+		// Drop the "window.YTD.tweets.part0 =" assignment; the rest is JSON.
+		if _, err := br.ReadString('='); err != nil {
+			return err
+		}
+		return decodeTweetJSON(member, br, emit)
+	case formatJSON:
+		return decodeTweetJSON(member, br, emit)
+	case formatCSV:
+		return scanTweetCSV(member, br, ',', emit)
+	case formatTSV:
+		return scanTweetCSV(member, br, '\t', emit)
+	default:
+		return scanTweetText(member, br, emit)
+	}
+}
+
+// decodeTweetJSON handles a top-level array of tweets, a single API response,
+// or a stream of concatenated / newline-delimited objects. Each value (or
+// array element) is read as a json.RawMessage on its own, so one malformed
+// record costs only the line it is on.
+func decodeTweetJSON(member string, r *bufio.Reader, emit func(Source)) error {
+	dec := json.NewDecoder(r)
+	inArray := false
+	if first, err := peekNonSpace(r); err == nil && first == '[' {
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		inArray = true
+	}
+
+	pending := bytes.NewReader(nil)
+	for {
+		var raw json.RawMessage
+		var err error
+		if inArray && !dec.More() {
+			// The closing bracket (or the end of a truncated array). Anything
+			// after it is read as further top-level values.
+			if _, err = dec.Token(); err == nil {
+				inArray = false
+				continue
+			}
+		} else {
+			err = dec.Decode(&raw)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		var syntaxErr *json.SyntaxError
+		if err != nil && !errors.As(err, &syntaxErr) && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if err == nil {
+			var v interface{}
+			vd := json.NewDecoder(bytes.NewReader(raw))
+			vd.UseNumber()
+			if vd.Decode(&v) == nil {
+				handleTweetValue(member, v, emit)
+			}
+			continue
+		}
+
+		// One bad record must not cost the rest of the member: drop the line
+		// it is on (still taking any Vine URLs in it, as the plain scanner
+		// would) and resume with a fresh decoder on the next line.
+		line, rest, rerr := skipLine(dec, pending, r)
+		log.Printf("%s: skipping malformed JSON line (%v): %.200s", member, err, line)
+		for _, slug := range slugsInText(line) {
+			emit(Source{Slug: slug, SourceFile: member})
+		}
+		if rerr == io.EOF {
+			return nil
+		}
+		if rerr != nil {
+			return rerr
+		}
+		pending = bytes.NewReader(rest)
+		if !inArray {
+			dec = json.NewDecoder(io.MultiReader(pending, r))
+			continue
+		}
+		// Inside an array the new decoder is given an opening bracket of its
+		// own, so it expects elements and the separating commas again.
+		dec = json.NewDecoder(io.MultiReader(strings.NewReader("["), pending, r))
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	}
+}
+
+// skipLine returns the line a failed Decode stopped on and whatever the
+// decoder had already buffered past it. The decoder reads from pending (data
+// buffered by an earlier decoder) and then r.
+func skipLine(dec *json.Decoder, pending *bytes.Reader, r *bufio.Reader) (string, []byte, error) {
+	buffered, err := io.ReadAll(io.MultiReader(dec.Buffered(), pending))
+	if err != nil {
+		return "", nil, err
+	}
+	// The failed value starts after the whitespace (and, in an array, the
+	// comma) that ended the last one.
+	buffered = bytes.TrimLeft(buffered, " \t\r\n,")
+	if i := bytes.IndexByte(buffered, '\n'); i >= 0 {
+		return string(buffered[:i]), buffered[i+1:], nil
+	}
+	tail, err := r.ReadString('\n')
+	return string(buffered) + strings.TrimRight(tail, "\r\n"), nil, err
+}
+
+func peekNonSpace(r *bufio.Reader) (byte, error) {
+	for n := 1; ; n++ {
+		b, err := r.Peek(n)
+		if len(b) < n {
+			return 0, err
+		}
+		c := b[n-1]
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return c, nil
+		}
+	}
+}
+
+func handleTweetValue(member string, v interface{}, emit func(Source)) {
+	switch t := v.(type) {
+	case []interface{}:
+		for _, item := range t {
+			handleTweetValue(member, item, emit)
+		}
+	case map[string]interface{}:
+		// v2 response envelope: {"data": ..., "includes": {"users": [...], "tweets": [...]}}
+		if data, ok := t["data"]; ok {
+			users := make(map[string]string)
+			includes, _ := t["includes"].(map[string]interface{})
+			if us, ok := includes["users"].([]interface{}); ok {
+				for _, u := range us {
+					if um, ok := u.(map[string]interface{}); ok {
+						users[JSONString(um["id"])] = JSONString(um["username"])
+					}
+				}
+			}
+			var tweets []interface{}
+			switch d := data.(type) {
+			case []interface{}:
+				tweets = d
+			case map[string]interface{}:
+				tweets = []interface{}{d}
+			}
+			if inc, ok := includes["tweets"].([]interface{}); ok {
+				tweets = append(tweets, inc...)
+			}
+			for _, tw := range tweets {
+				if tm, ok := tw.(map[string]interface{}); ok {
+					emitTweet(member, tm, users, emit)
+				}
+			}
+			return
+		}
+		// Twitter archive entries wrap each tweet: {"tweet": {...}}
+		if tw, ok := t["tweet"].(map[string]interface{}); ok {
+			emitTweet(member, tw, nil, emit)
+			return
+		}
+		if looksLikeTweet(t) {
+			emitTweet(member, t, nil, emit)
+			return
+		}
+		// Unknown shape: still find every URL, just without provenance.
+		seen := make(map[string]struct{})
+		walkJSONStrings(t, func(s string) {
+			for _, slug := range slugsInText(s) {
+				if _, ok := seen[slug]; !ok {
+					seen[slug] = struct{}{}
+					emit(Source{Slug: slug, SourceFile: member})
+				}
+			}
+		})
+	}
+}
+
+func looksLikeTweet(t map[string]interface{}) bool {
+	for _, k := range []string{"id_str", "text", "full_text", "entities", "created_at"} {
+		if _, ok := t[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func walkJSONStrings(v interface{}, fn func(string)) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for _, vv := range t {
+			walkJSONStrings(vv, fn)
+		}
+	case []interface{}:
+		for _, vv := range t {
+			walkJSONStrings(vv, fn)
+		}
+	case string:
+		fn(t)
+	}
+}
+
+// emitTweet pulls slugs from a single v1.1 or v2 tweet object: expanded URLs
+// from the entities first, then the raw text as a fallback. Retweeted and
+// quoted tweets are reported as tweets of their own.
+func emitTweet(member string, t map[string]interface{}, users map[string]string, emit func(Source)) {
+	src := Source{SourceFile: member}
+	src.TweetID = JSONString(t["id_str"])
+	if src.TweetID == "" {
+		src.TweetID = JSONString(t["id"])
+	}
+	src.CreatedAt = JSONString(t["created_at"])
+	if u, ok := t["user"].(map[string]interface{}); ok {
+		src.Author = JSONString(u["screen_name"])
+		src.AuthorID = JSONString(u["id_str"])
+		if src.AuthorID == "" {
+			src.AuthorID = JSONString(u["id"])
+		}
+	} else if aid := JSONString(t["author_id"]); aid != "" {
+		src.AuthorID = aid
+		src.Author = users[aid]
+	}
+
+	seen := make(map[string]struct{})
+	add := func(s string) {
+		for _, slug := range slugsInText(s) {
+			if _, ok := seen[slug]; ok {
+				continue
+			}
+			seen[slug] = struct{}{}
+			rec := src
+			rec.Slug = slug
+			emit(rec)
+		}
+	}
+
+	entitySets := []interface{}{t["entities"], t["extended_entities"]}
+	if ext, ok := t["extended_tweet"].(map[string]interface{}); ok {
+		entitySets = append(entitySets, ext["entities"])
+		add(JSONString(ext["full_text"]))
+	}
+	for _, es := range entitySets {
+		em, ok := es.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		urls, _ := em["urls"].([]interface{})
+		for _, u := range urls {
+			if um, ok := u.(map[string]interface{}); ok {
+				add(JSONString(um["expanded_url"]))
+				add(JSONString(um["unwound_url"]))
+			}
+		}
+	}
+	add(JSONString(t["full_text"]))
+	add(JSONString(t["text"]))
+
+	for _, k := range []string{"retweeted_status", "quoted_status"} {
+		if inner, ok := t[k].(map[string]interface{}); ok {
+			emitTweet(member, inner, users, emit)
+		}
+	}
+}
+
+// scanTweetCSV reads CSV/TSV exports with a header row. Every cell is searched
+// for Vine URLs; the id/author/date columns, when present, give provenance.
+func scanTweetCSV(member string, r io.Reader, comma rune, emit func(Source)) error {
+	cr := csv.NewReader(r)
+	cr.Comma = comma
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	col := func(names ...string) int {
+		for _, n := range names {
+			for i, h := range header {
+				if strings.EqualFold(strings.TrimSpace(h), n) {
+					return i
+				}
+			}
+		}
+		return -1
+	}
+	idCol := col("id_str", "tweet_id", "id")
+	authorCol := col("screen_name", "username", "user_screen_name", "author", "user")
+	timeCol := col("created_at", "timestamp", "date", "time")
+
+	cell := func(rec []string, i int) string {
+		if i < 0 || i >= len(rec) {
+			return ""
+		}
+		return strings.TrimSpace(rec[i])
+	}
+	handle := func(rec []string) {
+		src := Source{
+			TweetID:    cell(rec, idCol),
+			Author:     cell(rec, authorCol),
+			CreatedAt:  cell(rec, timeCol),
+			SourceFile: member,
+		}
+		seen := make(map[string]struct{})
+		for _, c := range rec {
+			for _, slug := range slugsInText(c) {
+				if _, ok := seen[slug]; ok {
+					continue
+				}
+				seen[slug] = struct{}{}
+				out := src
+				out.Slug = slug
+				emit(out)
+			}
+		}
+	}
+
+	// No recognizable columns: the first row is data, not a header.
+	if idCol < 0 && authorCol < 0 && timeCol < 0 {
+		handle(header)
+	}
+
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			var perr *csv.ParseError
+			if errors.As(err, &perr) {
+				continue
+			}
+			return err
+		}
+		handle(rec)
+	}
+}
+
+// scanTweetText handles the plain Vine-Tweets text dumps: one tweet per line,
+// usually "<tweetId> <url> ...". Any Vine URL on the line counts. The stream is
+// matched in chunks, so line length does not matter.
+func scanTweetText(member string, r io.Reader, emit func(Source)) error {
+	m := &Matcher{Emit: func(slug, tweetID string) {
+		emit(Source{Slug: slug, TweetID: tweetID, SourceFile: member})
+	}}
+	_, err := io.Copy(m, r)
+	m.Flush()
+	return err
+}
+
+func slugsInText(s string) []string {
+	if !strings.Contains(s, "vine.co") {
+		return nil
+	}
+	var out []string
+	for _, m := range vineURLRe.FindAllStringSubmatch(s, -1) {
+		if len(m) >= 2 && m[1] != "" {
+			out = append(out, m[1])
+		}
+	}
+	return out
+}
+
+// JSONString renders a decoded JSON string or number (IDs come as either).
+func JSONString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	case float64:
+		return fmt.Sprintf("%.0f", t)
+	default:
+		return ""
+	}
+}
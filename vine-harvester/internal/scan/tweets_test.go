@@ -0,0 +1,111 @@
+// tweets_test.go
+package scan
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func parse(t *testing.T, member, input string) []string {
+	t.Helper()
+	var got []string
+	err := ParseDump(member, strings.NewReader(input), func(s Source) {
+		got = append(got, s.Slug+"/"+s.TweetID)
+	})
+	if err != nil {
+		t.Fatalf("ParseDump: %v", err)
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestParseDumpSkipsMalformedJSONLines(t *testing.T) {
+	input := `{"id_str":"1","text":"https://vine.co/v/aaa"}
+{"id_str":"2","text":"https://vine.co/v/bbb"   broken
+{"id_str":"3","text":"https://vine.co/v/ccc"}
+not json at all vine.co/v/ddd
+{"id_str":"4","entities":{"urls":[{"expanded_url":"https://vine.co/v/eee"}]}}
+{"id_str":"5","text":"https://vine.co/v/fff"`
+
+	got := parse(t, "tweets.jsonl", input)
+	// The broken lines keep their URLs, without the provenance JSON would
+	// have given them.
+	want := "[aaa/1 bbb/ ccc/3 ddd/ eee/4 fff/]"
+	if fmt.Sprint(got) != want {
+		t.Fatalf("got %v, want %s", got, want)
+	}
+}
+
+func TestParseDumpFormats(t *testing.T) {
+	for _, tc := range []struct {
+		member, input, want string
+	}{
+		{"a.js", `window.YTD.tweets.part0 = [{"tweet":{"id_str":"7","full_text":"vine.co/v/js1"}}]`, "[js1/7]"},
+		{"v2.json", `{"data":[{"id":"8","author_id":"u1","text":"vine.co/v/v2a"}],"includes":{"users":[{"id":"u1","username":"x"}]}}`, "[v2a/8]"},
+		{"t.csv", "id,text\n9,see vine.co/v/csv1\n", "[csv1/9]"},
+		{"t.txt", "10 https://vine.co/v/txt1\n", "[txt1/10]"},
+	} {
+		if got := parse(t, tc.member, tc.input); fmt.Sprint(got) != tc.want {
+			t.Errorf("%s: got %v, want %s", tc.member, got, tc.want)
+		}
+	}
+}
+
+func TestParseDumpResyncsAcrossBufferRefills(t *testing.T) {
+	var b strings.Builder
+	want := 0
+	for i := 0; i < 5000; i++ {
+		if i%97 == 0 {
+			fmt.Fprintf(&b, "{\"id_str\":\"%d\",\"text\": oops vine.co/v/bad%d\n", i, i)
+		} else {
+			fmt.Fprintf(&b, "{\"id_str\":\"%d\",\"text\":\"https://vine.co/v/s%d %s\"}\n", i, i, strings.Repeat("x", i%300))
+		}
+		want++
+	}
+	if got := parse(t, "big.jsonl", b.String()); len(got) != want {
+		t.Fatalf("got %d slugs, want %d", len(got), want)
+	}
+}
+
+func TestParseDumpSkipsMalformedArrayElements(t *testing.T) {
+	for _, tc := range []struct {
+		member, input, want string
+	}{
+		{"tweets.json", `[
+{"id_str":"1","text":"https://vine.co/v/aaa"},
+{"id_str":"2","text": oops https://vine.co/v/bbb},
+{"id_str":"3","text":"https://vine.co/v/ccc"}
+]`, "[aaa/1 bbb/ ccc/3]"},
+		// Pretty-printed archive: the bad element spans several lines, each
+		// of which is skipped until the next element starts.
+		{"tweets.js", `window.YTD.tweets.part0 = [
+  {
+    "tweet" : {
+      "id_str" : "4",
+      "full_text" : "https://vine.co/v/ddd"
+    }
+  },
+  {
+    "tweet" : {
+      "id_str" : "5",
+      "full_text" : "https://vine.co/v/eee
+    }
+  },
+  {
+    "tweet" : {
+      "id_str" : "6",
+      "full_text" : "https://vine.co/v/fff"
+    }
+  }
+]`, "[ddd/4 eee/ fff/6]"},
+		// A second array after the first is read too.
+		{"two.json", `[{"id_str":"7","text":"vine.co/v/ggg"}]
+[{"id_str":"8","text":"vine.co/v/hhh"}]`, "[ggg/7 hhh/8]"},
+	} {
+		if got := parse(t, tc.member, tc.input); fmt.Sprint(got) != tc.want {
+			t.Errorf("%s: got %v, want %s", tc.member, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// s3input.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3ReaderAt serves zip central-directory lookups with ranged GetObject calls,
+// so a top-level .zip in the bucket is read without downloading it first.
+type s3ReaderAt struct {
+	ctx    context.Context
+	client *s3.Client
+	bucket string
+	key    string
+	size   int64
+}
+
+func (s *s3ReaderAt) Size() int64 { return s.size }
+
+func (s *s3ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p)) - 1
+	if end >= s.size {
+		end = s.size - 1
+	}
+	resp, err := s.client.GetObject(s.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", off, end)),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("GetObject %s range %d-%d: %w", s.key, off, end, err)
+	}
+	defer resp.Body.Close()
+	n, err := io.ReadFull(resp.Body, p[:end-off+1])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// s3Input is the streaming body of an object that can also be read at random
+// offsets; walkInput uses whichever it needs.
+type s3Input struct {
+	io.Reader
+	*s3ReaderAt
+}
@@ -0,0 +1,461 @@
+// sync.go
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"vine-harvester/internal/s3store"
+)
+
+// `vine-harvester sync` publishes a local harvest outDir (profiles, posts,
+// media) to an S3/R2 prefix. What was uploaded is recorded in a manifest
+// (key -> size, mtime, sha256) stored next to the objects, so later syncs
+// only hash files whose size or mtime changed and only upload files whose
+// content did, without listing the bucket. Only keys in the manifest that lie
+// under the current include entries are ever deleted as orphans; objects
+// written by other tools (posts_index.json) are left alone.
+
+const syncManifestFile = "sync_manifest.json.gz"
+
+// saveManifestEvery bounds how much upload progress an interrupted sync can
+// lose: the manifest is written back after this many uploads.
+const saveManifestEvery = 5000
+
+type syncManifest struct {
+	Objects   map[string]syncEntry `json:"objects"`
+	UpdatedAt time.Time            `json:"updatedAt"`
+}
+
+type syncEntry struct {
+	Size   int64  `json:"size"`
+	MTime  int64  `json:"mtime"` // UnixNano of the local file when it was hashed
+	SHA256 string `json:"sha256"`
+}
+
+func loadSyncManifest(ctx context.Context, remote s3store.Path, client *s3.Client) (*syncManifest, bool, error) {
+	m := &syncManifest{Objects: make(map[string]syncEntry)}
+	data, err := readOutFile(ctx, remote, client, syncManifestFile)
+	if errors.Is(err, errOutFileNotFound) {
+		return m, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("loading sync manifest: %w", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, false, fmt.Errorf("decoding sync manifest: %w", err)
+	}
+	defer zr.Close()
+	if err := json.NewDecoder(zr).Decode(m); err != nil {
+		return nil, false, fmt.Errorf("decoding sync manifest: %w", err)
+	}
+	if m.Objects == nil {
+		m.Objects = make(map[string]syncEntry)
+	}
+	return m, true, nil
+}
+
+func (m *syncManifest) save(ctx context.Context, remote s3store.Path, client *s3.Client) error {
+	m.UpdatedAt = time.Now().UTC()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(m); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return writeOutFile(ctx, remote, client, syncManifestFile, buf.Bytes())
+}
+
+// contentTypeFor picks the Content-Type objects are served with. Compressed
+// profiles/posts keep their codec's type; readers decode them by magic bytes.
+func contentTypeFor(key string) string {
+	switch strings.ToLower(filepath.Ext(key)) {
+	case ".json":
+		return "application/json; charset=utf-8"
+	case ".mp4":
+		return "video/mp4"
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	case ".txt":
+		return "text/plain; charset=utf-8"
+	case ".gz":
+		return "application/gzip"
+	case ".zst":
+		return "application/zstd"
+	}
+	return "application/octet-stream"
+}
+
+// syncFile is one local file under the synced outDir; Key is its slash
+// separated path relative to outDir, which is also its key under the prefix.
+type syncFile struct {
+	Key   string
+	Path  string
+	Size  int64
+	MTime int64
+}
+
+// listSyncFiles walks the include entries of root. Leftover *.tmp files from
+// an interrupted write are skipped.
+func listSyncFiles(root string, include []string) ([]syncFile, error) {
+	var files []syncFile
+	for _, inc := range include {
+		start := filepath.Join(root, filepath.FromSlash(inc))
+		err := filepath.WalkDir(start, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if path == start && errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if !d.Type().IsRegular() || strings.HasSuffix(d.Name(), ".tmp") {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, syncFile{
+				Key:   filepath.ToSlash(rel),
+				Path:  path,
+				Size:  info.Size(),
+				MTime: info.ModTime().UnixNano(),
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %w", start, err)
+		}
+	}
+	return files, nil
+}
+
+// underIncludes reports whether key is one of the include entries or lies
+// under one of them.
+func underIncludes(key string, include []string) bool {
+	for _, inc := range include {
+		if key == inc || strings.HasPrefix(key, inc+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// hashFile returns the hex SHA-256 and MD5 of a file in one read; the MD5 is
+// what S3 reports as the ETag of a single-part upload.
+func hashFile(path string) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	sh, mh := sha256.New(), md5.New()
+	if _, err := io.Copy(io.MultiWriter(sh, mh), f); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(sh.Sum(nil)), hex.EncodeToString(mh.Sum(nil)), nil
+}
+
+// listRemoteETags maps every key under the prefix (relative to it) to its
+// ETag. It is only used when there is no manifest yet, so objects that an
+// earlier upload (or a harvest straight to S3) already put there are adopted
+// instead of uploaded again.
+func listRemoteETags(ctx context.Context, client *s3.Client, remote s3store.Path) (map[string]string, error) {
+	etags := make(map[string]string)
+	var token *string
+	for {
+		out, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            aws.String(remote.Bucket),
+			Prefix:            aws.String(remote.Prefix),
+			ContinuationToken: token,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("listing s3://%s/%s: %w", remote.Bucket, remote.Prefix, err)
+		}
+		for _, obj := range out.Contents {
+			key := strings.TrimPrefix(aws.ToString(obj.Key), remote.Prefix)
+			etags[key] = strings.Trim(aws.ToString(obj.ETag), `"`)
+		}
+		if !aws.ToBool(out.IsTruncated) || out.NextContinuationToken == nil {
+			return etags, nil
+		}
+		token = out.NextContinuationToken
+	}
+}
+
+func uploadSyncFile(ctx context.Context, client *s3.Client, remote s3store.Path, f syncFile) error {
+	fh, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	key := remote.Prefix + f.Key
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(remote.Bucket),
+		Key:           aws.String(key),
+		Body:          fh,
+		ContentLength: aws.Int64(f.Size),
+		ContentType:   aws.String(contentTypeFor(f.Key)),
+	})
+	if err != nil {
+		return fmt.Errorf("PutObject %s: %w", key, err)
+	}
+	return nil
+}
+
+// deleteRemote removes keys (relative to the prefix) in batches of 1000, the
+// DeleteObjects limit, and returns the ones that are gone.
+func deleteRemote(ctx context.Context, client *s3.Client, remote s3store.Path, keys []string) ([]string, error) {
+	var deleted []string
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 1000 {
+			n = 1000
+		}
+		batch := keys[:n]
+		keys = keys[n:]
+		ids := make([]types.ObjectIdentifier, len(batch))
+		for i, k := range batch {
+			ids[i] = types.ObjectIdentifier{Key: aws.String(remote.Prefix + k)}
+		}
+		out, err := client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(remote.Bucket),
+			Delete: &types.Delete{Objects: ids, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return deleted, fmt.Errorf("DeleteObjects: %w", err)
+		}
+		failed := make(map[string]bool)
+		for _, e := range out.Errors {
+			key := strings.TrimPrefix(aws.ToString(e.Key), remote.Prefix)
+			log.Printf("error deleting %s: %s %s", key, aws.ToString(e.Code), aws.ToString(e.Message))
+			failed[key] = true
+		}
+		for _, k := range batch {
+			if !failed[k] {
+				deleted = append(deleted, k)
+			}
+		}
+	}
+	return deleted, nil
+}
+
+// syncJob is a file that has to be hashed, with what the manifest recorded
+// for it (Known is false for a file the manifest has never seen).
+type syncJob struct {
+	File  syncFile
+	Prev  syncEntry
+	Known bool
+}
+
+// syncResult is what a worker learned about one file.
+type syncResult struct {
+	File     syncFile
+	Entry    syncEntry
+	Uploaded bool
+	Err      error
+}
+
+func runSync(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	localDir := flags.String("outDir", "", "Local harvest output directory to publish")
+	remoteDir := flags.String("remote", "", "Destination s3://bucket/prefix")
+	include := flags.String("include", "profiles,posts,media,layout.json", "Comma-separated entries of outDir to sync (the harvester's run state is left out)")
+	workers := flags.Int("workers", 16, "Number of concurrent hash/upload workers")
+	deleteOrphans := flags.Bool("delete", false, "Delete remote objects under the include entries that an earlier sync recorded and whose local file is gone")
+	dryRun := flags.Bool("dryRun", false, "Report what would be uploaded and deleted without changing the bucket")
+	flags.Parse(args)
+
+	remote := s3store.ParsePath(*remoteDir)
+	if *localDir == "" || !remote.S3 {
+		return fmt.Errorf("sync needs -outDir <local dir> and -remote s3://bucket/prefix")
+	}
+	var includes []string
+	for _, inc := range strings.Split(*include, ",") {
+		if inc = strings.Trim(strings.TrimSpace(inc), "/"); inc != "" {
+			includes = append(includes, inc)
+		}
+	}
+	client, err := s3store.NewClient(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("S3 client: %w", err)
+	}
+
+	manifest, found, err := loadSyncManifest(ctx, remote, client)
+	if err != nil {
+		return err
+	}
+	var remoteETags map[string]string
+	if found {
+		log.Printf("Sync manifest: %d objects already in s3://%s/%s", len(manifest.Objects), remote.Bucket, remote.Prefix)
+	} else {
+		if remoteETags, err = listRemoteETags(ctx, client, remote); err != nil {
+			return err
+		}
+		log.Printf("No sync manifest yet; %d objects already in s3://%s/%s will be matched by ETag", len(remoteETags), remote.Bucket, remote.Prefix)
+	}
+
+	files, err := listSyncFiles(*localDir, includes)
+	if err != nil {
+		return err
+	}
+	log.Printf("Found %d local files under %s", len(files), *localDir)
+
+	// Files whose size and mtime match the manifest are taken as unchanged
+	// without reading them; everything else is hashed, and uploaded if the
+	// hash differs.
+	local := make(map[string]bool, len(files))
+	var pending []syncJob
+	unchanged := 0
+	for _, f := range files {
+		local[f.Key] = true
+		prev, ok := manifest.Objects[f.Key]
+		if ok && prev.Size == f.Size && prev.MTime == f.MTime {
+			unchanged++
+			continue
+		}
+		pending = append(pending, syncJob{File: f, Prev: prev, Known: ok})
+	}
+
+	workerCount := *workers
+	if workerCount < 1 {
+		workerCount = 1
+	}
+	jobs := make(chan syncJob, workerCount)
+	results := make(chan syncResult, workerCount)
+	var wg sync.WaitGroup
+	for i := 0; i < workerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				f := j.File
+				r := syncResult{File: f, Entry: syncEntry{Size: f.Size, MTime: f.MTime}}
+				var md5hex string
+				r.Entry.SHA256, md5hex, r.Err = hashFile(f.Path)
+				if r.Err == nil {
+					same := j.Known && j.Prev.Size == f.Size && j.Prev.SHA256 == r.Entry.SHA256
+					if !j.Known && remoteETags != nil {
+						same = remoteETags[f.Key] == md5hex
+					}
+					if !same {
+						r.Uploaded = true
+						if !*dryRun {
+							r.Err = uploadSyncFile(ctx, client, remote, f)
+						}
+					}
+				}
+				results <- r
+			}
+		}()
+	}
+	go func() {
+		for _, j := range pending {
+			jobs <- j
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	uploaded, failed, sinceSave := 0, 0, 0
+	var uploadedBytes int64
+	for r := range results {
+		if r.Err != nil {
+			log.Printf("error syncing %s: %v", r.File.Key, r.Err)
+			failed++
+			continue
+		}
+		if r.Uploaded {
+			uploaded++
+			uploadedBytes += r.File.Size
+			if *dryRun {
+				log.Printf("would upload %s (%d bytes)", r.File.Key, r.File.Size)
+				continue
+			}
+			sinceSave++
+		} else {
+			unchanged++
+		}
+		manifest.Objects[r.File.Key] = r.Entry
+		if sinceSave >= saveManifestEvery && !*dryRun {
+			if err := manifest.save(ctx, remote, client); err != nil {
+				log.Printf("error saving sync manifest: %v", err)
+			}
+			sinceSave = 0
+		}
+	}
+
+	// Only keys under this run's include entries can be orphans: anything else
+	// in the manifest was published by a sync with a wider -include and was
+	// not looked at locally this time.
+	var orphans []string
+	for key := range manifest.Objects {
+		if !local[key] && underIncludes(key, includes) {
+			orphans = append(orphans, key)
+		}
+	}
+	sort.Strings(orphans)
+	deleted := 0
+	switch {
+	case len(orphans) == 0:
+	case !*deleteOrphans:
+		log.Printf("%d remote objects no longer exist locally (use -delete to remove them)", len(orphans))
+	case *dryRun:
+		for _, key := range orphans {
+			log.Printf("would delete %s", key)
+		}
+		deleted = len(orphans)
+	default:
+		gone, err := deleteRemote(ctx, client, remote, orphans)
+		for _, key := range gone {
+			delete(manifest.Objects, key)
+		}
+		deleted = len(gone)
+		if err != nil {
+			log.Printf("error deleting orphans: %v", err)
+			failed += len(orphans) - len(gone)
+		}
+	}
+
+	if !*dryRun {
+		if err := manifest.save(ctx, remote, client); err != nil {
+			return fmt.Errorf("saving sync manifest: %w", err)
+		}
+	}
+	log.Printf("Sync complete: %d uploaded (%d bytes), %d unchanged, %d deleted, %d failed", uploaded, uploadedBytes, unchanged, deleted, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d objects failed to sync; run again to retry them", failed)
+	}
+	return nil
+}
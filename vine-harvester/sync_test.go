@@ -0,0 +1,58 @@
+// sync_test.go
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"vine-harvester/internal/s3store/s3test"
+)
+
+func TestSyncDeletesOnlyOrphansUnderInclude(t *testing.T) {
+	srv := s3test.NewServer(t)
+	dir := t.TempDir()
+	put := func(rel, data string) {
+		t.Helper()
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("profiles/1.json", `{"userIdStr":"1"}`)
+	put("profiles/2.json", `{"userIdStr":"2"}`)
+	put("posts/1/11.json", `{"postIdStr":"11"}`)
+	put("media/11.mp4", "mp4")
+	put("layout.json", `{"layout":"flat"}`)
+	sync := func(args ...string) {
+		t.Helper()
+		args = append([]string{"-outDir", dir, "-remote", "s3://vines/pub/", "-delete"}, args...)
+		if err := runSync(context.Background(), args); err != nil {
+			t.Fatalf("sync %v: %v", args, err)
+		}
+	}
+	sync()
+
+	// Everything but profile 2 is gone locally; a sync of profiles alone
+	// must not take posts, media or layout.json with it.
+	for _, rel := range []string{"profiles/1.json", "posts/1/11.json", "media/11.mp4", "layout.json"} {
+		os.Remove(filepath.Join(dir, filepath.FromSlash(rel)))
+	}
+	sync("-include", "profiles")
+
+	got := strings.Join(srv.Keys("vines"), " ")
+	want := "pub/layout.json pub/media/11.mp4 pub/posts/1/11.json pub/profiles/2.json pub/" + syncManifestFile
+	if got != want {
+		t.Fatalf("bucket after -include profiles -delete:\n got %s\nwant %s", got, want)
+	}
+
+	// A later full sync still knows about the rest and removes it then.
+	sync()
+	got = strings.Join(srv.Keys("vines"), " ")
+	if want := "pub/profiles/2.json pub/" + syncManifestFile; got != want {
+		t.Fatalf("bucket after full -delete:\n got %s\nwant %s", got, want)
+	}
+}
@@ -3,118 +3,44 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"vine-harvester/internal/s3store"
+	"vine-harvester/internal/scan"
 )
 
 var (
-	flagInputDir  = flag.String("inputDir", "", "Input directory (local path or s3://bucket/prefix)")
-	flagOutDir    = flag.String("outDir", "", "Output directory (local path or s3://bucket/prefix)")
-	flagWorkers   = flag.Int("workers", 32, "Number of concurrent workers for reading input objects")
-	flagDownload  = flag.Bool("download", false, "Currently unused; reserved for future MP4 downloading")
-	flagLoopEvery = flag.Duration("loopEvery", 0, "If > 0, loop the harvest every given duration (e.g. 10m)")
+	flagInputDir   = flag.String("inputDir", "", "Input directory (local path or s3://bucket/prefix)")
+	flagOutDir     = flag.String("outDir", "", "Output directory (local path or s3://bucket/prefix)")
+	flagWorkers    = flag.Int("workers", 32, "Number of concurrent workers for reading input files/objects")
+	flagDownload   = flag.Bool("download", false, "Currently unused; reserved for future MP4 downloading")
+	flagLoopEvery  = flag.Duration("loopEvery", 0, "If > 0, loop the harvest every given duration (e.g. 10m)")
+	flagDedupMemMB = flag.Int("dedupMemMB", 512, "Memory budget (MiB) per slug set before spilling sorted runs to disk (0 = never spill)")
+	flagTmpDir     = flag.String("tmpDir", "", "Directory for dedup spill files, nested zips and staged uploads (default: system temp dir)")
+	flagCheckpoint = flag.Bool("checkpoint", true, "Keep a checkpoint of scanned inputs (key, ETag, size) in outDir and only rescan new or changed ones")
 )
 
-// Simple helper to read env with a default.
-func getenvDefault(key, def string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
-	}
-	return def
-}
-
-// S3 client initializer that targets Cloudflare R2 (or any S3-compatible endpoint)
-// via the S3_ENDPOINT environment variable.
-func newS3Client() *s3.Client {
-	region := getenvDefault("AWS_REGION", "auto")
-
-	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
-	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
-	endpoint := os.Getenv("S3_ENDPOINT") // e.g. https://<ACCOUNT_ID>.r2.cloudflarestorage.com
-
-	if accessKey == "" || secretKey == "" || endpoint == "" {
-		log.Fatalf("AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and S3_ENDPOINT must be set for S3/R2 access")
-	}
-
-	cfg, err := config.LoadDefaultConfig(
-		context.TODO(),
-		config.WithRegion(region),
-		config.WithCredentialsProvider(
-			credentials.NewStaticCredentialsProvider(accessKey, secretKey, ""),
-		),
-		config.WithEndpointResolverWithOptions(
-			aws.EndpointResolverWithOptionsFunc(
-				func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-					if service == s3.ServiceID {
-						return aws.Endpoint{
-							URL:               endpoint,
-							HostnameImmutable: true,
-						}, nil
-					}
-					return aws.Endpoint{}, &aws.EndpointNotFoundError{}
-				},
-			),
-		),
-	)
-	if err != nil {
-		log.Fatalf("failed to load AWS config: %v", err)
-	}
-
-	return s3.NewFromConfig(cfg)
-}
-
-// Represents either an S3 path or a local path.
-type s3Path struct {
-	Bucket string
-	Prefix string
-	Local  string
-	S3     bool
-}
-
-func parsePath(p string) s3Path {
-	if strings.HasPrefix(p, "s3://") {
-		rest := strings.TrimPrefix(p, "s3://")
-		parts := strings.SplitN(rest, "/", 2)
-		bucket := parts[0]
-		prefix := ""
-		if len(parts) == 2 {
-			prefix = parts[1]
-		}
-		if prefix != "" && !strings.HasSuffix(prefix, "/") {
-			prefix += "/"
-		}
-		return s3Path{
-			Bucket: bucket,
-			Prefix: prefix,
-			S3:     true,
-		}
-	}
-	return s3Path{
-		Local: p,
-		S3:    false,
-	}
-}
-
-// Finds all *.txt objects in an S3 bucket/prefix.
-func listTxtObjects(ctx context.Context, client *s3.Client, sp s3Path) ([]types.Object, error) {
+// Finds all input objects (*.txt and their compressed/archived forms) in an
+// S3 bucket/prefix.
+func listInputObjects(ctx context.Context, client *s3.Client, sp s3store.Path) ([]types.Object, error) {
 	log.Printf("Listing objects in bucket=%s prefix=%s", sp.Bucket, sp.Prefix)
 
-	var txtObjects []types.Object
+	var inputObjects []types.Object
 	var token *string
 
 	for {
@@ -128,55 +54,51 @@ func listTxtObjects(ctx context.Context, client *s3.Client, sp s3Path) ([]types.
 		}
 
 		for _, obj := range out.Contents {
-			if strings.HasSuffix(strings.ToLower(*obj.Key), ".txt") {
-				txtObjects = append(txtObjects, obj)
+			if scan.IsCandidate(*obj.Key) {
+				inputObjects = append(inputObjects, obj)
 			}
 		}
 
-		if out.IsTruncated && out.NextContinuationToken != nil {
+		if aws.ToBool(out.IsTruncated) && out.NextContinuationToken != nil {
 			token = out.NextContinuationToken
 		} else {
 			break
 		}
 	}
 
-	return txtObjects, nil
+	return inputObjects, nil
 }
 
-// Extracts Vine slugs from a text blob by regex searching for vine.co/v/SLUG.
-var vineSlugRe = regexp.MustCompile(`vine\.co/v/([A-Za-z0-9]+)`)
-
-func extractSlugsFromReader(r io.Reader, slugs map[string]struct{}, mu *sync.Mutex) error {
-	scanner := bufio.NewScanner(r)
-	// Increase buffer in case some lines are huge.
-	const maxCapacity = 1024 * 1024
-	buf := make([]byte, 64*1024)
-	scanner.Buffer(buf, maxCapacity)
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		matches := vineSlugRe.FindAllStringSubmatch(line, -1)
-		if len(matches) == 0 {
-			continue
-		}
-		mu.Lock()
-		for _, m := range matches {
-			if len(m) >= 2 {
-				slug := m[1]
-				slugs[slug] = struct{}{}
-			}
+// scanStats counts what one input file contributed.
+type scanStats struct {
+	Bytes   int64
+	Matches int64
+}
+
+// Extracts Vine slugs from a stream by matching vine.co/v/SLUG in fixed-size
+// chunks, so arbitrarily long lines (minified JSON dumps) are handled without
+// buffering them whole.
+func extractSlugsFromReader(r io.Reader, slugs *scan.Set, stats *scanStats) error {
+	var addErr error
+	m := &scan.Matcher{Emit: func(slug, _ string) {
+		if addErr == nil {
+			addErr = slugs.Add(slug)
 		}
-		mu.Unlock()
-	}
+	}}
+	_, err := io.CopyBuffer(m, r, make([]byte, 256*1024))
+	m.Flush()
 
-	if err := scanner.Err(); err != nil {
+	stats.Bytes += m.Bytes
+	stats.Matches += m.Matches
+	if err != nil {
 		return fmt.Errorf("scanning input: %w", err)
 	}
-	return nil
+	return addErr
 }
 
-// Read a single S3 object and extract Vine slugs.
-func processS3Object(ctx context.Context, client *s3.Client, bucket, key string, slugs map[string]struct{}, mu *sync.Mutex) error {
+// Read a single S3 object (decompressing / unpacking as needed) and extract
+// Vine slugs.
+func processS3Object(ctx context.Context, client *s3.Client, bucket, key string, size int64, slugs *scan.Set) error {
 	resp, err := client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
@@ -186,17 +108,27 @@ func processS3Object(ctx context.Context, client *s3.Client, bucket, key string,
 	}
 	defer resp.Body.Close()
 
-	return extractSlugsFromReader(resp.Body, slugs, mu)
+	in := s3Input{
+		Reader:     resp.Body,
+		s3ReaderAt: &s3ReaderAt{ctx: ctx, client: client, bucket: bucket, key: key, size: size},
+	}
+	name := "s3://" + bucket + "/" + key
+	var stats scanStats
+	err = scan.Walk(name, in, scan.WithProgress(name, func(member string, r io.Reader) error {
+		return extractSlugsFromReader(r, slugs, &stats)
+	}))
+	log.Printf("%s: %d bytes, %d Vine URLs", name, stats.Bytes, stats.Matches)
+	return err
 }
 
-// For local inputDir: walk *.txt files.
-func listLocalTxtFiles(sp s3Path) ([]string, error) {
+// For local inputDir: walk *.txt files and their compressed/archived forms.
+func listLocalInputFiles(sp s3store.Path) ([]string, error) {
 	var files []string
 	err := filepath.Walk(sp.Local, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if info.Mode().IsRegular() && strings.HasSuffix(strings.ToLower(info.Name()), ".txt") {
+		if info.Mode().IsRegular() && scan.IsCandidate(info.Name()) {
 			files = append(files, path)
 		}
 		return nil
@@ -207,143 +139,436 @@ func listLocalTxtFiles(sp s3Path) ([]string, error) {
 	return files, nil
 }
 
-func processLocalFile(path string, slugs map[string]struct{}, mu *sync.Mutex) error {
-	f, err := os.Open(path)
+func processLocalFile(path string, slugs *scan.Set) error {
+	var stats scanStats
+	err := scan.WalkFile(path, func(member string, r io.Reader) error {
+		return extractSlugsFromReader(r, slugs, &stats)
+	})
+	log.Printf("%s: %d bytes, %d Vine URLs", path, stats.Bytes, stats.Matches)
+	return err
+}
+
+// slugFile streams a sorted slug list to a temporary file and then moves it
+// into outDir (or uploads it), so lists larger than memory can be written.
+type slugFile struct {
+	out  s3store.Path
+	name string
+	tmp  string
+	f    *os.File
+	w    *bufio.Writer
+	n    int64
+}
+
+func createSlugFile(out s3store.Path, name string) (*slugFile, error) {
+	var f *os.File
+	var err error
+	if out.S3 {
+		f, err = os.CreateTemp(*flagTmpDir, "vine-slugs-*.txt")
+	} else {
+		dest := filepath.Join(out.Local, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+			return nil, fmt.Errorf("creating %s: %w", filepath.Dir(dest), err)
+		}
+		f, err = os.Create(dest + ".tmp")
+	}
 	if err != nil {
-		return fmt.Errorf("open %s: %w", path, err)
+		return nil, err
 	}
-	defer f.Close()
-	return extractSlugsFromReader(f, slugs, mu)
+	return &slugFile{out: out, name: name, tmp: f.Name(), f: f, w: bufio.NewWriterSize(f, 1<<20)}, nil
 }
 
-// Writes the collected slugs into outDir as vine_slugs.txt (S3 or local).
-func writeSlugs(ctx context.Context, out s3Path, client *s3.Client, slugs map[string]struct{}) error {
-	// Turn map into sorted slice (optional; unsorted is fine too).
-	var list []string
-	for slug := range slugs {
-		list = append(list, slug)
+func (sf *slugFile) Add(slug string) {
+	sf.w.WriteString(slug)
+	sf.w.WriteByte('\n')
+	sf.n++
+}
+
+// Abort discards the file when writing failed part-way.
+func (sf *slugFile) Abort() {
+	sf.f.Close()
+	os.Remove(sf.tmp)
+}
+
+func (sf *slugFile) Commit(ctx context.Context, client *s3.Client) error {
+	if err := sf.w.Flush(); err != nil {
+		sf.Abort()
+		return err
+	}
+	if !sf.out.S3 {
+		if err := sf.f.Close(); err != nil {
+			os.Remove(sf.tmp)
+			return err
+		}
+		dest := filepath.Join(sf.out.Local, filepath.FromSlash(sf.name))
+		if err := os.Rename(sf.tmp, dest); err != nil {
+			return fmt.Errorf("writing %s: %w", dest, err)
+		}
+		log.Printf("Wrote %s (%d slugs)", dest, sf.n)
+		return nil
+	}
+
+	defer sf.Abort()
+	if _, err := sf.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	key := sf.out.Prefix + sf.name
+	_, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(sf.out.Bucket),
+		Key:    aws.String(key),
+		Body:   sf.f,
+	})
+	if err != nil {
+		return fmt.Errorf("PutObject %s: %w", key, err)
+	}
+	log.Printf("Wrote s3://%s/%s (%d slugs)", sf.out.Bucket, key, sf.n)
+	return nil
+}
+
+// Streams a slug list written earlier into set. A missing file adds nothing.
+func loadSlugs(ctx context.Context, out s3store.Path, client *s3.Client, name string, set *scan.Set) (int64, error) {
+	var body io.ReadCloser
+	if out.S3 {
+		key := out.Prefix + name
+		resp, err := client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(out.Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			var nsk *types.NoSuchKey
+			if errors.As(err, &nsk) {
+				return 0, nil
+			}
+			return 0, fmt.Errorf("GetObject %s: %w", key, err)
+		}
+		body = resp.Body
+	} else {
+		f, err := os.Open(filepath.Join(out.Local, filepath.FromSlash(name)))
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		body = f
 	}
-	// Not strictly required, but nicer / deterministic.
-	// sort.Strings(list)
+	defer body.Close()
+
+	var n int64
+	sc := bufio.NewScanner(body)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			if err := set.Add(line); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, sc.Err()
+}
 
-	var builder strings.Builder
-	for _, slug := range list {
-		builder.WriteString(slug)
-		builder.WriteByte('\n')
+// mergeSlugs walks two sorted sets together, writing their union to all and
+// the slugs only present in scanned to delta (which may be nil).
+func mergeSlugs(existing, scanned *scan.Set, all, delta *slugFile) error {
+	a, err := existing.Iter()
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	b, err := scanned.Iter()
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	hasA, hasB := a.Next(), b.Next()
+	for hasA || hasB {
+		switch {
+		case hasA && (!hasB || a.Key() < b.Key()):
+			all.Add(a.Key())
+			hasA = a.Next()
+		case hasB && (!hasA || b.Key() < a.Key()):
+			all.Add(b.Key())
+			if delta != nil {
+				delta.Add(b.Key())
+			}
+			hasB = b.Next()
+		default:
+			all.Add(a.Key())
+			hasA, hasB = a.Next(), b.Next()
+		}
 	}
-	data := []byte(builder.String())
+	if err := a.Err(); err != nil {
+		return err
+	}
+	return b.Err()
+}
 
+var errOutFileNotFound = errors.New("not found")
+
+// Writes data to outDir/name (S3 or local).
+func writeOutFile(ctx context.Context, out s3store.Path, client *s3.Client, name string, data []byte) error {
 	if out.S3 {
-		key := out.Prefix + "vine_slugs.txt"
+		key := out.Prefix + name
 		_, err := client.PutObject(ctx, &s3.PutObjectInput{
 			Bucket: aws.String(out.Bucket),
 			Key:    aws.String(key),
-			Body:   strings.NewReader(string(data)),
+			Body:   bytes.NewReader(data),
 		})
 		if err != nil {
 			return fmt.Errorf("PutObject %s: %w", key, err)
 		}
-		log.Printf("Wrote slugs to s3://%s/%s", out.Bucket, key)
+		log.Printf("Wrote s3://%s/%s", out.Bucket, key)
 		return nil
 	}
 
 	// Local path
-	if err := os.MkdirAll(out.Local, 0o755); err != nil {
-		return fmt.Errorf("creating outDir %s: %w", out.Local, err)
+	dest := filepath.Join(out.Local, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return fmt.Errorf("creating %s: %w", filepath.Dir(dest), err)
+	}
+	tmp := dest + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("writing %s: %w", dest, err)
 	}
-	dest := filepath.Join(out.Local, "vine_slugs.txt")
-	if err := os.WriteFile(dest, data, 0o644); err != nil {
+	if err := os.Rename(tmp, dest); err != nil {
 		return fmt.Errorf("writing %s: %w", dest, err)
 	}
-	log.Printf("Wrote slugs to %s", dest)
+	log.Printf("Wrote %s", dest)
 	return nil
 }
 
+// Reads outDir/name (S3 or local); errOutFileNotFound if it doesn't exist yet.
+func readOutFile(ctx context.Context, out s3store.Path, client *s3.Client, name string) ([]byte, error) {
+	if out.S3 {
+		key := out.Prefix + name
+		resp, err := client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(out.Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			var nsk *types.NoSuchKey
+			if errors.As(err, &nsk) {
+				return nil, errOutFileNotFound
+			}
+			return nil, fmt.Errorf("GetObject %s: %w", key, err)
+		}
+		defer resp.Body.Close()
+		return io.ReadAll(resp.Body)
+	}
+
+	data, err := os.ReadFile(filepath.Join(out.Local, filepath.FromSlash(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errOutFileNotFound
+	}
+	return data, err
+}
+
+// commitSlugFiles publishes a pass's full slug list and its delta (nil
+// without a checkpoint). The delta goes first: should the full list then
+// fail, the next pass still finds these slugs missing from it and lists them
+// again, whereas the other order would drop them from every delta for good.
+func commitSlugFiles(ctx context.Context, client *s3.Client, all, delta *slugFile) error {
+	if delta != nil {
+		if err := delta.Commit(ctx, client); err != nil {
+			all.Abort()
+			return err
+		}
+	}
+	return all.Commit(ctx, client)
+}
+
 func runOnce(ctx context.Context) error {
 	if *flagInputDir == "" || *flagOutDir == "" {
 		return fmt.Errorf("inputDir and outDir are required")
 	}
 
-	inPath := parsePath(*flagInputDir)
-	outPath := parsePath(*flagOutDir)
+	inPath := s3store.ParsePath(*flagInputDir)
+	outPath := s3store.ParsePath(*flagOutDir)
 
 	s3Client := (*s3.Client)(nil)
 	if inPath.S3 || outPath.S3 {
-		s3Client = newS3Client()
+		var err error
+		if s3Client, err = s3store.NewClient(ctx, nil); err != nil {
+			return fmt.Errorf("S3 client: %w", err)
+		}
 	}
 
-	slugs := make(map[string]struct{})
-	var mu sync.Mutex
-
-	if inPath.S3 {
-		log.Printf("=== Scanning %s for Vine video URLs (S3/R2) ===", *flagInputDir)
-		objs, err := listTxtObjects(ctx, s3Client, inPath)
+	memLimit := int64(*flagDedupMemMB) << 20
+	slugs := scan.NewSet(*flagTmpDir, memLimit)
+	defer slugs.Close()
+	existing := scan.NewSet(*flagTmpDir, memLimit)
+	defer existing.Close()
+
+	// With a checkpoint, only objects that are new or changed since the last
+	// pass are scanned, and their slugs are merged into the existing set.
+	var cp *scanCheckpoint
+	if *flagCheckpoint {
+		var err error
+		cp, err = loadCheckpoint(ctx, outPath, s3Client)
 		if err != nil {
 			return err
 		}
-		log.Printf("Found %d .txt objects in S3/R2", len(objs))
-
-		// Worker pool for parallel object processing
-		type job struct {
-			Key string
+		n, err := loadSlugs(ctx, outPath, s3Client, slugsFile, existing)
+		if err != nil {
+			return fmt.Errorf("loading existing slugs: %w", err)
 		}
+		log.Printf("Checkpoint: %d objects already scanned, %d slugs already known", len(cp.Objects), n)
+	}
+	seen := make(map[string]checkpointEntry)
+	skipped := 0
+
+	// Both input kinds feed the same worker pool; each job scans one file or
+	// object into the sharded slug set.
+	type job struct {
+		Name  string
+		Entry checkpointEntry
+		Run   func() error
+	}
 
-		jobs := make(chan job, *flagWorkers)
-		var wg sync.WaitGroup
-
-		workerCount := *flagWorkers
-		if workerCount < 1 {
-			workerCount = 1
-		}
+	workerCount := *flagWorkers
+	if workerCount < 1 {
+		workerCount = 1
+	}
 
-		for i := 0; i < workerCount; i++ {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				for j := range jobs {
-					if err := processS3Object(ctx, s3Client, inPath.Bucket, j.Key, slugs, &mu); err != nil {
-						log.Printf("error processing %s: %v", j.Key, err)
-					}
+	jobs := make(chan job, workerCount)
+	var wg sync.WaitGroup
+
+	for i := 0; i < workerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if err := j.Run(); err != nil {
+					log.Printf("error processing %s: %v", j.Name, err)
+					continue
 				}
-			}()
+				cp.markDone(j.Name, j.Entry)
+			}
+		}()
+	}
+
+	if inPath.S3 {
+		log.Printf("=== Scanning %s for Vine video URLs (S3/R2) ===", *flagInputDir)
+		objs, err := listInputObjects(ctx, s3Client, inPath)
+		if err != nil {
+			close(jobs)
+			wg.Wait()
+			return err
 		}
+		log.Printf("Found %d input objects in S3/R2", len(objs))
 
 		for _, obj := range objs {
+			if slugs.Err() != nil {
+				break
+			}
 			if obj.Key == nil {
 				continue
 			}
-			jobs <- job{Key: *obj.Key}
+			key, size := *obj.Key, aws.ToInt64(obj.Size)
+			entry := checkpointEntry{ETag: aws.ToString(obj.ETag), Size: size}
+			seen[key] = entry
+			if cp.unchanged(key, entry) {
+				skipped++
+				continue
+			}
+			jobs <- job{Name: key, Entry: entry, Run: func() error {
+				return processS3Object(ctx, s3Client, inPath.Bucket, key, size, slugs)
+			}}
 		}
-		close(jobs)
-		wg.Wait()
 
 	} else {
 		log.Printf("=== Scanning %s for Vine video URLs (local) ===", inPath.Local)
-		files, err := listLocalTxtFiles(inPath)
+		files, err := listLocalInputFiles(inPath)
 		if err != nil {
-			return fmt.Errorf("listing local txt files: %w", err)
+			close(jobs)
+			wg.Wait()
+			return fmt.Errorf("listing local input files: %w", err)
 		}
-		log.Printf("Found %d .txt files locally", len(files))
+		log.Printf("Found %d input files locally", len(files))
 
 		for _, path := range files {
-			if err := processLocalFile(path, slugs, &mu); err != nil {
+			if slugs.Err() != nil {
+				break
+			}
+			path := path
+			fi, err := os.Stat(path)
+			if err != nil {
 				log.Printf("error processing %s: %v", path, err)
+				continue
+			}
+			// Local files have no ETag; the modification time stands in for it.
+			entry := checkpointEntry{ETag: fi.ModTime().UTC().Format(time.RFC3339Nano), Size: fi.Size()}
+			seen[path] = entry
+			if cp.unchanged(path, entry) {
+				skipped++
+				continue
 			}
+			jobs <- job{Name: path, Entry: entry, Run: func() error {
+				return processLocalFile(path, slugs)
+			}}
 		}
 	}
+	close(jobs)
+	wg.Wait()
+	// A failed spill stops the feed above; the checkpoint is not saved, so
+	// the next pass scans these inputs again.
+	if err := slugs.Err(); err != nil {
+		return fmt.Errorf("collecting slugs: %w", err)
+	}
 
-	log.Printf("Collected %d unique Vine slugs", len(slugs))
+	all, err := createSlugFile(outPath, slugsFile)
+	if err != nil {
+		return err
+	}
+	var delta *slugFile
+	if cp != nil {
+		// Newly discovered slugs go to their own file so downstream harvesting
+		// can pick up just the delta.
+		deltaName := "deltas/vine_slugs_" + time.Now().UTC().Format("20060102T150405.000Z") + ".txt"
+		if delta, err = createSlugFile(outPath, deltaName); err != nil {
+			all.Abort()
+			return err
+		}
+	}
+	if err := mergeSlugs(existing, slugs, all, delta); err != nil {
+		all.Abort()
+		if delta != nil {
+			delta.Abort()
+		}
+		return fmt.Errorf("merging slugs: %w", err)
+	}
+	newCount := all.n
+	if delta != nil {
+		newCount = delta.n
+	}
+	log.Printf("Collected %d unique Vine slugs (%d new this pass, %d unchanged inputs skipped)", all.n, newCount, skipped)
 
-	if err := writeSlugs(ctx, outPath, s3Client, slugs); err != nil {
+	if err := commitSlugFiles(ctx, s3Client, all, delta); err != nil {
 		return err
 	}
 
+	if cp != nil {
+		cp.prune(seen)
+		if err := cp.save(ctx, outPath, s3Client); err != nil {
+			return err
+		}
+	}
+
 	log.Printf("Scan complete.")
 	return nil
 }
 
 func main() {
+	// `vine-harvester sync ...` publishes a harvest outDir instead of scanning.
+	if len(os.Args) > 1 && os.Args[1] == "sync" {
+		if err := runSync(context.Background(), os.Args[2:]); err != nil {
+			log.Fatalf("sync failed: %v", err)
+		}
+		return
+	}
+
 	flag.Parse()
+	scan.TempDir = *flagTmpDir
 
 	if *flagInputDir == "" || *flagOutDir == "" {
 		log.Fatalf("inputDir and outDir are required")
@@ -0,0 +1,119 @@
+// vine_full_harvest_test.go
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"vine-harvester/internal/s3store"
+)
+
+// localScan points the scanner flags at fresh local directories.
+func localScan(t *testing.T) (in, out string) {
+	t.Helper()
+	in, out = t.TempDir(), t.TempDir()
+	*flagInputDir, *flagOutDir, *flagTmpDir = in, out, t.TempDir()
+	*flagCheckpoint = true
+	return in, out
+}
+
+func readCheckpoint(t *testing.T, out string) map[string]checkpointEntry {
+	t.Helper()
+	var cp scanCheckpoint
+	data, err := os.ReadFile(filepath.Join(out, checkpointFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		t.Fatal(err)
+	}
+	return cp.Objects
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Fields(string(data))
+}
+
+func deltas(t *testing.T, out string) [][]string {
+	t.Helper()
+	paths, _ := filepath.Glob(filepath.Join(out, "deltas", "*.txt"))
+	sort.Strings(paths)
+	var all [][]string
+	for _, p := range paths {
+		all = append(all, readLines(t, p))
+	}
+	return all
+}
+
+func TestRunOnceLeavesPartlyReadInputsUnchecked(t *testing.T) {
+	in, out := localScan(t)
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("vine.co/v/lost"))
+	zw.Close()
+	var zbuf bytes.Buffer
+	w := zip.NewWriter(&zbuf)
+	f, _ := w.Create("ok.txt")
+	f.Write([]byte("1 https://vine.co/v/zipped\n"))
+	f, _ = w.Create("torn.txt.gz")
+	f.Write(gz.Bytes()[:gz.Len()-6])
+	w.Close()
+
+	os.WriteFile(filepath.Join(in, "plain.txt"), []byte("2 https://vine.co/v/plain\n"), 0644)
+	os.WriteFile(filepath.Join(in, "dump.zip"), zbuf.Bytes(), 0644)
+
+	if err := runOnce(context.Background()); err != nil {
+		t.Fatalf("runOnce: %v", err)
+	}
+
+	cp := readCheckpoint(t, out)
+	if _, ok := cp[filepath.Join(in, "plain.txt")]; !ok {
+		t.Errorf("plain.txt not checkpointed: %v", cp)
+	}
+	if _, ok := cp[filepath.Join(in, "dump.zip")]; ok {
+		t.Errorf("dump.zip checkpointed although one member failed")
+	}
+	// Slugs from the members that could be read are kept all the same.
+	if got := strings.Join(readLines(t, filepath.Join(out, slugsFile)), " "); got != "plain zipped" {
+		t.Errorf("slugs = %q", got)
+	}
+}
+
+func TestCommitSlugFilesKeepsDeltaWhenListFails(t *testing.T) {
+	out := s3store.ParsePath(t.TempDir())
+	all, err := createSlugFile(out, slugsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta, err := createSlugFile(out, "deltas/vine_slugs_1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all.Add("first")
+	delta.Add("first")
+
+	// A directory in the way makes the final rename of the full list fail.
+	if err := os.MkdirAll(filepath.Join(out.Local, slugsFile, "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitSlugFiles(context.Background(), nil, all, delta); err == nil {
+		t.Fatal("commitSlugFiles succeeded without writing the full list")
+	}
+	if d := deltas(t, out.Local); len(d) != 1 || strings.Join(d[0], " ") != "first" {
+		t.Fatalf("deltas after failed commit = %v", d)
+	}
+}